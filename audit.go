@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// commandAudit is the command reporting the terms of the published records
+// that authorize far more senders than intended, or that should not be used,
+// instead of flattening them.
+const commandAudit = "audit"
+
+// writeAudit writes the terms of the records in the tree that effectively
+// authorize the whole internet, which flattening would otherwise carry over
+// silently, and the ptr mechanisms that RFC 7208 section 5.5 discourages.
+// It reports whether none was found.
+func writeAudit(w io.Writer, result *spfflatten.Result) bool {
+	var findings []string
+	var walk func(nodes []*spfflatten.Node)
+	walk = func(nodes []*spfflatten.Node) {
+		for _, node := range nodes {
+			switch node.All {
+			case "+all":
+				findings = append(findings, fmt.Sprintf("%s: +all authorizes every sender on the internet", auditLocation(node)))
+			case "all":
+				findings = append(findings, fmt.Sprintf("%s: all without a qualifier defaults to +all, which authorizes every sender on the internet", auditLocation(node)))
+			}
+			for _, ptr := range node.PTR {
+				findings = append(findings, fmt.Sprintf("%s: %s should not be used (RFC 7208 section 5.5), as it is slow, unreliable on DNS errors and burdens the .arpa name servers", auditLocation(node), ptr))
+			}
+			walk(node.Children)
+		}
+	}
+
+	for _, root := range result.Tree {
+		switch policy, ok := rootPolicy(root); {
+		case !ok:
+		case policy == "?all":
+			findings = append(findings, fmt.Sprintf("%s: ?all leaves every sender not listed neutral, which receivers treat like having no SPF record", root.Domain))
+		case policy == "":
+			findings = append(findings, fmt.Sprintf("%s: no all mechanism leaves every sender not listed neutral, like ?all", root.Domain))
+		}
+		walk([]*spfflatten.Node{root})
+	}
+
+	for _, entry := range result.Entries {
+		if entry.Source == "" {
+			continue
+		}
+		if prefix := entry.Prefix(); prefix.IsValid() && prefix.Bits() == 0 {
+			findings = append(findings, fmt.Sprintf("%s: %s mechanism authorizing %s covers every IPv%d address", entry.Source, entry.Mechanism, entry.IP, ipVersion(entry)))
+		}
+	}
+
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "No overly permissive or discouraged terms found")
+		return true
+	}
+	for _, finding := range findings {
+		fmt.Fprintln(w, finding)
+	}
+	return false
+}
+
+// auditLocation returns the domain of node along with how its parent
+// record referenced it.
+func auditLocation(node *spfflatten.Node) string {
+	if parent := node.Parent(); parent != nil {
+		return fmt.Sprintf("%s:%s in %s", node.Via, node.Domain, parent.Domain)
+	}
+	return node.Domain
+}
+
+// rootPolicy returns the all mechanism that applies to senders the record
+// of the top-level include domain root does not list, following redirect=
+// when the record has none. It reports false when the policy is unknown
+// because a redirect target was visited elsewhere.
+func rootPolicy(root *spfflatten.Node) (string, bool) {
+	node := root
+	for node.All == "" {
+		var redirect *spfflatten.Node
+		for _, child := range node.Children {
+			if child.Via == "redirect" {
+				redirect = child
+			}
+		}
+		if redirect == nil {
+			return "", true
+		}
+		if redirect.Repeated {
+			return "", false
+		}
+		node = redirect
+	}
+	return node.All, true
+}
+
+// ipVersion returns 4 or 6 depending on the address family of entry.
+func ipVersion(entry spfflatten.Entry) int {
+	if entry.Prefix().Addr().Is4() {
+		return 4
+	}
+	return 6
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerAzure = "azure"
+
+func init() {
+	spfpublish.Register(providerAzure, newAzure)
+}
+
+// Azure Resource Manager endpoints and the version of the DNS API.
+const (
+	azureEndpoint      = "https://management.azure.com"
+	azureAuthorityHost = "https://login.microsoftonline.com"
+	azureDNSVersion    = "2018-05-01"
+)
+
+// azureIMDSEndpoint is the Azure Instance Metadata Service issuing the
+// tokens of the managed identities of virtual machines, which is only given
+// azureIMDSTimeout to answer, as it is unreachable outside Azure. It is a
+// variable for the tests to replace.
+var azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+const azureIMDSTimeout = 2 * time.Second
+
+// azureServicePrincipal is the service principal requests are authorized
+// for, with the fields printed by az ad sp create-for-rbac.
+type azureServicePrincipal struct {
+	AppID    string `json:"appId"`
+	Password string `json:"password"`
+	Tenant   string `json:"tenant"`
+}
+
+// azure publishes records through the Azure DNS API of Azure Resource
+// Manager. It authenticates with the first of these credentials that is
+// available, in the order of the DefaultAzureCredential of azidentity: the
+// client secret of a service principal, from AZURE_TENANT_ID,
+// AZURE_CLIENT_ID and AZURE_CLIENT_SECRET or from the output of az ad sp
+// create-for-rbac saved to -credentials; a workload identity, from the
+// federated token of AZURE_FEDERATED_TOKEN_FILE; a managed identity; and
+// the account signed in to the Azure CLI. The zone is looked up in the
+// subscription of AZURE_SUBSCRIPTION_ID.
+type azure struct {
+	spfpublish.Config
+	principal    azureServicePrincipal
+	subscription string
+	header       http.Header
+	zoneID       string
+}
+
+// azureRecordSet is a TXT record set of the Azure DNS API, each record of
+// which is made of character-strings.
+type azureRecordSet struct {
+	Etag       string `json:"etag,omitempty"`
+	Properties struct {
+		TTL        int              `json:"TTL"`
+		TXTRecords []azureTXTRecord `json:"TXTRecords"`
+	} `json:"properties"`
+}
+
+// azureTXTRecord is a TXT record of an Azure DNS record set.
+type azureTXTRecord struct {
+	Value []string `json:"value"`
+}
+
+// newAzure returns a publisher for the Azure DNS zone of config.
+func newAzure(config spfpublish.Config) (spfpublish.Publisher, error) {
+	principal := azureServicePrincipal{
+		AppID:    os.Getenv("AZURE_CLIENT_ID"),
+		Password: os.Getenv("AZURE_CLIENT_SECRET"),
+		Tenant:   os.Getenv("AZURE_TENANT_ID"),
+	}
+	if config.Credentials != "" {
+		data, err := os.ReadFile(config.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &principal); err != nil {
+			return nil, fmt.Errorf("invalid service principal file %s: %w", config.Credentials, err)
+		}
+	}
+	if principal.Password != "" && (principal.AppID == "" || principal.Tenant == "") {
+		return nil, errors.New("incomplete service principal: set AZURE_TENANT_ID and AZURE_CLIENT_ID along with AZURE_CLIENT_SECRET")
+	}
+	subscription := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	if subscription == "" {
+		return nil, errors.New("no subscription: set AZURE_SUBSCRIPTION_ID")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = azureEndpoint
+	}
+	return &azure{Config: config, principal: principal, subscription: subscription}, nil
+}
+
+// authorize obtains an access token the first time, see token.
+func (a *azure) authorize(ctx context.Context) error {
+	if a.header != nil {
+		return nil
+	}
+	token, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+	a.header = http.Header{"Authorization": {"Bearer " + token}}
+	return nil
+}
+
+// token obtains an access token from the first of the credentials of azure
+// that is available. The client secret and the workload identity are used
+// when they are configured, while the managed identity and the Azure CLI
+// are tried in turn, failing with the errors of both.
+func (a *azure) token(ctx context.Context) (string, error) {
+	resource := strings.TrimSuffix(a.Endpoint, "/")
+	if a.principal.Password != "" {
+		return a.clientToken(ctx, a.principal.Tenant, a.principal.AppID, url.Values{"client_secret": {a.principal.Password}})
+	}
+	if file := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" {
+		tenant, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+		if tenant == "" || clientID == "" {
+			return "", errors.New("incomplete workload identity: set AZURE_TENANT_ID and AZURE_CLIENT_ID along with AZURE_FEDERATED_TOKEN_FILE")
+		}
+		// The token is read on each use, as it is rotated on disk
+		assertion, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the federated token: %w", err)
+		}
+		return a.clientToken(ctx, tenant, clientID, url.Values{
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		})
+	}
+
+	token, managedErr := a.managedIdentityToken(ctx, resource)
+	if managedErr == nil {
+		return token, nil
+	}
+	token, cliErr := azureCLIToken(ctx, resource)
+	if cliErr == nil {
+		return token, nil
+	}
+	return "", fmt.Errorf("no credentials: set AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET, pass -credentials, or run with a workload or managed identity or after az login (managed identity: %v; Azure CLI: %v)", managedErr, cliErr)
+}
+
+// clientToken requests an access token for the application clientID of
+// tenant with the OAuth 2.0 client credentials grant, authenticated by the
+// client secret or assertion of credentials.
+func (a *azure) clientToken(ctx context.Context, tenant, clientID string, credentials url.Values) (string, error) {
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = azureAuthorityHost
+	}
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {clientID},
+		"scope":      {strings.TrimSuffix(a.Endpoint, "/") + "/.default"},
+	}
+	for key, values := range credentials {
+		form[key] = values
+	}
+	return requestToken(ctx, a.Client, strings.TrimSuffix(authority, "/")+"/"+url.PathEscape(tenant)+"/oauth2/v2.0/token", form)
+}
+
+// managedIdentityToken requests an access token for resource from the
+// managed identity of the host: from IDENTITY_ENDPOINT, authenticated by
+// IDENTITY_HEADER, on App Service, Functions and Container Apps, or from
+// the Instance Metadata Service on virtual machines. AZURE_CLIENT_ID selects
+// a user-assigned identity rather than the system-assigned one.
+func (a *azure) managedIdentityToken(ctx context.Context, resource string) (string, error) {
+	query := url.Values{"resource": {resource}}
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	endpoint, header := azureIMDSEndpoint, http.Header{"Metadata": {"true"}}
+	if identityEndpoint, secret := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); identityEndpoint != "" && secret != "" {
+		query.Set("api-version", "2019-08-01")
+		endpoint, header = identityEndpoint, http.Header{"X-IDENTITY-HEADER": {secret}}
+	} else {
+		query.Set("api-version", "2018-02-01")
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, azureIMDSTimeout)
+		defer cancel()
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(ctx, a.Client, http.MethodGet, endpoint+"?"+query.Encode(), header, nil, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token returned")
+	}
+	return token.AccessToken, nil
+}
+
+// azureCLIToken returns an access token for resource of the account signed
+// in to the Azure CLI with az login, in the tenant of AZURE_TENANT_ID when
+// it is set.
+func azureCLIToken(ctx context.Context, resource string) (string, error) {
+	cmd := exec.CommandContext(ctx, "az", "account", "get-access-token", "--resource", resource, "--output", "json")
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		cmd.Args = append(cmd.Args, "--tenant", tenant)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := json.Unmarshal(out, &token); err != nil || token.AccessToken == "" {
+		return "", errors.New("az account get-access-token returned no access token")
+	}
+	return token.AccessToken, nil
+}
+
+// call sends an authorized request for the resource path of the API, with
+// the ETag a record set must match when etag is not empty.
+func (a *azure) call(ctx context.Context, method, path, etag string, in, out any) error {
+	return a.send(ctx, method, strings.TrimSuffix(a.Endpoint, "/")+path+"?api-version="+azureDNSVersion, etag, in, out)
+}
+
+// send sends an authorized request to the URL of the API, as call does.
+func (a *azure) send(ctx context.Context, method, endpoint, etag string, in, out any) error {
+	if err := a.authorize(ctx); err != nil {
+		return err
+	}
+	header := a.header.Clone()
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	return doJSON(ctx, a.Client, method, endpoint, header, in, out)
+}
+
+// zone returns the resource ID of the zone, looking it up by name among the
+// zones of the subscription the first time. The zones are listed in pages,
+// each linking to the next one.
+func (a *azure) zone(ctx context.Context) (string, error) {
+	if a.zoneID != "" {
+		return a.zoneID, nil
+	}
+	next := strings.TrimSuffix(a.Endpoint, "/") + "/subscriptions/" + url.PathEscape(a.subscription) + "/providers/Microsoft.Network/dnszones?api-version=" + azureDNSVersion
+	for next != "" {
+		var zones struct {
+			Value []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := a.send(ctx, http.MethodGet, next, "", nil, &zones); err != nil {
+			return "", fmt.Errorf("failed to look up zone %s: %w", a.Zone, err)
+		}
+		for _, zone := range zones.Value {
+			if strings.EqualFold(zone.Name, a.Zone) {
+				a.zoneID = zone.ID
+				return a.zoneID, nil
+			}
+		}
+		next = zones.NextLink
+	}
+	return "", fmt.Errorf("zone %s not found in subscription %s", a.Zone, a.subscription)
+}
+
+// recordSet returns the resource path of the TXT record set of name along
+// with the record set, which has no ETag when it does not exist.
+func (a *azure) recordSet(ctx context.Context, name string) (string, azureRecordSet, error) {
+	var set azureRecordSet
+	zoneID, err := a.zone(ctx)
+	if err != nil {
+		return "", set, err
+	}
+	path := zoneID + "/TXT/" + url.PathEscape(relativeName(name, a.Zone))
+	err = a.call(ctx, http.MethodGet, path, "", nil, &set)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return path, azureRecordSet{}, nil
+	}
+	return path, set, err
+}
+
+// Current returns the SPF records of the TXT record set of name.
+func (a *azure) Current(ctx context.Context, name string) ([]string, error) {
+	_, set, err := a.recordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range set.Properties.TXTRecords {
+		if value := strings.Join(record.Value, ""); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT record set of name, keeping its records other than
+// SPF records. The record set is only replaced or deleted when its ETag is
+// unchanged since it was read, so concurrent changes are not lost.
+func (a *azure) Apply(ctx context.Context, name, value string) error {
+	path, existing, err := a.recordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var set azureRecordSet
+	set.Properties.TTL = a.TTL
+	set.Properties.TXTRecords = slices.DeleteFunc(existing.Properties.TXTRecords, func(record azureTXTRecord) bool {
+		return spf.IsRecord(strings.Join(record.Value, ""))
+	})
+	if value != "" {
+		set.Properties.TXTRecords = append(set.Properties.TXTRecords, azureTXTRecord{spf.Chunk(value)})
+	}
+
+	switch {
+	case len(set.Properties.TXTRecords) > 0:
+		// Without an ETag the record set did not exist and is created
+		return a.call(ctx, http.MethodPut, path, existing.Etag, set, nil)
+	case existing.Etag != "":
+		return a.call(ctx, http.MethodDelete, path, existing.Etag, nil, nil)
+	}
+	return nil
+}
+
+// Verify checks that the TXT record set of name holds value, see verifySPF.
+func (a *azure) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, a, name, value)
+}
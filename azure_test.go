@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+// azureTestResource is the resource the tokens of the tests are requested
+// for.
+const azureTestResource = "https://management.azure.com"
+
+// newAzureTokenServer starts a fake of Microsoft Entra ID and of the managed
+// identity endpoints, issuing a token named after the flow a request was
+// made with when it carries the expected credentials, and an error
+// otherwise.
+func newAzureTokenServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	issue := func(w http.ResponseWriter, token string) {
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tenant/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var token string
+		switch {
+		case r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "client" || r.Form.Get("scope") != azureTestResource+"/.default":
+		case r.Form.Get("client_secret") == "secret":
+			token = "client-secret"
+		case r.Form.Get("client_assertion") == "assertion" && r.Form.Get("client_assertion_type") == "urn:ietf:params:oauth:client-assertion-type:jwt-bearer":
+			token = "workload-identity"
+		}
+		issue(w, token)
+	})
+	mux.HandleFunc("GET /msi", func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if r.Header.Get("X-IDENTITY-HEADER") == "header" && r.URL.Query().Get("api-version") == "2019-08-01" && r.URL.Query().Get("resource") == azureTestResource {
+			token = "app-service"
+		}
+		issue(w, token)
+	})
+	mux.HandleFunc("GET /imds", func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if r.Header.Get("Metadata") == "true" && r.URL.Query().Get("api-version") == "2018-02-01" && r.URL.Query().Get("resource") == azureTestResource {
+			token = "imds:" + r.URL.Query().Get("client_id")
+		}
+		issue(w, token)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAzureToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the Azure CLI is faked with a shell script")
+	}
+	server := newAzureTokenServer(t)
+	dir := t.TempDir()
+	federatedToken := filepath.Join(dir, "federated-token")
+	if err := os.WriteFile(federatedToken, []byte("assertion\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	principal := filepath.Join(dir, "principal.json")
+	if err := os.WriteFile(principal, []byte(`{"appId": "client", "password": "secret", "tenant": "tenant"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// az prints a token for the expected arguments only.
+	cli := filepath.Join(dir, "bin")
+	if err := os.Mkdir(cli, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n" +
+		`[ "$*" = "account get-access-token --resource ` + azureTestResource + ` --output json --tenant tenant" ] || { echo "unexpected arguments $*" >&2; exit 1; }` + "\n" +
+		`echo '{"accessToken": "azure-cli"}'` + "\n"
+	if err := os.WriteFile(filepath.Join(cli, "az"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		credentials string
+		imds        string
+		token       string
+		// err is a substring of the error, empty when a token is issued.
+		err string
+	}{
+		{
+			name:  "client secret",
+			env:   map[string]string{"AZURE_TENANT_ID": "tenant", "AZURE_CLIENT_ID": "client", "AZURE_CLIENT_SECRET": "secret"},
+			token: "client-secret",
+		},
+		{
+			name:        "service principal file",
+			credentials: principal,
+			token:       "client-secret",
+		},
+		{
+			name: "wrong client secret",
+			env:  map[string]string{"AZURE_TENANT_ID": "tenant", "AZURE_CLIENT_ID": "client", "AZURE_CLIENT_SECRET": "wrong"},
+			err:  "invalid_request",
+		},
+		{
+			name:  "workload identity",
+			env:   map[string]string{"AZURE_TENANT_ID": "tenant", "AZURE_CLIENT_ID": "client", "AZURE_FEDERATED_TOKEN_FILE": federatedToken},
+			token: "workload-identity",
+		},
+		{
+			name: "incomplete workload identity",
+			env:  map[string]string{"AZURE_CLIENT_ID": "client", "AZURE_FEDERATED_TOKEN_FILE": federatedToken},
+			err:  "incomplete workload identity",
+		},
+		{
+			name:  "app service managed identity",
+			env:   map[string]string{"IDENTITY_ENDPOINT": server.URL + "/msi", "IDENTITY_HEADER": "header"},
+			token: "app-service",
+		},
+		{
+			name:  "system-assigned managed identity",
+			imds:  "/imds",
+			token: "imds:",
+		},
+		{
+			name:  "user-assigned managed identity",
+			env:   map[string]string{"AZURE_CLIENT_ID": "client"},
+			imds:  "/imds",
+			token: "imds:client",
+		},
+		{
+			name:  "azure cli",
+			env:   map[string]string{"AZURE_TENANT_ID": "tenant", "PATH": cli},
+			token: "azure-cli",
+		},
+		{
+			name: "no credentials",
+			env:  map[string]string{"AZURE_TENANT_ID": "other", "PATH": cli},
+			err:  "no credentials",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_CLIENT_SECRET", "AZURE_FEDERATED_TOKEN_FILE", "IDENTITY_ENDPOINT", "IDENTITY_HEADER"} {
+				t.Setenv(name, "")
+			}
+			t.Setenv("PATH", t.TempDir())
+			t.Setenv("AZURE_AUTHORITY_HOST", server.URL)
+			t.Setenv("AZURE_SUBSCRIPTION_ID", "subscription")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			// Without a managed identity, the Instance Metadata Service
+			// refuses the requests.
+			imds := azureIMDSEndpoint
+			azureIMDSEndpoint = server.URL + "/none"
+			if tt.imds != "" {
+				azureIMDSEndpoint = server.URL + tt.imds
+			}
+			t.Cleanup(func() { azureIMDSEndpoint = imds })
+
+			p, err := newAzure(spfpublish.Config{Credentials: tt.credentials, Client: server.Client()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := p.(*azure).token(context.Background())
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("token() error = %v, want %q", err, tt.err)
+			}
+			if token != tt.token {
+				t.Errorf("token() = %q, want %q", token, tt.token)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// commandCheck is the command comparing the records published on -domain
+// with the flattened result instead of printing it.
+const commandCheck = "check"
+
+// checkPublished compares the SPF records currently published with the
+// records generated from result, writing the terms that differ between
+// them. It reports whether every published record matches.
+func checkPublished(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) (bool, error) {
+	records, err := buildRecords(result, opts)
+	if err != nil {
+		return false, err
+	}
+
+	inSync := true
+	for _, record := range records {
+		published, err := opts.LookupPublished(record.Name)
+		if err != nil {
+			return false, fmt.Errorf("failed to look up the SPF record of %s: %w", record.Name, err)
+		}
+		switch {
+		case len(published) == 0:
+			inSync = false
+			fmt.Fprintf(w, "%s: no SPF record published, expected:\n  %s\n", record.Name, record.Value)
+			continue
+		case len(published) > 1:
+			inSync = false
+			fmt.Fprintf(w, "%s: %d SPF records published, which receivers evaluate to a permanent error\n", record.Name, len(published))
+			continue
+		}
+
+		removed, added := diffTerms(strings.Join(published[0], ""), record.Value)
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		inSync = false
+		fmt.Fprintf(w, "%s:\n", record.Name)
+		for _, term := range removed {
+			fmt.Fprintf(w, "  - %s\n", term)
+		}
+		for _, term := range added {
+			fmt.Fprintf(w, "  + %s\n", term)
+		}
+	}
+
+	switch {
+	case inSync && len(records) == 1:
+		fmt.Fprintln(w, "The published record matches the flattened result")
+	case inSync:
+		fmt.Fprintf(w, "The %d published records match the flattened result\n", len(records))
+	}
+	return inSync, nil
+}
+
+// diffTerms returns the terms of the published record missing from the
+// generated one, and those of the generated record missing from the
+// published one. Terms are compared case-insensitively, ignoring their
+// order.
+func diffTerms(published, generated string) (removed, added []string) {
+	missing := func(record, from string) []string {
+		terms := make(map[string]bool)
+		for _, term := range strings.Fields(from) {
+			terms[strings.ToLower(term)] = true
+		}
+		var result []string
+		for _, term := range strings.Fields(record) {
+			if !terms[strings.ToLower(term)] {
+				result = append(result, term)
+			}
+		}
+		return result
+	}
+	return missing(published, generated), missing(generated, published)
+}
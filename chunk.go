@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// quoteChunks formats chunks as quoted character-strings in zone file
+// presentation format.
+func quoteChunks(chunks []string) string {
+	quoted := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		chunk = strings.ReplaceAll(chunk, `\`, `\\`)
+		quoted[i] = `"` + strings.ReplaceAll(chunk, `"`, `\"`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// printChunkSizes reports the byte count of each character-string of the
+// record published on name.
+func printChunkSizes(name string, chunks []string) {
+	sizes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		sizes[i] = strconv.Itoa(len(chunk))
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d character-strings of %s bytes\n", name, len(chunks), strings.Join(sizes, ", "))
+}
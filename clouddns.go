@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerCloudDNS = "clouddns"
+
+func init() {
+	spfpublish.Register(providerCloudDNS, newCloudDNS)
+}
+
+// cloudDNSEndpoint is the base URL of the Cloud DNS API.
+const cloudDNSEndpoint = "https://dns.googleapis.com/dns/v1"
+
+// cloudDNSScope is the OAuth scope allowing to change the records.
+const cloudDNSScope = "https://www.googleapis.com/auth/ndev.clouddns.readwrite"
+
+// cloudDNSChangeInterval is the time between checks of whether a change
+// was applied.
+const cloudDNSChangeInterval = 2 * time.Second
+
+// serviceAccount is the key file of a Google Cloud service account.
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// cloudDNS publishes records through the Cloud DNS API, authenticating as
+// the service account whose key file is given by -credentials or
+// GOOGLE_APPLICATION_CREDENTIALS. The records are changed in the project of
+// the service account, or of GOOGLE_CLOUD_PROJECT when set.
+type cloudDNS struct {
+	spfpublish.Config
+	account serviceAccount
+	project string
+	header  http.Header
+	zone    string
+	// changes holds the change last submitted for each name, which Verify
+	// waits for.
+	changes map[string]cloudDNSChange
+}
+
+// cloudDNSRecordSet is a resource record set of the Cloud DNS API.
+type cloudDNSRecordSet struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	RRDatas []string `json:"rrdatas"`
+}
+
+// cloudDNSChange is a change of the Cloud DNS API, which applies its
+// deletions and additions atomically.
+type cloudDNSChange struct {
+	ID        string              `json:"id,omitempty"`
+	Status    string              `json:"status,omitempty"`
+	Additions []cloudDNSRecordSet `json:"additions,omitempty"`
+	Deletions []cloudDNSRecordSet `json:"deletions,omitempty"`
+}
+
+// newCloudDNS returns a publisher for the Cloud DNS managed zone of config.
+func newCloudDNS(config spfpublish.Config) (spfpublish.Publisher, error) {
+	file := config.Credentials
+	if file == "" {
+		file = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if file == "" {
+		return nil, errors.New("no credentials: set GOOGLE_APPLICATION_CREDENTIALS or pass -credentials")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account key file %s: %w", file, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, fmt.Errorf("invalid service account key file %s: no client_email or private_key", file)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if project == "" {
+		project = account.ProjectID
+	}
+	if project == "" {
+		return nil, errors.New("no project: set GOOGLE_CLOUD_PROJECT")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = cloudDNSEndpoint
+	}
+	return &cloudDNS{Config: config, account: account, project: project, changes: make(map[string]cloudDNSChange)}, nil
+}
+
+// authorize obtains an access token for the service account the first
+// time, exchanging a JWT signed with its private key (RFC 7523).
+func (c *cloudDNS) authorize(ctx context.Context) error {
+	if c.header != nil {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(c.account.PrivateKey))
+	if block == nil {
+		return errors.New("invalid private key of the service account")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid private key of the service account: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("private key of the service account is not an RSA key")
+	}
+
+	now := time.Now()
+	encode := func(v any) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]any{
+		"iss":   c.account.ClientEmail,
+		"scope": cloudDNSScope,
+		"aud":   c.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	token, err := requestToken(ctx, c.Client, c.account.TokenURI, form)
+	if err != nil {
+		return err
+	}
+	c.header = http.Header{"Authorization": {"Bearer " + token}}
+	return nil
+}
+
+// call sends an authorized request to the API path of the project.
+func (c *cloudDNS) call(ctx context.Context, method, path string, in, out any) error {
+	if err := c.authorize(ctx); err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(c.Endpoint, "/") + "/projects/" + url.PathEscape(c.project) + path
+	return doJSON(ctx, c.Client, method, endpoint, c.header, in, out)
+}
+
+// managedZone returns the name of the managed zone, looking it up by DNS
+// name the first time.
+func (c *cloudDNS) managedZone(ctx context.Context) (string, error) {
+	if c.zone != "" {
+		return c.zone, nil
+	}
+	var zones struct {
+		ManagedZones []struct {
+			Name string `json:"name"`
+		} `json:"managedZones"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/managedZones?dnsName="+url.QueryEscape(c.Zone+"."), nil, &zones); err != nil {
+		return "", fmt.Errorf("failed to look up zone %s: %w", c.Zone, err)
+	}
+	if len(zones.ManagedZones) == 0 {
+		return "", fmt.Errorf("managed zone %s not found in project %s", c.Zone, c.project)
+	}
+	c.zone = zones.ManagedZones[0].Name
+	return c.zone, nil
+}
+
+// recordSets returns the API path of the managed zone along with the TXT
+// record set of name, if any.
+func (c *cloudDNS) recordSets(ctx context.Context, name string) (string, []cloudDNSRecordSet, error) {
+	zone, err := c.managedZone(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	path := "/managedZones/" + url.PathEscape(zone)
+	var sets struct {
+		RRSets []cloudDNSRecordSet `json:"rrsets"`
+	}
+	if err := c.call(ctx, http.MethodGet, path+"/rrsets?type=TXT&name="+url.QueryEscape(name+"."), nil, &sets); err != nil {
+		return "", nil, err
+	}
+	return path, sets.RRSets, nil
+}
+
+// Current returns the SPF records of the TXT record set of name.
+func (c *cloudDNS) Current(ctx context.Context, name string) ([]string, error) {
+	_, sets, err := c.recordSets(ctx, name)
+	if err != nil || len(sets) == 0 {
+		return nil, err
+	}
+	var values []string
+	for _, data := range sets[0].RRDatas {
+		if value := unquoteTXT(data); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT record set of name in a single change, keeping its
+// values other than SPF records.
+func (c *cloudDNS) Apply(ctx context.Context, name, value string) error {
+	path, sets, err := c.recordSets(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var change cloudDNSChange
+	set := cloudDNSRecordSet{Name: name + ".", Type: "TXT", TTL: c.TTL}
+	if len(sets) > 0 {
+		change.Deletions = sets[:1]
+		set.RRDatas = slices.DeleteFunc(slices.Clone(sets[0].RRDatas), func(data string) bool {
+			return spf.IsRecord(unquoteTXT(data))
+		})
+	}
+	if value != "" {
+		set.RRDatas = append(set.RRDatas, quoteChunks(spf.Chunk(value)))
+	}
+	if len(set.RRDatas) > 0 {
+		change.Additions = []cloudDNSRecordSet{set}
+	}
+	if len(change.Additions) == 0 && len(change.Deletions) == 0 {
+		return nil
+	}
+
+	if err := c.call(ctx, http.MethodPost, path+"/changes", change, &change); err != nil {
+		return err
+	}
+	c.changes[name] = change
+	return nil
+}
+
+// Verify waits until the change Apply submitted for name is done, so that
+// records referencing name are only published after it, then checks that
+// the TXT record set of name holds value, see verifySPF.
+func (c *cloudDNS) Verify(ctx context.Context, name, value string) error {
+	if change, ok := c.changes[name]; ok {
+		if err := c.waitForChange(ctx, change); err != nil {
+			return err
+		}
+		delete(c.changes, name)
+	}
+	return verifySPF(ctx, c, name, value)
+}
+
+// waitForChange polls the status of a change until it is done.
+func (c *cloudDNS) waitForChange(ctx context.Context, change cloudDNSChange) error {
+	zone, err := c.managedZone(ctx)
+	if err != nil {
+		return err
+	}
+	path := "/managedZones/" + url.PathEscape(zone)
+	for change.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cloudDNSChangeInterval):
+		}
+		if err := c.call(ctx, http.MethodGet, path+"/changes/"+url.PathEscape(change.ID), nil, &change); err != nil {
+			return fmt.Errorf("failed to get the status of change %s: %w", change.ID, err)
+		}
+	}
+	return nil
+}
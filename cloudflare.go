@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerCloudflare = "cloudflare"
+
+func init() {
+	spfpublish.Register(providerCloudflare, newCloudflare)
+}
+
+// cloudflareEndpoint is the base URL of the Cloudflare API.
+const cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+// cloudflare publishes records through the Cloudflare API, authenticating
+// with an API token from CLOUDFLARE_API_TOKEN or -credentials that has the
+// Zone.DNS edit permission.
+type cloudflare struct {
+	spfpublish.Config
+	header http.Header
+	zoneID string
+}
+
+// cloudflareResponse is the envelope of every Cloudflare API response.
+type cloudflareResponse[T any] struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result T `json:"result"`
+}
+
+// err returns the errors of an unsuccessful response.
+func (r *cloudflareResponse[T]) err() error {
+	if r.Success {
+		return nil
+	}
+	var errs []error
+	for _, e := range r.Errors {
+		errs = append(errs, fmt.Errorf("%s (code %d)", e.Message, e.Code))
+	}
+	if len(errs) == 0 {
+		return errors.New("request failed")
+	}
+	return errors.Join(errs...)
+}
+
+// cloudflareRecord is a DNS record of the Cloudflare API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+// newCloudflare returns a publisher for the Cloudflare zone of config.
+func newCloudflare(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "CLOUDFLARE_API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = cloudflareEndpoint
+	}
+	return &cloudflare{
+		Config: config,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+	}, nil
+}
+
+// call sends a request to the API path and decodes the result into out.
+func (c *cloudflare) call(ctx context.Context, method, path string, in, out any) error {
+	resp := cloudflareResponse[any]{Result: out}
+	err := doJSON(ctx, c.Client, method, strings.TrimSuffix(c.Endpoint, "/")+path, c.header, in, &resp)
+	// Failed requests come with the envelope describing the errors
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && len(resp.Errors) > 0 {
+		return resp.err()
+	}
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+// zone returns the ID of the zone, looking it up by name the first time.
+func (c *cloudflare) zone(ctx context.Context) (string, error) {
+	if c.zoneID != "" {
+		return c.zoneID, nil
+	}
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(c.Zone), nil, &zones); err != nil {
+		return "", fmt.Errorf("failed to look up zone %s: %w", c.Zone, err)
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("zone %s not found, or not accessible with the API token", c.Zone)
+	}
+	c.zoneID = zones[0].ID
+	return c.zoneID, nil
+}
+
+// spfRecords returns the API path of the records of the zone along with the
+// SPF records of name.
+func (c *cloudflare) spfRecords(ctx context.Context, name string) (string, []cloudflareRecord, error) {
+	zoneID, err := c.zone(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	records := "/zones/" + zoneID + "/dns_records"
+	var existing []cloudflareRecord
+	if err := c.call(ctx, http.MethodGet, records+"?type=TXT&per_page=100&name="+url.QueryEscape(name), nil, &existing); err != nil {
+		return "", nil, err
+	}
+	return records, slices.DeleteFunc(existing, func(record cloudflareRecord) bool {
+		return !spf.IsRecord(unquoteTXT(record.Content))
+	}), nil
+}
+
+// Current returns the SPF records of name.
+func (c *cloudflare) Current(ctx context.Context, name string) ([]string, error) {
+	_, existing, err := c.spfRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing {
+		values = append(values, unquoteTXT(record.Content))
+	}
+	return values, nil
+}
+
+// Apply updates the SPF record of name in place when there is one, creating
+// it otherwise, and deletes any other SPF record of name.
+func (c *cloudflare) Apply(ctx context.Context, name, value string) error {
+	records, existing, err := c.spfRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Cloudflare splits long TXT values into character-strings itself. The
+	// first SPF record is updated and the others deleted, all of them when
+	// there is no value.
+	replaced := value == ""
+	for _, record := range existing {
+		if replaced {
+			if err := c.call(ctx, http.MethodDelete, records+"/"+record.ID, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Content, record.TTL = value, c.TTL
+		if err := c.call(ctx, http.MethodPut, records+"/"+record.ID, record, nil); err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if replaced {
+		return nil
+	}
+	return c.call(ctx, http.MethodPost, records, cloudflareRecord{Type: "TXT", Name: name, Content: value, TTL: c.TTL}, nil)
+}
+
+// Verify checks that name holds value, see verifySPF.
+func (c *cloudflare) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, c, name, value)
+}
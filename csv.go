@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatCSV = "csv"
+
+// writeCSV writes one row per flattened entry with the columns needed to
+// trace it back to the record it came from.
+func writeCSV(w io.Writer, result *spfflatten.Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"entry", "family", "source_domain", "depth", "mechanism", "path"}); err != nil {
+		return err
+	}
+	for _, entry := range result.Entries {
+		family := familyIPv6
+		if spfflatten.IsIPv4(entry.IP) {
+			family = familyIPv4
+		}
+		row := []string{
+			entry.IP,
+			family,
+			entry.Source,
+			strconv.Itoa(len(entry.Path)),
+			entry.Mechanism,
+			strings.Join(entry.Path, " > "),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
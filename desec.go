@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerDeSEC = "desec"
+
+func init() {
+	spfpublish.Register(providerDeSEC, newDeSEC)
+}
+
+// deSECEndpoint is the base URL of the deSEC API.
+const deSECEndpoint = "https://desec.io/api/v1"
+
+// deSEC publishes records through the deSEC API, authenticating with a
+// token from DESEC_TOKEN or -credentials.
+type deSEC struct {
+	spfpublish.Config
+	header http.Header
+}
+
+// deSECRecordSet is an RRset of the deSEC API, whose name is relative to
+// the domain, empty for the domain itself. TXT records must be given in
+// zone file presentation format, quoted character-strings of at most 255
+// bytes.
+type deSECRecordSet struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+// newDeSEC returns a publisher for the deSEC domain of config.
+func newDeSEC(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "DESEC_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = deSECEndpoint
+	}
+	return &deSEC{
+		Config: config,
+		header: http.Header{"Authorization": {"Token " + token}},
+	}, nil
+}
+
+// call sends a request to the API path of the RRsets of the domain.
+func (d *deSEC) call(ctx context.Context, method, path string, in, out any) error {
+	endpoint := strings.TrimSuffix(d.Endpoint, "/") + "/domains/" + url.PathEscape(d.Zone) + "/rrsets/" + path
+	err := doJSON(ctx, d.Client, method, endpoint, d.header, in, out)
+	// Failed requests come with a detail, or with the messages of the
+	// invalid fields of each RRset
+	var apiErr *apiError
+	var body any
+	if errors.As(err, &apiErr) && apiErr.Status != http.StatusNotFound && json.Unmarshal([]byte(apiErr.Body), &body) == nil {
+		if messages := deSECMessages("", body); len(messages) > 0 {
+			return errors.New(strings.Join(messages, "; "))
+		}
+	}
+	return err
+}
+
+// deSECMessages returns the messages of an error response of the deSEC API,
+// prefixed with the field they are about.
+func deSECMessages(field string, body any) []string {
+	var messages []string
+	switch body := body.(type) {
+	case string:
+		if field != "" && field != "detail" {
+			body = field + ": " + body
+		}
+		messages = append(messages, body)
+	case []any:
+		for _, v := range body {
+			messages = append(messages, deSECMessages(field, v)...)
+		}
+	case map[string]any:
+		for _, key := range slices.Sorted(maps.Keys(body)) {
+			messages = append(messages, deSECMessages(key, body[key])...)
+		}
+	}
+	return messages
+}
+
+// recordSet returns the TXT RRset of name, which has no records when it
+// does not exist.
+func (d *deSEC) recordSet(ctx context.Context, name string) (deSECRecordSet, error) {
+	var existing deSECRecordSet
+	err := d.call(ctx, http.MethodGet, url.PathEscape(relativeName(name, d.Zone))+"/TXT/", nil, &existing)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return deSECRecordSet{}, nil
+	}
+	return existing, err
+}
+
+// Current returns the SPF records of the TXT RRset of name.
+func (d *deSEC) Current(ctx context.Context, name string) ([]string, error) {
+	existing, err := d.recordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing.Records {
+		if value := unquoteTXT(record); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT RRset of name, keeping its records other than SPF
+// records. The RRset is written with a bulk update, which creates it when
+// it does not exist and deletes it when it has no records left.
+func (d *deSEC) Apply(ctx context.Context, name, value string) error {
+	existing, err := d.recordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	subname := relativeName(name, d.Zone)
+	if subname == "@" {
+		subname = ""
+	}
+	set := deSECRecordSet{Subname: subname, Type: "TXT", TTL: d.TTL}
+	set.Records = slices.DeleteFunc(existing.Records, func(record string) bool {
+		return spf.IsRecord(unquoteTXT(record))
+	})
+	if value != "" {
+		set.Records = append(set.Records, quoteChunks(spf.Chunk(value)))
+	}
+	if len(set.Records) == 0 && len(existing.Records) == 0 {
+		return nil
+	}
+	if set.Records == nil {
+		set.Records = []string{}
+	}
+	return d.call(ctx, http.MethodPatch, "", []deSECRecordSet{set}, nil)
+}
+
+// Verify checks that the TXT RRset of name holds value, see verifySPF.
+func (d *deSEC) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, d, name, value)
+}
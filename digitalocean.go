@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerDigitalOcean = "digitalocean"
+
+func init() {
+	spfpublish.Register(providerDigitalOcean, newDigitalOcean)
+}
+
+// digitalOceanEndpoint is the base URL of the DigitalOcean API.
+const digitalOceanEndpoint = "https://api.digitalocean.com/v2"
+
+// digitalOcean publishes records through the domains API of DigitalOcean,
+// authenticating with a personal access token from DIGITALOCEAN_TOKEN or
+// -credentials that has the domain read and update scopes.
+type digitalOcean struct {
+	spfpublish.Config
+	header http.Header
+}
+
+// digitalOceanRecord is a domain record of the DigitalOcean API, whose name
+// is relative to the domain.
+type digitalOceanRecord struct {
+	ID   int    `json:"id,omitempty"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  int    `json:"ttl"`
+}
+
+// newDigitalOcean returns a publisher for the DigitalOcean domain of config.
+func newDigitalOcean(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "DIGITALOCEAN_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = digitalOceanEndpoint
+	}
+	return &digitalOcean{
+		Config: config,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+	}, nil
+}
+
+// call sends a request to the API path of the records of the domain.
+func (d *digitalOcean) call(ctx context.Context, method, path string, in, out any) error {
+	endpoint := strings.TrimSuffix(d.Endpoint, "/") + "/domains/" + url.PathEscape(d.Zone) + "/records" + path
+	err := doJSON(ctx, d.Client, method, endpoint, d.header, in, out)
+	// Failed requests come with a message describing the error
+	var apiErr *apiError
+	var resp struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && resp.Message != "" {
+		return fmt.Errorf("%s (%s)", resp.Message, resp.ID)
+	}
+	return err
+}
+
+// spfRecords returns the SPF records of name.
+func (d *digitalOcean) spfRecords(ctx context.Context, name string) ([]digitalOceanRecord, error) {
+	var existing struct {
+		DomainRecords []digitalOceanRecord `json:"domain_records"`
+	}
+	if err := d.call(ctx, http.MethodGet, "?type=TXT&per_page=200&name="+url.QueryEscape(name), nil, &existing); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(existing.DomainRecords, func(record digitalOceanRecord) bool {
+		return !spf.IsRecord(unquoteTXT(record.Data))
+	}), nil
+}
+
+// Current returns the SPF records of name.
+func (d *digitalOcean) Current(ctx context.Context, name string) ([]string, error) {
+	existing, err := d.spfRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing {
+		values = append(values, unquoteTXT(record.Data))
+	}
+	return values, nil
+}
+
+// Apply updates the SPF record of name in place when there is one, creating
+// it otherwise, and deletes any other SPF record of name.
+func (d *digitalOcean) Apply(ctx context.Context, name, value string) error {
+	existing, err := d.spfRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// DigitalOcean splits long TXT values into character-strings itself. The
+	// first SPF record is updated and the others deleted, all of them when
+	// there is no value.
+	replaced := value == ""
+	for _, record := range existing {
+		path := "/" + strconv.Itoa(record.ID)
+		if replaced {
+			if err := d.call(ctx, http.MethodDelete, path, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Data, record.TTL = value, d.TTL
+		if err := d.call(ctx, http.MethodPut, path, record, nil); err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if replaced {
+		return nil
+	}
+	record := digitalOceanRecord{Type: "TXT", Name: relativeName(name, d.Zone), Data: value, TTL: d.TTL}
+	return d.call(ctx, http.MethodPost, "", record, nil)
+}
+
+// Verify checks that name holds value, see verifySPF.
+func (d *digitalOcean) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, d, name, value)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatDNSControl = "dnscontrol"
+
+// writeDNSControl writes the records as DNSControl TXT() record modifiers,
+// ready to be pasted into the D() block of the domain in dnsconfig.js.
+// DNSControl splits values longer than 255 bytes into character-strings itself.
+func writeDNSControl(w io.Writer, records []PublishedRecord, opts spfflatten.FormatOptions) error {
+	for _, record := range records {
+		label := relativeName(record.Name, opts.Domain)
+		fmt.Fprintf(w, "TXT(%s, %s, TTL(%d)),\n", jsString(label), jsString(record.Value), opts.TTL)
+	}
+	return nil
+}
+
+// jsString quotes s as a JavaScript string literal.
+func jsString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatDOT = "dot"
+
+// writeDOT writes the include tree as a Graphviz digraph. Each domain is a
+// node annotated with the lookups its record consumes and the entries it
+// contributes, and each include or redirect is an edge, so that cycles and
+// lookup-heavy branches are visible.
+func writeDOT(w io.Writer, result *spfflatten.Result) error {
+	fmt.Fprintln(w, "digraph spf {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+
+	declared := make(map[string]bool)
+	var walk func(nodes []*spfflatten.Node)
+	walk = func(nodes []*spfflatten.Node) {
+		for _, node := range nodes {
+			if !node.Repeated && !declared[node.Domain] {
+				declared[node.Domain] = true
+				label := fmt.Sprintf("%s\n%d lookups, %d ip4, %d ip6", node.Domain, node.Lookups, node.IP4, node.IP6)
+				fmt.Fprintf(w, "  %s [label=%s];\n", strconv.Quote(node.Domain), strconv.Quote(label))
+			}
+			if node.Parent() != nil {
+				fmt.Fprintf(w, "  %s -> %s [label=%s];\n", strconv.Quote(node.Parent().Domain), strconv.Quote(node.Domain), strconv.Quote(node.Via))
+			}
+			walk(node.Children)
+		}
+	}
+	walk(result.Tree)
+
+	fmt.Fprintln(w, "}")
+	return nil
+}
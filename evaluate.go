@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// commandEvaluate is the command evaluating the original and the flattened
+// record for a sender instead of printing the flattened record.
+const commandEvaluate = "evaluate"
+
+// evaluateSender evaluates for sender the original records, see
+// originalRecord, and the flattened record, both as published on name. It
+// writes the result of each along with the mechanism that determined it,
+// and reports whether both results are the same.
+func evaluateSender(ctx context.Context, w io.Writer, f *spfflatten.Flattener, result *spfflatten.Result, opts spfflatten.FormatOptions, name string, sender spfflatten.Sender) (bool, error) {
+	original, err := originalRecord(result, opts)
+	if err != nil {
+		return false, err
+	}
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return false, err
+	}
+	before := f.CheckRecord(ctx, original, name, sender)
+	after := f.CheckRecord(ctx, record, name, sender)
+	// The record combining the include domains is not published anywhere,
+	// so only the include chain below it is shown
+	fmt.Fprintf(w, "original:  %s\n", describeEvaluation(before, before.Path[1:]))
+	fmt.Fprintf(w, "flattened: %s\n", describeEvaluation(after, after.Path))
+	return before.Result == after.Result, nil
+}
+
+// originalRecord returns a record equivalent to the original records before
+// flattening: the addresses given on the command line, an include of each
+// include domain and the all mechanism of the generated record.
+func originalRecord(result *spfflatten.Result, opts spfflatten.FormatOptions) (string, error) {
+	var terms []string
+	for _, entry := range result.Entries {
+		if entry.Source == "" {
+			terms = append(terms, tagIP(entry.IP))
+		}
+	}
+	for _, root := range result.Tree {
+		terms = append(terms, "include:"+root.Domain)
+	}
+	if all := allTerm(result, opts); all != "" {
+		terms = append(terms, all)
+	}
+	return formatRecord(terms)
+}
+
+// describeEvaluation returns the result of evaluation with the mechanism
+// that determined it and path, the chain of records holding it.
+func describeEvaluation(evaluation *spfflatten.Evaluation, path []string) string {
+	var b strings.Builder
+	b.WriteString(string(evaluation.Result))
+	if evaluation.Mechanism != "" {
+		fmt.Fprintf(&b, ", matched %s", evaluation.Mechanism)
+	}
+	if len(path) > 0 {
+		fmt.Fprintf(&b, " in %s", strings.Join(path, " > "))
+	}
+	if evaluation.Err != nil {
+		fmt.Fprintf(&b, ": %v", evaluation.Err)
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// commandExplain is the command explaining which mechanisms authorize an
+// address instead of printing the flattened record.
+const commandExplain = "explain"
+
+// writeExplanation writes why sender is authorized or rejected: the chain
+// of includes down to the mechanism of the original records that
+// determines its result, then the entries of the flattened record covering
+// its address along with the mechanism and record each of them came from.
+func writeExplanation(ctx context.Context, w io.Writer, f *spfflatten.Flattener, result *spfflatten.Result, opts spfflatten.FormatOptions, name string, sender spfflatten.Sender) error {
+	original, err := originalRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	before := f.CheckRecord(ctx, original, name, sender)
+	fmt.Fprintf(w, "%s in the original records: %s\n", sender.IP, before.Result)
+	writeChain(w, before)
+
+	after := f.CheckRecord(ctx, record, name, sender)
+	fmt.Fprintf(w, "%s in the flattened record: %s\n", sender.IP, after.Result)
+	covered := false
+	for _, entry := range result.Entries {
+		if prefix := entry.Prefix(); prefix.IsValid() && prefix.Contains(sender.IP.Unmap()) {
+			covered = true
+			fmt.Fprintf(w, "  %s, from %s\n", tagIP(entry.IP), describeSource(entry))
+		}
+	}
+	if !covered {
+		fmt.Fprintln(w, "  covered by none of the flattened entries")
+	}
+	if after.Mechanism != "" && !strings.HasPrefix(after.Mechanism, "ip4:") && !strings.HasPrefix(after.Mechanism, "ip6:") {
+		fmt.Fprintf(w, "  matched %s\n", after.Mechanism)
+	}
+	if after.Err != nil {
+		fmt.Fprintf(w, "  %v\n", after.Err)
+	}
+	return nil
+}
+
+// writeChain writes the records of the original records that evaluation
+// went through, leaving out the record combining the include domains, down
+// to the mechanism that determined its result.
+func writeChain(w io.Writer, evaluation *spfflatten.Evaluation) {
+	indent := "  "
+	for _, domain := range evaluation.Path[1:] {
+		fmt.Fprintf(w, "%s%s\n", indent, domain)
+		indent += "  "
+	}
+	switch {
+	case evaluation.Mechanism != "":
+		fmt.Fprintf(w, "%smatched %s\n", indent, evaluation.Mechanism)
+	case evaluation.Err != nil:
+		fmt.Fprintf(w, "%s%v\n", indent, evaluation.Err)
+	default:
+		fmt.Fprintf(w, "%smatched no mechanism\n", indent)
+	}
+}
+
+// describeSource returns the mechanism and include chain an entry of the
+// flattened record came from.
+func describeSource(entry spfflatten.Entry) string {
+	if entry.Source == "" {
+		return "the command line"
+	}
+	if len(entry.Path) > 1 {
+		return fmt.Sprintf("%s in %s, included through %s", entry.Mechanism, entry.Source, strings.Join(entry.Path[:len(entry.Path)-1], " > "))
+	}
+	return fmt.Sprintf("%s in %s", entry.Mechanism, entry.Source)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// Formats loading the flattened networks into packet filter sets.
+const (
+	formatNftables = "nftables"
+	formatIpset    = "ipset"
+	formatPF       = "pf"
+	formatHAProxy  = "haproxy"
+	formatNginx    = "nginx"
+	formatPostfix  = "postfix"
+	formatExim     = "exim"
+)
+
+// splitFamilies returns the IPv4 and IPv6 networks of result, as most
+// firewalls keep them in separate sets.
+func splitFamilies(result *spfflatten.Result) (ip4, ip6 []string) {
+	for _, ip := range result.IPs() {
+		if spfflatten.IsIPv4(ip) {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+	return ip4, ip6
+}
+
+// writeNftables writes an nft script creating the sets <set>_v4 and
+// <set>_v6 in the table opts.NftTable and replacing their elements, so that
+// running it again with nft -f updates the sets in place. auto-merge lets
+// overlapping networks from different includes share a set.
+func writeNftables(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	ip4, ip6 := splitFamilies(result)
+	fmt.Fprintf(w, "add table %s\n", opts.NftTable)
+	for _, set := range []struct {
+		name, addrType string
+		elements       []string
+	}{
+		{opts.SetName + "_v4", "ipv4_addr", maskNetworks(ip4)},
+		{opts.SetName + "_v6", "ipv6_addr", maskNetworks(ip6)},
+	} {
+		fmt.Fprintf(w, "add set %s %s { type %s; flags interval; auto-merge; }\n", opts.NftTable, set.name, set.addrType)
+		fmt.Fprintf(w, "flush set %s %s\n", opts.NftTable, set.name)
+		if len(set.elements) > 0 {
+			fmt.Fprintf(w, "add element %s %s { %s }\n", opts.NftTable, set.name, strings.Join(set.elements, ", "))
+		}
+	}
+	return nil
+}
+
+// writeIpset writes an ipset restore script creating the hash:net sets
+// <set>_v4 and <set>_v6 and replacing their members.
+func writeIpset(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	ip4, ip6 := splitFamilies(result)
+	for _, set := range []struct {
+		name, family string
+		members      []string
+	}{
+		{opts.SetName + "_v4", "inet", maskNetworks(ip4)},
+		{opts.SetName + "_v6", "inet6", maskNetworks(ip6)},
+	} {
+		fmt.Fprintf(w, "create %s hash:net family %s -exist\n", set.name, set.family)
+		fmt.Fprintf(w, "flush %s\n", set.name)
+		for _, member := range set.members {
+			fmt.Fprintf(w, "add %s %s\n", set.name, member)
+		}
+	}
+	return nil
+}
+
+// writePF writes a pf table file with one network per line, to be loaded
+// with a table <set> persist file "..." line in pf.conf.
+func writePF(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	fmt.Fprintf(w, "# table <%s> persist file \"/etc/pf.%s\"\n", opts.SetName, opts.SetName)
+	for _, entry := range result.Entries {
+		if opts.Annotate {
+			fmt.Fprintln(w, entry.IP, annotation(entry))
+		} else {
+			fmt.Fprintln(w, entry.IP)
+		}
+	}
+	return nil
+}
+
+// writeHAProxy writes an HAProxy ACL file with one network per line, to be
+// matched with acl <name> src -f <file>.
+func writeHAProxy(w io.Writer, result *spfflatten.Result) error {
+	for _, ip := range result.IPs() {
+		fmt.Fprintln(w, ip)
+	}
+	return nil
+}
+
+// writeNginx writes nginx allow directives for each network, followed by
+// deny all; when opts.NginxDenyAll is set, to be included in a location
+// block.
+func writeNginx(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	for _, entry := range result.Entries {
+		if opts.Annotate {
+			fmt.Fprintf(w, "allow %s; %s\n", entry.IP, annotation(entry))
+		} else {
+			fmt.Fprintf(w, "allow %s;\n", entry.IP)
+		}
+	}
+	if opts.NginxDenyAll {
+		fmt.Fprintln(w, "deny all;")
+	}
+	return nil
+}
+
+// writePostfix writes a Postfix cidr: table mapping each network to
+// opts.PostfixAction, for use in smtpd_client_restrictions and the like.
+// Postfix rejects networks with host bits set, so they are masked.
+func writePostfix(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	for _, ip := range result.IPs() {
+		fmt.Fprintf(w, "%s %s\n", maskNetwork(ip), opts.PostfixAction)
+	}
+	return nil
+}
+
+// writeExim writes the networks as an Exim named host list, referenced as
+// +<set> in ACLs. Items are separated by colons, so the colons of IPv6
+// addresses are doubled.
+func writeExim(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	ips := result.IPs()
+	for i, ip := range ips {
+		ips[i] = strings.ReplaceAll(ip, ":", "::")
+	}
+	fmt.Fprintf(w, "hostlist %s = %s\n", opts.SetName, strings.Join(ips, " : "))
+	return nil
+}
+
+// maskNetworks returns ips with the host bits of their networks cleared, as
+// nft rejects them, dropping the networks that become duplicates.
+func maskNetworks(ips []string) []string {
+	var masked []string
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		network := maskNetwork(ip)
+		if !seen[network] {
+			seen[network] = true
+			masked = append(masked, network)
+		}
+	}
+	return masked
+}
+
+// maskNetwork clears the host bits of a network in CIDR notation, such as
+// 192.0.2.1/24 becoming 192.0.2.0/24. Addresses without a prefix length are
+// returned as is.
+func maskNetwork(ip string) string {
+	if !strings.Contains(ip, "/") {
+		return ip
+	}
+	_, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return ip
+	}
+	return network.String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerGandi = "gandi"
+
+func init() {
+	spfpublish.Register(providerGandi, newGandi)
+}
+
+// gandiEndpoint is the base URL of the Gandi LiveDNS API.
+const gandiEndpoint = "https://api.gandi.net/v5/livedns"
+
+// gandi publishes records through the Gandi LiveDNS API, authenticating
+// with a personal access token from GANDI_PERSONAL_ACCESS_TOKEN or
+// -credentials that has the permission to manage the DNS records of the
+// domain.
+type gandi struct {
+	spfpublish.Config
+	header http.Header
+}
+
+// gandiRecordSet is a resource record set of the LiveDNS API, whose TXT
+// values are in zone file presentation format.
+type gandiRecordSet struct {
+	TTL    int      `json:"rrset_ttl,omitempty"`
+	Values []string `json:"rrset_values"`
+}
+
+// newGandi returns a publisher for the Gandi LiveDNS domain of config.
+func newGandi(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "GANDI_PERSONAL_ACCESS_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = gandiEndpoint
+	}
+	return &gandi{
+		Config: config,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+	}, nil
+}
+
+// call sends a request for the TXT record set of the relative name in the
+// domain.
+func (g *gandi) call(ctx context.Context, method, name string, in, out any) error {
+	endpoint := strings.TrimSuffix(g.Endpoint, "/") + "/domains/" + url.PathEscape(g.Zone) + "/records/" + url.PathEscape(name) + "/TXT"
+	err := doJSON(ctx, g.Client, method, endpoint, g.header, in, out)
+	// Failed requests come with a message describing the error
+	var apiErr *apiError
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if errors.As(err, &apiErr) && apiErr.Status != http.StatusNotFound && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && resp.Message != "" {
+		return errors.New(resp.Message)
+	}
+	return err
+}
+
+// recordSet returns the TXT record set of name, which has no values when it
+// does not exist.
+func (g *gandi) recordSet(ctx context.Context, name string) (gandiRecordSet, error) {
+	var existing gandiRecordSet
+	err := g.call(ctx, http.MethodGet, relativeName(name, g.Zone), nil, &existing)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return gandiRecordSet{}, nil
+	}
+	return existing, err
+}
+
+// Current returns the SPF records of the TXT record set of name.
+func (g *gandi) Current(ctx context.Context, name string) ([]string, error) {
+	existing, err := g.recordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, data := range existing.Values {
+		if value := unquoteTXT(data); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT record set of name, keeping its values other than
+// SPF records. LiveDNS holds a single record set for each name and type,
+// replaced as a whole, so the values are carried over rather than adding a
+// record next to them.
+func (g *gandi) Apply(ctx context.Context, name, value string) error {
+	existing, err := g.recordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	name = relativeName(name, g.Zone)
+
+	set := gandiRecordSet{TTL: g.TTL}
+	set.Values = slices.DeleteFunc(existing.Values, func(data string) bool {
+		return spf.IsRecord(unquoteTXT(data))
+	})
+	if value != "" {
+		set.Values = append(set.Values, quoteChunks(spf.Chunk(value)))
+	}
+
+	switch {
+	case len(set.Values) > 0:
+		return g.call(ctx, http.MethodPut, name, set, nil)
+	case len(existing.Values) > 0:
+		return g.call(ctx, http.MethodDelete, name, nil, nil)
+	}
+	return nil
+}
+
+// Verify checks that the TXT record set of name holds value, see verifySPF.
+func (g *gandi) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, g, name, value)
+}
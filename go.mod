@@ -2,12 +2,15 @@ module github.com/perryh/dns-spf-flatten
 
 go 1.25.5
 
-require github.com/miekg/dns v1.1.70
+require (
+	github.com/miekg/dns v1.1.70
+	golang.org/x/net v0.48.0
+	golang.org/x/sys v0.39.0
+)
 
 require (
 	golang.org/x/mod v0.31.0 // indirect
-	golang.org/x/net v0.48.0 // indirect
 	golang.org/x/sync v0.19.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
 	golang.org/x/tools v0.40.0 // indirect
 )
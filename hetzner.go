@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerHetzner = "hetzner"
+
+func init() {
+	spfpublish.Register(providerHetzner, newHetzner)
+}
+
+// hetznerEndpoint is the base URL of the Hetzner DNS API.
+const hetznerEndpoint = "https://dns.hetzner.com/api/v1"
+
+// hetzner publishes records through the Hetzner DNS API, authenticating
+// with an API token from HETZNER_DNS_API_TOKEN or -credentials.
+type hetzner struct {
+	spfpublish.Config
+	header http.Header
+	zoneID string
+}
+
+// hetznerRecord is a record of the Hetzner DNS API, whose name is relative
+// to the zone and whose TXT value is in zone file presentation format.
+type hetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl"`
+}
+
+// newHetzner returns a publisher for the Hetzner DNS zone of config.
+func newHetzner(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "HETZNER_DNS_API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = hetznerEndpoint
+	}
+	return &hetzner{
+		Config: config,
+		header: http.Header{"Auth-Api-Token": {token}},
+	}, nil
+}
+
+// call sends a request to the API path and decodes the response into out.
+func (h *hetzner) call(ctx context.Context, method, path string, in, out any) error {
+	err := doJSON(ctx, h.Client, method, strings.TrimSuffix(h.Endpoint, "/")+path, h.header, in, out)
+	// Failed requests come with a message describing the error, nested or
+	// not depending on the error
+	var apiErr *apiError
+	var resp struct {
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil {
+		switch {
+		case resp.Error.Message != "":
+			return errors.New(resp.Error.Message)
+		case resp.Message != "":
+			return errors.New(resp.Message)
+		}
+	}
+	return err
+}
+
+// zone returns the ID of the zone, looking it up by name the first time.
+func (h *hetzner) zone(ctx context.Context) (string, error) {
+	if h.zoneID != "" {
+		return h.zoneID, nil
+	}
+	var zones struct {
+		Zones []struct {
+			ID string `json:"id"`
+		} `json:"zones"`
+	}
+	if err := h.call(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(h.Zone), nil, &zones); err != nil {
+		return "", fmt.Errorf("failed to look up zone %s: %w", h.Zone, err)
+	}
+	if len(zones.Zones) == 0 {
+		return "", fmt.Errorf("zone %s not found, or not accessible with the API token", h.Zone)
+	}
+	h.zoneID = zones.Zones[0].ID
+	return h.zoneID, nil
+}
+
+// spfRecords returns the ID of the zone along with the SPF records of name.
+func (h *hetzner) spfRecords(ctx context.Context, name string) (string, []hetznerRecord, error) {
+	zoneID, err := h.zone(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	// The records of a zone can only be listed all at once
+	var existing struct {
+		Records []hetznerRecord `json:"records"`
+	}
+	if err := h.call(ctx, http.MethodGet, "/records?zone_id="+url.QueryEscape(zoneID), nil, &existing); err != nil {
+		return "", nil, err
+	}
+	label := relativeName(name, h.Zone)
+	return zoneID, slices.DeleteFunc(existing.Records, func(record hetznerRecord) bool {
+		return record.Type != "TXT" || !strings.EqualFold(record.Name, label) || !spf.IsRecord(unquoteTXT(record.Value))
+	}), nil
+}
+
+// Current returns the SPF records of name.
+func (h *hetzner) Current(ctx context.Context, name string) ([]string, error) {
+	_, existing, err := h.spfRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing {
+		values = append(values, unquoteTXT(record.Value))
+	}
+	return values, nil
+}
+
+// Apply updates the SPF record of name in place when there is one, creating
+// it otherwise, and deletes any other SPF record of name.
+func (h *hetzner) Apply(ctx context.Context, name, value string) error {
+	zoneID, existing, err := h.spfRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Hetzner takes long TXT values split into quoted character-strings.
+	// The first SPF record is updated and the others deleted, all of them
+	// when there is no value.
+	replaced := value == ""
+	for _, record := range existing {
+		path := "/records/" + url.PathEscape(record.ID)
+		if replaced {
+			if err := h.call(ctx, http.MethodDelete, path, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Value, record.TTL = quoteChunks(spf.Chunk(value)), h.TTL
+		if err := h.call(ctx, http.MethodPut, path, record, nil); err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if replaced {
+		return nil
+	}
+	record := hetznerRecord{ZoneID: zoneID, Type: "TXT", Name: relativeName(name, h.Zone), Value: quoteChunks(spf.Chunk(value)), TTL: h.TTL}
+	return h.call(ctx, http.MethodPost, "/records", record, nil)
+}
+
+// Verify checks that name holds value, see verifySPF.
+func (h *hetzner) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, h, name, value)
+}
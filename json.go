@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// Output formats selecting how a flattened result is serialized.
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// jsonDocument is the document written by -format json.
+type jsonDocument struct {
+	Entries   []spfflatten.Entry       `json:"entries"`
+	Terms     []string                 `json:"terms"`
+	All       string                   `json:"all,omitempty"`
+	Modifiers []string                 `json:"modifiers"`
+	Record    string                   `json:"record"`
+	Lookups   int                      `json:"lookups"`
+	Queries   int                      `json:"dns_queries"`
+	Warnings  []string                 `json:"warnings"`
+	Skipped   []spfflatten.SkippedTerm `json:"skipped"`
+}
+
+// writeJSON writes the flattened result along with its metadata as JSON.
+func writeJSON(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	doc := jsonDocument{
+		Entries:   result.Entries,
+		Terms:     result.Terms,
+		All:       allTerm(result, opts),
+		Modifiers: result.Modifiers,
+		Record:    record,
+		Lookups:   result.Lookups,
+		Queries:   result.Queries,
+		Warnings:  result.Warnings,
+		Skipped:   result.Skipped,
+	}
+	if !opts.KeepModifiers {
+		doc.Modifiers = nil
+	}
+
+	// Encode empty lists as [] rather than null for easier consumption
+	if doc.Entries == nil {
+		doc.Entries = []spfflatten.Entry{}
+	}
+	if doc.Terms == nil {
+		doc.Terms = []string{}
+	}
+	if doc.Modifiers == nil {
+		doc.Modifiers = []string{}
+	}
+	if doc.Warnings == nil {
+		doc.Warnings = []string{}
+	}
+	if doc.Skipped == nil {
+		doc.Skipped = []spfflatten.SkippedTerm{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
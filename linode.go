@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerLinode = "linode"
+
+func init() {
+	spfpublish.Register(providerLinode, newLinode)
+}
+
+// linodeEndpoint is the base URL of the Linode API.
+const linodeEndpoint = "https://api.linode.com/v4"
+
+// linode publishes records through the domains API of Linode, authenticating
+// with a personal access token from LINODE_TOKEN or -credentials that has
+// the domains read/write scope.
+type linode struct {
+	spfpublish.Config
+	header   http.Header
+	domainID int
+}
+
+// linodeRecord is a domain record of the Linode API, whose name is relative
+// to the domain, empty for the domain itself.
+type linodeRecord struct {
+	ID     int    `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	TTL    int    `json:"ttl_sec"`
+}
+
+// linodePage is a page of a list of the Linode API.
+type linodePage[T any] struct {
+	Data  []T `json:"data"`
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+}
+
+// newLinode returns a publisher for the Linode domain of config.
+func newLinode(config spfpublish.Config) (spfpublish.Publisher, error) {
+	token, err := readCredentials(config.Credentials, "LINODE_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = linodeEndpoint
+	}
+	return &linode{
+		Config: config,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+	}, nil
+}
+
+// call sends a request to the API path, with the X-Filter header of filter
+// when not nil.
+func (l *linode) call(ctx context.Context, method, path string, filter map[string]string, in, out any) error {
+	header := l.header
+	if filter != nil {
+		data, err := json.Marshal(filter)
+		if err != nil {
+			return err
+		}
+		header = header.Clone()
+		header.Set("X-Filter", string(data))
+	}
+	err := doJSON(ctx, l.Client, method, strings.TrimSuffix(l.Endpoint, "/")+path, header, in, out)
+	// Failed requests come with the reasons of the errors
+	var apiErr *apiError
+	var resp struct {
+		Errors []struct {
+			Field  string `json:"field"`
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	}
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && len(resp.Errors) > 0 {
+		var errs []error
+		for _, e := range resp.Errors {
+			if e.Field != "" {
+				e.Reason = e.Field + ": " + e.Reason
+			}
+			errs = append(errs, errors.New(e.Reason))
+		}
+		return errors.Join(errs...)
+	}
+	return err
+}
+
+// domain returns the ID of the domain, looking it up by name the first
+// time.
+func (l *linode) domain(ctx context.Context) (int, error) {
+	if l.domainID != 0 {
+		return l.domainID, nil
+	}
+	var domains linodePage[struct {
+		ID     int    `json:"id"`
+		Domain string `json:"domain"`
+	}]
+	if err := l.call(ctx, http.MethodGet, "/domains", map[string]string{"domain": l.Zone}, nil, &domains); err != nil {
+		return 0, fmt.Errorf("failed to look up domain %s: %w", l.Zone, err)
+	}
+	for _, domain := range domains.Data {
+		if strings.EqualFold(domain.Domain, l.Zone) {
+			l.domainID = domain.ID
+			return l.domainID, nil
+		}
+	}
+	return 0, fmt.Errorf("domain %s not found, or not accessible with the token", l.Zone)
+}
+
+// spfRecords returns the API path of the records of the domain along with
+// the SPF records of name.
+func (l *linode) spfRecords(ctx context.Context, name string) (string, []linodeRecord, error) {
+	domainID, err := l.domain(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	records := "/domains/" + strconv.Itoa(domainID) + "/records"
+	label := linodeLabel(name, l.Zone)
+	var existing []linodeRecord
+	for page := 1; ; page++ {
+		var list linodePage[linodeRecord]
+		filter := map[string]string{"type": "TXT", "name": label}
+		if err := l.call(ctx, http.MethodGet, records+"?page_size=500&page="+strconv.Itoa(page), filter, nil, &list); err != nil {
+			return "", nil, err
+		}
+		existing = append(existing, list.Data...)
+		if page >= list.Pages {
+			break
+		}
+	}
+	return records, slices.DeleteFunc(existing, func(record linodeRecord) bool {
+		return record.Type != "TXT" || !strings.EqualFold(record.Name, label) || !spf.IsRecord(unquoteTXT(record.Target))
+	}), nil
+}
+
+// linodeLabel returns the name of the records of name in the domain zone,
+// which is empty for the domain itself.
+func linodeLabel(name, zone string) string {
+	label := relativeName(name, zone)
+	if label == "@" {
+		return ""
+	}
+	return label
+}
+
+// Current returns the SPF records of name.
+func (l *linode) Current(ctx context.Context, name string) ([]string, error) {
+	_, existing, err := l.spfRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing {
+		values = append(values, unquoteTXT(record.Target))
+	}
+	return values, nil
+}
+
+// Apply updates the SPF record of name in place when there is one, creating
+// it otherwise, and deletes any other SPF record of name. Records are
+// updated and deleted by their ID, which an update keeps.
+func (l *linode) Apply(ctx context.Context, name, value string) error {
+	records, existing, err := l.spfRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// Linode splits long TXT values into character-strings itself. The
+	// first SPF record is updated and the others deleted, all of them when
+	// there is no value.
+	replaced := value == ""
+	for _, record := range existing {
+		path := records + "/" + strconv.Itoa(record.ID)
+		if replaced {
+			if err := l.call(ctx, http.MethodDelete, path, nil, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		record.Target, record.TTL = value, l.TTL
+		if err := l.call(ctx, http.MethodPut, path, nil, record, nil); err != nil {
+			return err
+		}
+		replaced = true
+	}
+	if replaced {
+		return nil
+	}
+	return l.call(ctx, http.MethodPost, records, nil, linodeRecord{Type: "TXT", Name: linodeLabel(name, l.Zone), Target: value, TTL: l.TTL}, nil)
+}
+
+// Verify checks that name holds value, see verifySPF.
+func (l *linode) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, l, name, value)
+}
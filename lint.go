@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// commandLint is the command checking the published records against the DNS
+// lookup limit instead of flattening them.
+const commandLint = "lint"
+
+// writeLint writes, for each include domain, the number of DNS lookups
+// evaluating its published record consumes against the limit of RFC 7208
+// section 4.6.4, followed by the lookups of each branch of its include tree.
+// It reports whether every record is within the limit.
+func writeLint(w io.Writer, result *spfflatten.Result) bool {
+	c := newLookupCounter(result.Tree)
+	ok := true
+	for _, root := range result.Tree {
+		total, loop := c.total(root)
+		switch {
+		case loop:
+			ok = false
+			fmt.Fprintf(w, "%s: include loop, which receivers evaluate to a permanent error\n", root.Domain)
+		case total > spfflatten.MaxLookups:
+			ok = false
+			fmt.Fprintf(w, "%s: %d DNS lookups, exceeding the limit of %d\n", root.Domain, total, spfflatten.MaxLookups)
+		default:
+			fmt.Fprintf(w, "%s: %d DNS lookups, within the limit of %d\n", root.Domain, total, spfflatten.MaxLookups)
+		}
+		fmt.Fprintln(w, c.label(root))
+		c.writeBranches(w, root.Children, "")
+	}
+	return ok
+}
+
+// lookupCounter counts the DNS lookups of the branches of an include tree.
+// Domains included more than once are only resolved once, so their repeated
+// nodes are counted as their first occurrence, which receivers evaluate
+// again.
+type lookupCounter struct {
+	first  map[string]*spfflatten.Node
+	totals map[*spfflatten.Node]int
+	active map[*spfflatten.Node]bool
+}
+
+// newLookupCounter returns a counter of the lookups of the tree made of
+// nodes.
+func newLookupCounter(nodes []*spfflatten.Node) *lookupCounter {
+	c := &lookupCounter{
+		first:  make(map[string]*spfflatten.Node),
+		totals: make(map[*spfflatten.Node]int),
+		active: make(map[*spfflatten.Node]bool),
+	}
+	var walk func([]*spfflatten.Node)
+	walk = func(nodes []*spfflatten.Node) {
+		for _, node := range nodes {
+			if !node.Repeated {
+				c.first[node.Domain] = node
+			}
+			walk(node.Children)
+		}
+	}
+	walk(nodes)
+	return c
+}
+
+// total returns the number of DNS lookups evaluating the record of node
+// consumes, including the records it includes or redirects to, and whether
+// evaluating it loops.
+func (c *lookupCounter) total(node *spfflatten.Node) (int, bool) {
+	if node.Repeated {
+		first := c.first[node.Domain]
+		if first == nil {
+			return 0, false
+		}
+		node = first
+	}
+	if c.active[node] {
+		return 0, true
+	}
+	if total, ok := c.totals[node]; ok {
+		return total, false
+	}
+
+	c.active[node] = true
+	defer delete(c.active, node)
+	total := node.Lookups
+	for _, child := range node.Children {
+		lookups, loop := c.total(child)
+		if loop {
+			return 0, true
+		}
+		total += lookups
+	}
+	c.totals[node] = total
+	return total, false
+}
+
+// writeBranches writes nodes below a parent like writeSubtree, prefixing
+// each line with indent.
+func (c *lookupCounter) writeBranches(w io.Writer, nodes []*spfflatten.Node, indent string) {
+	for i, node := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%s%s%s:%s\n", indent, branch, node.Via, c.label(node))
+		c.writeBranches(w, node.Children, indent+next)
+	}
+}
+
+// label returns the domain of node with the lookups of its own record and of
+// its whole branch.
+func (c *lookupCounter) label(node *spfflatten.Node) string {
+	total, loop := c.total(node)
+	switch {
+	case loop && node.Repeated:
+		return node.Domain + " (include loop)"
+	case loop:
+		return fmt.Sprintf("%s (%d lookups, looping)", node.Domain, node.Lookups)
+	case node.Repeated:
+		return fmt.Sprintf("%s (already visited, %d in total)", node.Domain, total)
+	}
+	return fmt.Sprintf("%s (%d lookups, %d in total)", node.Domain, node.Lookups, total)
+}
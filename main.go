@@ -1,210 +1,748 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
 )
 
-type SPFRecord struct {
-	IP4      []string
-	IP6      []string
-	Includes []string
-}
-
 func main() {
 	var (
-		ip4List     stringSlice
-		ip6List     stringSlice
-		includeList stringSlice
-		tags        bool
+		ip4List           stringSlice
+		ip6List           stringSlice
+		includeList       stringSlice
+		keepIncludeList   stringSlice
+		headerList        stringSlice
+		provider          string
+		credentials       string
+		endpoint          string
+		dryRun            bool
+		apply             bool
+		propagationList   stringSlice
+		propagationWait   time.Duration
+		scheduled         bool
+		tags              bool
+		keepModifiers     bool
+		ptrMode           string
+		keepExists        bool
+		allowMacros       bool
+		allQualifier      string
+		strict            bool
+		unicode           bool
+		output            string
+		domain            string
+		splitTemplate     string
+		splitSize         int
+		format            string
+		ttl               int
+		terraformProvider string
+		zone              string
+		templateFile      string
+		setName           string
+		nftTable          string
+		family            string
+		nginxDenyAll      bool
+		postfixAction     string
+		sortOrder         string
+		annotate          bool
+		tree              bool
+		summary           bool
+		redundancy        bool
+		resolverList      stringSlice
+		tlsServerName     string
+		tlsSPKI           string
+		verify            bool
+		retries           int
+		retryBackoff      time.Duration
+		retryJitter       time.Duration
+		queryTimeout      time.Duration
+		deadline          time.Duration
+		ednsSize          int
+		noEDNS            bool
+		dnssec            bool
+		qps               float64
+		proxyAddress      string
+		concurrency       int
+		sourceAddress     string
+		authoritative     bool
+		maxDepth          int
+		lookupBudget      int
+		maxPrefix         string
+		sizeBudget        int
+		senderIP          string
+		mailFrom          string
+		helo              string
 	)
 
 	flag.Var(&ip4List, "ip4", "IPv4 addresses to include (can be specified multiple times)")
 	flag.Var(&ip6List, "ip6", "IPv6 addresses to include (can be specified multiple times)")
 	flag.Var(&includeList, "include", "Domain names to include SPF records from (can be specified multiple times)")
+	flag.Var(&keepIncludeList, "keep-include", "Include domain to keep as an include: mechanism instead of flattening it, such as a provider whose addresses change frequently (can be specified multiple times)")
+	flag.BoolVar(&scheduled, "scheduled", false, "Silence the warnings about includes known to change their addresses frequently, as the run is repeated on a schedule")
 	flag.BoolVar(&tags, "tags", false, "Add ip4 or ip6 tag to each IP address")
+	flag.BoolVar(&keepModifiers, "keep-modifiers", false, "Output modifiers such as exp= from the top-level include records")
+	flag.StringVar(&ptrMode, "ptr-mode", spfflatten.PtrModeWarn, "How to handle ptr mechanisms: warn (skip with a warning), fail, or resolve (forward-confirmed reverse DNS of the domain's addresses)")
+	flag.BoolVar(&keepExists, "keep-exists", false, "Carry exists: mechanisms verbatim into the output instead of skipping them")
+	flag.BoolVar(&allowMacros, "allow-macros", false, "Pass mechanisms whose targets depend on macros such as %{i} through unchanged instead of failing")
+	flag.BoolVar(&allowMacros, "force", false, "Same as -allow-macros")
+	flag.StringVar(&allQualifier, "all-qualifier", "", "Qualifier (+, -, ~ or ?) of the all mechanism ending the output, overriding the one from the top-level include records")
+	flag.BoolVar(&strict, "strict", false, "Fail on records that receivers treat as a permanent error, such as invalid terms, multiple SPF records, include loops or exceeding -lookup-budget")
+	flag.BoolVar(&unicode, "unicode", false, "Show internationalized domain names in their Unicode form in warnings and errors")
+	flag.StringVar(&output, "output", outputList, "What to output: list (one IP address per line), record (a complete SPF record), or split (a root record including as many records as needed to stay within -split-size)")
+	flag.StringVar(&domain, "domain", "", "Domain the generated records are published on, required for -output split and for the formats that publish records")
+	flag.StringVar(&splitTemplate, "split-template", "spf%d", "Name of the included records relative to -domain, %d being replaced by the record number")
+	flag.IntVar(&splitSize, "split-size", 255, "Maximum length in bytes of each record generated by -output split")
+	flag.StringVar(&format, "format", formatText, "Output format: text, json (entries with their source, mechanism and TTL, plus lookup counts and warnings), csv (one row per entry with its source), terraform (DNS record resources), dnscontrol (TXT record modifiers), octodns (zone YAML), nsupdate (RFC 2136 update batch), dot (Graphviz graph of the include tree), mermaid (Mermaid flowchart of the include tree), nftables (nft script filling address sets), ipset (ipset restore script), pf (pf table file), haproxy (HAProxy src ACL file), nginx (allow directives), postfix (Postfix cidr: access table), exim (Exim host list), ndjson (one JSON entry per line, streamed as resolved), prom (Prometheus textfile collector metrics), markdown or html (report for change requests and reviews)")
+	flag.StringVar(&templateFile, "template", "", "Go text/template file to execute with the result instead of using -format")
+	flag.StringVar(&zone, "zone", "", "Zone containing -domain for -format nsupdate and the publish command (default: -domain)")
+	flag.IntVar(&ttl, "ttl", 300, "TTL of the generated records in formats that publish them, such as terraform")
+	flag.StringVar(&terraformProvider, "terraform-provider", terraformRoute53, "Resource type for -format terraform: route53 (aws_route53_record) or cloudflare (cloudflare_record)")
+	flag.StringVar(&setName, "set-name", "spf", "Name of the table or list of -format pf and exim, and base name of the sets written by -format nftables and ipset, suffixed with _v4 and _v6")
+	flag.StringVar(&nftTable, "nft-table", "inet filter", "Family and name of the nftables table holding the sets of -format nftables")
+	flag.StringVar(&family, "family", "", "Only output entries of the address family ipv4 or ipv6, such as to write separate ACL files")
+	flag.BoolVar(&nginxDenyAll, "nginx-deny-all", false, "End the directives of -format nginx with deny all;")
+	flag.StringVar(&postfixAction, "postfix-action", "OK", "Action of each network in the table of -format postfix")
+	flag.StringVar(&sortOrder, "sort", sortDiscovery, "Order of the entries: discovery (order resolved in) or numeric (IPv4 then IPv6, by address and prefix length)")
+	flag.BoolVar(&annotate, "annotate", false, "Append a comment with the include chain each entry came from to the lines of the list output and of -format pf and nginx")
+	flag.BoolVar(&tree, "tree", false, "Print the tree of include and redirect domains with the lookups and entries of each instead of the flattened record")
+	flag.BoolVar(&summary, "summary", false, "Print entry counts, record length, DNS lookups and queries, and include depth to stderr after the output")
+	flag.BoolVar(&redundancy, "redundancy", false, "Print the entries covered by broader entries, with the records they came from, to stderr after the output")
+	flag.Var(&resolverList, "resolver", "DNS resolver as host:port, tcp://host[:port] for TCP only, tls://host[:port] for DNS-over-TLS, or https:// URL of a DNS-over-HTTPS endpoint (can be specified multiple times to fail over in order on errors and SERVFAIL, default: $DNS_RESOLVER or the system nameservers)")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "Name to verify the certificate of a DNS-over-TLS resolver against (default: its host)")
+	flag.StringVar(&tlsSPKI, "tls-spki", "", "Base64 SHA-256 pin of the SubjectPublicKeyInfo authenticating a DNS-over-TLS resolver instead of its certificate")
+	flag.BoolVar(&verify, "verify-resolvers", false, "Flatten separately against each -resolver and report the terms they disagree on instead of printing the record, exiting with status 1 on differences")
+	flag.IntVar(&retries, "retries", 2, "Number of times to retry a DNS query that no resolver answered")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 250*time.Millisecond, "Delay before the first retry of a DNS query, doubled on each further retry")
+	flag.DurationVar(&retryJitter, "retry-jitter", 100*time.Millisecond, "Maximum random delay added to each retry backoff")
+	flag.DurationVar(&queryTimeout, "query-timeout", 2*time.Second, "Time to wait for each DNS query to a resolver")
+	flag.DurationVar(&deadline, "deadline", 0, "Maximum time to spend on DNS queries in total, after which the run fails with a report of what was resolved, not including the changes of the publish command (default: no limit)")
+	flag.IntVar(&ednsSize, "edns-size", 4096, "UDP payload size advertised with EDNS0, lower values avoiding fragmentation through broken firewalls")
+	flag.BoolVar(&noEDNS, "no-edns", false, "Send DNS queries without EDNS0, relying on TCP for answers larger than 512 bytes")
+	flag.BoolVar(&dnssec, "dnssec", false, "Fail unless every DNS answer is authenticated by DNSSEC, as reported by the AD flag of a validating resolver")
+	flag.Float64Var(&qps, "qps", 0, "Maximum number of DNS queries sent per second (default: no limit)")
+	flag.StringVar(&proxyAddress, "proxy", "", "URL of a socks5:// or http:// proxy to send DNS queries through, over TCP, DNS-over-TLS or DNS-over-HTTPS")
+	flag.IntVar(&concurrency, "concurrency", 1, "Number of records fetched concurrently")
+	flag.StringVar(&sourceAddress, "source-ip", "", "Local address to send DNS queries from, on multi-homed hosts")
+	flag.IntVar(&maxDepth, "max-depth", 0, "Maximum number of include and redirect levels below each include domain (default: no limit)")
+	flag.IntVar(&lookupBudget, "lookup-budget", spfflatten.MaxLookups, "Number of DNS lookups the generated records may require before warning, lower to leave room for other mechanisms")
+	flag.StringVar(&maxPrefix, "max-prefix", "", "Shortest prefix lengths of the networks the include domains may authorize as cidr4, cidr4//cidr6 or //cidr6, such as 16//32, failing on broader networks instead of warning about those broader than /12 or //32")
+	flag.IntVar(&sizeBudget, "size-budget", 0, "Number of bytes the generated record may take before warning, such as the limit of a DNS provider (default: no budget)")
+	flag.StringVar(&senderIP, "ip", "", "Address of the SMTP client to evaluate the records for with the evaluate and explain commands")
+	flag.StringVar(&mailFrom, "sender", "", "MAIL FROM address to evaluate the records for with the evaluate command (default: postmaster@ the -helo domain)")
+	flag.StringVar(&helo, "helo", "", "HELO domain to evaluate the records for with the evaluate command")
+	flag.StringVar(&provider, "provider", "", "DNS provider to update the records of -domain with the publish command: "+strings.Join(spfpublish.Providers(), ", "))
+	flag.StringVar(&credentials, "credentials", "", "File holding the credentials of -provider, instead of its environment variables")
+	flag.StringVar(&endpoint, "endpoint", "", "Base URL of the API of -provider (default: its public API, required for powerdns), or address of the primary nameserver for rfc2136")
+	flag.StringVar(&endpoint, "url", "", "Same as -endpoint, such as the URL to post the changes to with -provider webhook")
+	flag.Var(&headerList, "header", "Header field as \"Name: value\" to send with the requests of -provider webhook, such as an authorization (can be specified multiple times)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the plan of the publish command without making the changes or asking to")
+	flag.BoolVar(&apply, "apply", false, "Make the changes planned by the publish command without asking for confirmation")
+	flag.DurationVar(&propagationWait, "propagation-timeout", 10*time.Minute, "Time to wait for the changes made by the publish command to reach the resolvers of -propagation-resolver, exiting with status 6 when they do not (0 to not wait)")
+	flag.Var(&propagationList, "propagation-resolver", "Resolver as for -resolver that the changes made by the publish command must reach (can be specified multiple times, default: "+strings.Join(propagationResolvers, ", ")+")")
+	flag.BoolVar(&authoritative, "authoritative", false, "Query the authoritative nameservers of each domain directly instead of the resolvers, which are only used to find them, for uncached data")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [lint | audit | check | evaluate | explain | publish] [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	command := ""
+	if arg := flag.Arg(0); arg == commandLint || arg == commandAudit || arg == commandCheck || arg == commandEvaluate || arg == commandExplain || arg == commandPublish {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
 	if len(includeList) == 0 && len(ip4List) == 0 && len(ip6List) == 0 {
 		fmt.Fprintln(os.Stderr, "Error: At least one -ip4, -ip6, or -include argument is required")
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	ips, err := flattenSPF(ip4List, ip6List, includeList)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if command != "" && len(includeList) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: %s requires at least one -include argument\n", command)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if (command == commandCheck || command == commandPublish) && domain == "" {
+		fmt.Fprintf(os.Stderr, "Error: %s requires -domain\n", command)
+		flag.Usage()
 		os.Exit(1)
 	}
+	if apply && dryRun {
+		fmt.Fprintln(os.Stderr, "Error: -apply and -dry-run cannot be used together")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if _, ok := spfpublish.Lookup(provider); command == commandPublish && !ok {
+		fmt.Fprintf(os.Stderr, "Error: publish requires -provider %s, got %q\n", strings.Join(spfpublish.Providers(), ", "), provider)
+		flag.Usage()
+		os.Exit(1)
+	}
+	publishHeader := http.Header{}
+	for _, field := range headerList {
+		name, value, ok := strings.Cut(field, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid -header %q, must be Name: value\n", field)
+			flag.Usage()
+			os.Exit(1)
+		}
+		publishHeader.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	var sender spfflatten.Sender
+	if command == commandEvaluate || command == commandExplain {
+		addr, err := netip.ParseAddr(senderIP)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s requires a valid -ip address, got %q\n", command, senderIP)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if command == commandEvaluate && mailFrom == "" && helo == "" {
+			fmt.Fprintln(os.Stderr, "Error: evaluate requires -sender or -helo")
+			flag.Usage()
+			os.Exit(1)
+		}
+		sender = spfflatten.Sender{IP: addr, MailFrom: mailFrom, Helo: helo}
+	}
 
-	for _, ip := range ips {
-		if tags {
-			tag := "ip6"
-			if net.ParseIP(strings.Split(ip, "/")[0]).To4() != nil {
-				tag = "ip4"
-			}
-			fmt.Printf("%s:%s\n", tag, ip)
-		} else {
-			fmt.Println(ip)
+	if ednsSize < dns.MinMsgSize || ednsSize > dns.MaxMsgSize {
+		fmt.Fprintf(os.Stderr, "Error: invalid -edns-size %d, must be between %d and %d\n", ednsSize, dns.MinMsgSize, dns.MaxMsgSize)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if dnssec && authoritative {
+		fmt.Fprintln(os.Stderr, "Error: -dnssec relies on a validating resolver and cannot be used with -authoritative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if noEDNS {
+		if dnssec {
+			fmt.Fprintln(os.Stderr, "Error: -dnssec requires EDNS0 and cannot be used with -no-edns")
+			flag.Usage()
+			os.Exit(1)
 		}
 	}
-}
 
-func flattenSPF(ip4List, ip6List, includeList []string) ([]string, error) {
-	var allIPs []string
+	if qps < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -qps %g\n", qps)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	allIPs = append(allIPs, ip4List...)
-	allIPs = append(allIPs, ip6List...)
+	if concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -concurrency %d\n", concurrency)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	visited := make(map[string]bool)
-	for _, domain := range includeList {
-		ips, err := resolveDomain(domain, visited)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve include domain %s: %w", domain, err)
-		}
-		allIPs = append(allIPs, ips...)
+	if maxDepth < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -max-depth %d\n", maxDepth)
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	uniqueIPs := deduplicateIPs(allIPs)
-	return uniqueIPs, nil
-}
+	if lookupBudget < 1 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -lookup-budget %d\n", lookupBudget)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-func resolveDomain(domain string, visited map[string]bool) ([]string, error) {
-	domain = strings.ToLower(domain)
+	maxPrefix4, maxPrefix6, ok := parseMaxPrefix(maxPrefix)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: invalid -max-prefix %q, must be cidr4, cidr4//cidr6 or //cidr6\n", maxPrefix)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	if visited[domain] {
-		return nil, nil
+	if sizeBudget < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -size-budget %d\n", sizeBudget)
+		flag.Usage()
+		os.Exit(1)
 	}
-	visited[domain] = true
 
-	spfRecord, err := getSPFRecord(domain)
-	if err != nil {
-		return nil, err
+	if retries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -retries %d\n", retries)
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	var ips []string
-	ips = append(ips, spfRecord.IP4...)
-	ips = append(ips, spfRecord.IP6...)
+	if ptrMode != spfflatten.PtrModeWarn && ptrMode != spfflatten.PtrModeFail && ptrMode != spfflatten.PtrModeResolve {
+		fmt.Fprintf(os.Stderr, "Error: invalid -ptr-mode %q\n", ptrMode)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	for _, includeDomain := range spfRecord.Includes {
-		includeIPs, err := resolveDomain(includeDomain, visited)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve include %s: %w", includeDomain, err)
-		}
-		ips = append(ips, includeIPs...)
+	if output != outputList && output != outputRecord && output != outputSplit {
+		fmt.Fprintf(os.Stderr, "Error: invalid -output %q\n", output)
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	return ips, nil
-}
+	if _, ok := spfflatten.LookupFormat(format); !ok {
+		fmt.Fprintf(os.Stderr, "Error: invalid -format %q\n", format)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (output == outputSplit || slices.Contains(recordFormats, format)) && domain == "" {
+		fmt.Fprintf(os.Stderr, "Error: -domain is required for -output split and -format %s\n", strings.Join(recordFormats, ", "))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if terraformProvider != terraformRoute53 && terraformProvider != terraformCloudflare {
+		fmt.Fprintf(os.Stderr, "Error: invalid -terraform-provider %q\n", terraformProvider)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if strings.Count(splitTemplate, "%d") != 1 {
+		fmt.Fprintf(os.Stderr, "Error: -split-template %q must contain %%d exactly once\n", splitTemplate)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if sortOrder != sortDiscovery && sortOrder != sortNumeric {
+		fmt.Fprintf(os.Stderr, "Error: invalid -sort %q\n", sortOrder)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// The entries of ndjson are written as they are resolved, before they
+	// can be sorted or checked against -max-prefix.
+	streaming := format == formatNDJSON && templateFile == "" && command == ""
+	if streaming && (sortOrder != sortDiscovery || maxPrefix != "") {
+		fmt.Fprintln(os.Stderr, "Error: -format ndjson streams the entries as they are resolved and cannot be used with -sort numeric or -max-prefix")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-func getSPFRecord(domain string) (*SPFRecord, error) {
-	c := new(dns.Client)
-	m := new(dns.Msg)
+	if family != "" && family != familyIPv4 && family != familyIPv6 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -family %q\n", family)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	m.SetQuestion(dns.Fqdn(domain), dns.TypeTXT)
-	m.RecursionDesired = true
-	m.SetEdns0(4096, false)
+	switch allQualifier {
+	case "", "+", "-", "~", "?":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -all-qualifier %q\n", allQualifier)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	r, _, err := c.Exchange(m, getDNSResolver())
+	resolvers := []string(resolverList)
+	if len(resolvers) == 0 {
+		resolvers = getDNSResolvers()
+	}
+	tlsConfig, err := spfflatten.NewTLSConfig(tlsServerName, tlsSPKI)
 	if err != nil {
-		return nil, fmt.Errorf("DNS query failed: %w", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	if r.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("DNS query returned error code: %s", dns.RcodeToString[r.Rcode])
+	// Interrupting the run or reaching -deadline cancels the DNS queries in
+	// flight. Publishing is only stopped by interrupting the run, as the
+	// changes and their propagation take their own time.
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx := signalCtx
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(signalCtx, deadline)
+		defer cancel()
 	}
 
-	var spfTxt string
-	for _, ans := range r.Answer {
-		if txt, ok := ans.(*dns.TXT); ok {
-			// Concatenate all strings in the TXT record to build the complete record
-			fullTxt := strings.Join(txt.Txt, "")
-			if strings.HasPrefix(strings.ToLower(fullTxt), "v=spf1") {
-				spfTxt = strings.ToLower(fullTxt)
-				break
+	config := spfflatten.Options{
+		PtrMode:       ptrMode,
+		KeepExists:    keepExists,
+		AllowMacros:   allowMacros,
+		KeepIncludes:  keepIncludeList,
+		Scheduled:     scheduled,
+		Strict:        strict,
+		Unicode:       unicode,
+		Resolvers:     resolvers,
+		TLSConfig:     tlsConfig,
+		Retries:       retries,
+		Backoff:       retryBackoff,
+		Jitter:        retryJitter,
+		Timeout:       queryTimeout,
+		EDNSSize:      uint16(ednsSize),
+		NoEDNS:        noEDNS,
+		DNSSEC:        dnssec,
+		QPS:           qps,
+		Concurrency:   concurrency,
+		MaxDepth:      maxDepth,
+		LookupBudget:  lookupBudget,
+		MaxPrefix4:    maxPrefix4,
+		MaxPrefix6:    maxPrefix6,
+		Authoritative: authoritative,
+	}
+	// dialer opens the TCP connections of DNS-over-HTTPS and to proxies.
+	dialer := &net.Dialer{}
+	if sourceAddress != "" {
+		config.SourceIP = net.ParseIP(sourceAddress)
+		if config.SourceIP == nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -source-ip %q\n", sourceAddress)
+			flag.Usage()
+			os.Exit(1)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: config.SourceIP}
+	}
+	if proxyAddress != "" || config.SourceIP != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		if proxyAddress != "" {
+			proxyURL, err := url.Parse(proxyAddress)
+			if err == nil {
+				config.Dial, err = spfflatten.NewProxyDialer(proxyURL, dialer)
 			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid -proxy %q: %v\n", proxyAddress, err)
+				flag.Usage()
+				os.Exit(1)
+			}
+			transport.Proxy = http.ProxyURL(proxyURL)
 		}
+		config.HTTPClient = &http.Client{Transport: transport}
 	}
-
-	if spfTxt == "" {
-		return nil, fmt.Errorf("no SPF record found for domain %s", domain)
+	req := spfflatten.Request{Includes: includeList, IP4: ip4List, IP6: ip6List}
+	if verify {
+		if len(resolvers) < 2 {
+			fmt.Fprintln(os.Stderr, "Error: -verify-resolvers requires at least two -resolver arguments")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if !verifyResolvers(ctx, os.Stdout, config, req) {
+			os.Exit(1)
+		}
+		return
+	}
+	if streaming {
+		config.OnEntry = streamNDJSON(os.Stdout, family)
+	}
+	f := spfflatten.New(config)
+	result, err := f.Flatten(ctx, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", describeFlattenError(err))
+		if result != nil {
+			printPartial(os.Stderr, result)
+		}
+		os.Exit(exitStatus(err))
 	}
 
-	return parseSPFRecord(spfTxt)
-}
+	printWarnings(os.Stderr, result.Warnings)
+	printSkipped(f, result.Skipped)
+
+	switch command {
+	case commandLint:
+		if !writeLint(os.Stdout, result) {
+			os.Exit(exitPermanent)
+		}
+		return
+	case commandAudit:
+		if !writeAudit(os.Stdout, result) {
+			os.Exit(exitFindings)
+		}
+		return
+	}
 
-func parseSPFRecord(spf string) (*SPFRecord, error) {
-	record := &SPFRecord{
-		IP4:      []string{},
-		IP6:      []string{},
-		Includes: []string{},
+	if family != "" {
+		result.Entries = filterFamily(result.Entries, family)
+	}
+	if sortOrder == sortNumeric {
+		sortNumerically(result.Entries)
 	}
 
-	parts := strings.Fields(spf)
-	if len(parts) == 0 || !strings.HasPrefix(parts[0], "v=spf1") {
-		return nil, fmt.Errorf("invalid SPF record: %s", spf)
+	opts := spfflatten.FormatOptions{
+		Output:            output,
+		Annotate:          annotate,
+		Tags:              tags,
+		KeepModifiers:     keepModifiers,
+		Domain:            domain,
+		SplitTemplate:     splitTemplate,
+		SplitSize:         splitSize,
+		TTL:               ttl,
+		TerraformProvider: terraformProvider,
+		Zone:              zone,
+		LookupPublished: func(name string) ([][]string, error) {
+			return f.LookupPublished(ctx, name)
+		},
+		SetName:       setName,
+		NftTable:      nftTable,
+		NginxDenyAll:  nginxDenyAll,
+		PostfixAction: postfixAction,
+		LookupBudget:  lookupBudget,
+	}
+	if allQualifier != "" {
+		opts.All = allQualifier + "all"
+	}
+	if err := validateRecord(result, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: generated record is invalid: %v\n", err)
+		os.Exit(1)
+	}
+	if output != outputSplit {
+		name := domain
+		if name == "" && len(includeList) > 0 {
+			name = includeList[0]
+		}
+		record, err := generatedRecord(result, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: generated record is invalid: %v\n", err)
+			os.Exit(1)
+		}
+		warnRecordSize(os.Stderr, name, record, sizeBudget)
+	} else {
+		records, err := splitRecords(result, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		warnings := splitWarnings(result, records, opts)
+		printWarnings(os.Stderr, warnings)
+		result.Warnings = append(result.Warnings, warnings...)
 	}
 
-	for _, part := range parts[1:] {
-		if strings.HasPrefix(part, "ip4:") {
-			ip := strings.TrimPrefix(part, "ip4:")
-			if isValidIP(ip, 4) {
-				record.IP4 = append(record.IP4, ip)
+	if command == commandCheck {
+		inSync, err := checkPublished(os.Stdout, result, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitStatus(err))
+		}
+		if !inSync {
+			os.Exit(exitFindings)
+		}
+		return
+	}
+	if command == commandPublish {
+		publishZone := zone
+		if publishZone == "" {
+			publishZone = domain
+		}
+		interactive := !apply && !dryRun && isTerminal(os.Stdin)
+		factory, _ := spfpublish.Lookup(provider)
+		p, err := factory(spfpublish.Config{
+			Zone:        strings.TrimSuffix(publishZone, "."),
+			Credentials: credentials,
+			Endpoint:    endpoint,
+			Header:      publishHeader,
+			TTL:         ttl,
+			Client:      &http.Client{Timeout: time.Minute},
+			LookupSPF: func(ctx context.Context, name string) ([]string, error) {
+				published, err := f.LookupPublished(ctx, name)
+				values := make([]string, len(published))
+				for i, strs := range published {
+					values[i] = strings.Join(strs, "")
+				}
+				return values, err
+			},
+		})
+		var changes []publishChange
+		applied := false
+		if err == nil {
+			changes, err = planChanges(signalCtx, p, result, opts)
+		}
+		if err == nil {
+			writePlan(os.Stdout, changes, isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "")
+			switch {
+			case len(changes) == 0 || dryRun:
+			case interactive && !confirmApply(os.Stdout, os.Stdin):
+				err = errors.New("publish cancelled")
+			case apply || interactive:
+				fmt.Fprintln(os.Stdout)
+				err = applyChanges(signalCtx, os.Stdout, p, changes)
+				applied = err == nil
+			default:
+				fmt.Fprintln(os.Stdout, "Run again with -apply to make these changes")
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", provider, err)
+			os.Exit(1)
+		}
+		if applied && propagationWait > 0 {
+			config.Resolvers = propagationList
+			if len(config.Resolvers) == 0 {
+				config.Resolvers = propagationResolvers
 			}
-		} else if strings.HasPrefix(part, "ip6:") {
-			ip := strings.TrimPrefix(part, "ip6:")
-			if isValidIP(ip, 6) {
-				record.IP6 = append(record.IP6, ip)
+			if !waitPropagation(signalCtx, os.Stdout, config, changes, propagationWait) {
+				os.Exit(exitPropagation)
+			}
+		}
+		return
+	}
+	if command == commandEvaluate || command == commandExplain {
+		name := domain
+		if name == "" {
+			name = includeList[0]
+		}
+		if command == commandExplain {
+			if sender.Helo == "" {
+				sender.Helo = name
 			}
-		} else if strings.HasPrefix(part, "include:") {
-			domain := strings.TrimPrefix(part, "include:")
-			if domain != "" {
-				record.Includes = append(record.Includes, domain)
+			if err := writeExplanation(ctx, os.Stdout, f, result, opts, name, sender); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
 			}
+			return
+		}
+		same, err := evaluateSender(ctx, os.Stdout, f, result, opts, name, sender)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !same {
+			os.Exit(exitFindings)
+		}
+		return
+	}
+
+	switch {
+	case tree:
+		err = writeTree(os.Stdout, result)
+	case templateFile != "":
+		err = writeTemplate(os.Stdout, templateFile, result, opts)
+	default:
+		err = writeOutput(os.Stdout, format, result, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if summary {
+		if err := writeSummary(os.Stderr, result, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
 	}
+	if redundancy {
+		writeRedundancy(os.Stderr, result.Entries)
+	}
+}
+
+// Exit statuses of failed runs besides 1, telling errors of the published
+// records, which need fixing, from failures worth retrying later.
+const (
+	exitFindings  = 2
+	exitPermanent = 3
+	exitTemporary = 4
+	exitTakeover  = 5
+	// exitPropagation is the status of publish runs whose changes did not
+	// reach the resolvers of -propagation-resolver within
+	// -propagation-timeout.
+	exitPropagation = 6
+)
 
-	return record, nil
+// parseMaxPrefix parses the value of -max-prefix, which is made of the
+// optional IPv4 and IPv6 prefix lengths like the dual-cidr-length of SPF
+// mechanisms. Zero lengths stand for no limit.
+func parseMaxPrefix(value string) (cidr4, cidr6 int, ok bool) {
+	if value == "" {
+		return 0, 0, true
+	}
+	v4, v6, dual := strings.Cut(value, "//")
+	if v4 == "" && !dual {
+		return 0, 0, false
+	}
+	parse := func(s string, max int) (int, bool) {
+		if s == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 1 && n <= max
+	}
+	cidr4, ok4 := parse(v4, 32)
+	cidr6, ok6 := parse(v6, 128)
+	if dual && v6 == "" {
+		ok6 = false
+	}
+	return cidr4, cidr6, ok4 && ok6
 }
 
-func isValidIP(ip string, version int) bool {
-	if strings.Contains(ip, "/") {
-		ip = strings.Split(ip, "/")[0]
+// exitStatus returns the exit status for a run that failed with err.
+func exitStatus(err error) int {
+	switch {
+	case errors.Is(err, spfflatten.ErrUnregisteredDomain):
+		return exitTakeover
+	case errors.Is(err, spfflatten.ErrNoSPFRecord),
+		errors.Is(err, spfflatten.ErrMultipleSPFRecords),
+		errors.Is(err, spfflatten.ErrLookupLimitExceeded),
+		errors.Is(err, spfflatten.ErrLoopDetected):
+		return exitPermanent
+	case errors.Is(err, spfflatten.ErrDNSTemporary),
+		errors.Is(err, context.DeadlineExceeded):
+		return exitTemporary
 	}
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return false
+	return 1
+}
+
+// describeFlattenError returns the message of err, a failure to flatten,
+// along with the option that gets past it when there is one.
+func describeFlattenError(err error) string {
+	if errors.Is(err, spfflatten.ErrMacroDependent) {
+		return err.Error() + " (use -force to pass them through unchanged)"
 	}
-	if version == 4 {
-		return parsedIP.To4() != nil
+	return err.Error()
+}
+
+// printWarnings prints warnings to w, one per line.
+func printWarnings(w io.Writer, warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
 	}
-	return parsedIP.To4() == nil && strings.Contains(ip, ":")
 }
 
-func deduplicateIPs(ips []string) []string {
-	seen := make(map[string]bool)
-	var result []string
+// printPartial reports what was resolved before the run was interrupted.
+func printPartial(w io.Writer, result *spfflatten.Result) {
+	printWarnings(w, result.Warnings)
+	fmt.Fprintf(w, "Interrupted after %d DNS queries with %d entries resolved, include tree so far:\n", result.Queries, len(result.Entries))
+	writeTree(w, result)
+}
 
-	for _, ip := range ips {
-		if !seen[ip] {
-			seen[ip] = true
-			result = append(result, ip)
+// printSkipped warns about the skipped terms, grouped by the domain whose
+// record contained them.
+func printSkipped(f *spfflatten.Flattener, skipped []spfflatten.SkippedTerm) {
+	var domains []string
+	byDomain := make(map[string][]spfflatten.SkippedTerm)
+	for _, s := range skipped {
+		if _, ok := byDomain[s.Domain]; !ok {
+			domains = append(domains, s.Domain)
 		}
+		byDomain[s.Domain] = append(byDomain[s.Domain], s)
 	}
 
-	return result
+	for _, domain := range domains {
+		fmt.Fprintf(os.Stderr, "Warning: skipped terms in SPF record of %s, the output may be incomplete:\n", f.DisplayDomain(domain))
+		for _, s := range byDomain[domain] {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", s.Term, s.Reason)
+		}
+	}
 }
 
-func getDNSResolver() string {
+// getDNSResolvers returns the resolvers to use when -resolver is not given:
+// DNS_RESOLVER if set, otherwise the nameservers of the system
+// configuration, falling back to a local resolver.
+func getDNSResolvers() []string {
 	if resolver := os.Getenv("DNS_RESOLVER"); resolver != "" {
-		return resolver
+		return []string{resolver}
 	}
-	return "127.0.0.1:53"
+	return spfflatten.DefaultResolvers()
 }
 
 type stringSlice []string
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestParseMaxPrefix(t *testing.T) {
+	tests := []struct {
+		value        string
+		cidr4, cidr6 int
+		ok           bool
+	}{
+		{"", 0, 0, true},
+		{"16", 16, 0, true},
+		{"16//48", 16, 48, true},
+		{"//48", 0, 48, true},
+		{"1//1", 1, 1, true},
+		{"32//128", 32, 128, true},
+		{"0", 0, 0, false},
+		{"33", 0, 0, false},
+		{"16//0", 0, 0, false},
+		{"16//129", 0, 0, false},
+		{"16//", 0, 0, false},
+		{"//", 0, 0, false},
+		{"/16", 0, 0, false},
+		{"16/48", 0, 0, false},
+		{"x", 0, 0, false},
+		{"16//x", 0, 0, false},
+		{"-8", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cidr4, cidr6, ok := parseMaxPrefix(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("parseMaxPrefix() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && (cidr4 != tt.cidr4 || cidr6 != tt.cidr6) {
+				t.Errorf("parseMaxPrefix() = %d, %d, want %d, %d", cidr4, cidr6, tt.cidr4, tt.cidr6)
+			}
+		})
+	}
+}
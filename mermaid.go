@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatMermaid = "mermaid"
+
+// writeMermaid writes the include tree as a Mermaid flowchart that can be
+// embedded in Markdown. Domains are not valid Mermaid node identifiers, so
+// nodes are numbered in the order they are first seen and labelled with the
+// domain and the same counts as writeDOT.
+func writeMermaid(w io.Writer, result *spfflatten.Result) error {
+	fmt.Fprintln(w, "flowchart LR")
+
+	ids := make(map[string]string)
+	id := func(domain string) string {
+		if _, ok := ids[domain]; !ok {
+			ids[domain] = fmt.Sprintf("n%d", len(ids))
+		}
+		return ids[domain]
+	}
+
+	declared := make(map[string]bool)
+	var walk func(nodes []*spfflatten.Node)
+	walk = func(nodes []*spfflatten.Node) {
+		for _, node := range nodes {
+			if !node.Repeated && !declared[node.Domain] {
+				declared[node.Domain] = true
+				fmt.Fprintf(w, "  %s[\"%s<br/>%d lookups, %d ip4, %d ip6\"]\n", id(node.Domain), node.Domain, node.Lookups, node.IP4, node.IP6)
+			}
+			if node.Parent() != nil {
+				fmt.Fprintf(w, "  %s -->|%s| %s\n", id(node.Parent().Domain), node.Via, id(node.Domain))
+			}
+			walk(node.Children)
+		}
+	}
+	walk(result.Tree)
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatNDJSON = "ndjson"
+
+// streamNDJSON returns a function writing each entry it is given to w as a
+// line of JSON, skipping addresses already written and, when family is not
+// empty, entries of the other address family. It is called by the
+// flattener as entries are resolved, so output starts before the whole tree
+// has been traversed.
+func streamNDJSON(w io.Writer, family string) func(spfflatten.Entry) {
+	enc := json.NewEncoder(w)
+	seen := make(map[string]bool)
+	return func(entry spfflatten.Entry) {
+		if seen[entry.IP] || (family != "" && spfflatten.IsIPv4(entry.IP) != (family == familyIPv4)) {
+			return
+		}
+		seen[entry.IP] = true
+		enc.Encode(entry)
+	}
+}
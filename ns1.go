@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerNS1 = "ns1"
+
+func init() {
+	spfpublish.Register(providerNS1, newNS1)
+}
+
+// ns1Endpoint is the base URL of the NS1 API.
+const ns1Endpoint = "https://api.nsone.net/v1"
+
+// ns1 publishes records through the NS1 API, authenticating with an API key
+// from NS1_APIKEY or -credentials that is allowed to manage the records of
+// the zone.
+type ns1 struct {
+	spfpublish.Config
+	header http.Header
+}
+
+// ns1Record is a record of the NS1 API. Its answers are served through the
+// filter chain of the record, which selects among them by their metadata.
+type ns1Record struct {
+	Zone    string      `json:"zone,omitempty"`
+	Domain  string      `json:"domain,omitempty"`
+	Type    string      `json:"type,omitempty"`
+	TTL     int         `json:"ttl,omitempty"`
+	Answers []ns1Answer `json:"answers"`
+}
+
+// ns1Answer is an answer of an NS1 record, whose metadata and region are
+// carried over as they are when the record is updated.
+type ns1Answer struct {
+	ID     string          `json:"id,omitempty"`
+	Answer []string        `json:"answer"`
+	Meta   json.RawMessage `json:"meta,omitempty"`
+	Region string          `json:"region,omitempty"`
+}
+
+// newNS1 returns a publisher for the NS1 zone of config.
+func newNS1(config spfpublish.Config) (spfpublish.Publisher, error) {
+	key, err := readCredentials(config.Credentials, "NS1_APIKEY")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = ns1Endpoint
+	}
+	return &ns1{
+		Config: config,
+		header: http.Header{"X-Nsone-Key": {key}},
+	}, nil
+}
+
+// call sends a request for the TXT record of name in the zone.
+func (n *ns1) call(ctx context.Context, method, name string, in, out any) error {
+	endpoint := strings.TrimSuffix(n.Endpoint, "/") + "/zones/" + url.PathEscape(n.Zone) + "/" + url.PathEscape(name) + "/TXT"
+	err := doJSON(ctx, n.Client, method, endpoint, n.header, in, out)
+	// Failed requests come with a message describing the error
+	var apiErr *apiError
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if errors.As(err, &apiErr) && apiErr.Status != http.StatusNotFound && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && resp.Message != "" {
+		return errors.New(resp.Message)
+	}
+	return err
+}
+
+// record returns the TXT record of name, reporting whether it exists.
+func (n *ns1) record(ctx context.Context, name string) (ns1Record, bool, error) {
+	var existing ns1Record
+	err := n.call(ctx, http.MethodGet, name, nil, &existing)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return ns1Record{}, false, nil
+	}
+	return existing, err == nil, err
+}
+
+// Current returns the SPF answers of the TXT record of name.
+func (n *ns1) Current(ctx context.Context, name string) ([]string, error) {
+	existing, _, err := n.record(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, answer := range existing.Answers {
+		if value := strings.Join(answer.Answer, ""); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the answer of the TXT record of name holding an SPF
+// record, keeping its metadata so that the filter chain of the record keeps
+// selecting it, and removes the other SPF answers. The other answers and
+// the filter chain itself are left in place.
+func (n *ns1) Apply(ctx context.Context, name, value string) error {
+	existing, found, err := n.record(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// NS1 splits long TXT values into character-strings itself
+	var answers []ns1Answer
+	replaced := value == ""
+	for _, answer := range existing.Answers {
+		if !spf.IsRecord(strings.Join(answer.Answer, "")) {
+			answers = append(answers, answer)
+		} else if !replaced {
+			answer.Answer = []string{value}
+			answers = append(answers, answer)
+			replaced = true
+		}
+	}
+	if !replaced {
+		answers = append(answers, ns1Answer{Answer: []string{value}})
+	}
+
+	switch {
+	case !found && len(answers) > 0:
+		record := ns1Record{Zone: n.Zone, Domain: name, Type: "TXT", TTL: n.TTL, Answers: answers}
+		return n.call(ctx, http.MethodPut, name, record, nil)
+	case len(answers) > 0:
+		return n.call(ctx, http.MethodPost, name, ns1Record{TTL: n.TTL, Answers: answers}, nil)
+	case found:
+		return n.call(ctx, http.MethodDelete, name, nil, nil)
+	}
+	return nil
+}
+
+// Verify checks that the TXT record of name holds value, see verifySPF.
+func (n *ns1) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, n, name, value)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatNsupdate = "nsupdate"
+
+// writeNsupdate writes an nsupdate batch that replaces the SPF records
+// currently published on each record name with the generated ones. Only the
+// existing SPF values are deleted, leaving unrelated TXT records in place.
+func writeNsupdate(w io.Writer, records []PublishedRecord, opts spfflatten.FormatOptions) error {
+	zone := opts.Zone
+	if zone == "" {
+		zone = opts.Domain
+	}
+
+	fmt.Fprintf(w, "zone %s.\n", strings.TrimSuffix(zone, "."))
+	for _, record := range records {
+		name := strings.TrimSuffix(record.Name, ".")
+		existing, err := opts.LookupPublished(name)
+		if err != nil {
+			return fmt.Errorf("failed to look up the SPF record published on %s: %w", name, err)
+		}
+		for _, strs := range existing {
+			fmt.Fprintf(w, "update delete %s. TXT %s\n", name, quoteChunks(strs))
+		}
+		fmt.Fprintf(w, "update add %s. %d TXT %s\n", name, opts.TTL, quoteChunks(spf.Chunk(record.Value)))
+	}
+	fmt.Fprintln(w, "send")
+	return nil
+}
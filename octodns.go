@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatOctoDNS = "octodns"
+
+// writeOctoDNS writes the records as an octoDNS zone YAML fragment. octoDNS
+// splits values longer than 255 bytes into character-strings itself.
+func writeOctoDNS(w io.Writer, records []PublishedRecord, opts spfflatten.FormatOptions) error {
+	for _, record := range records {
+		label := relativeName(record.Name, opts.Domain)
+		if label == "@" {
+			label = ""
+		}
+		// octoDNS requires semicolons in TXT values to be escaped
+		value := strings.ReplaceAll(record.Value, ";", `\;`)
+		fmt.Fprintf(w, "%s:\n", yamlString(label))
+		fmt.Fprintf(w, "  type: TXT\n")
+		fmt.Fprintf(w, "  ttl: %d\n", opts.TTL)
+		fmt.Fprintf(w, "  value: %s\n", yamlString(value))
+	}
+	return nil
+}
+
+// yamlString quotes s as a single-quoted YAML scalar.
+func yamlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
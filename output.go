@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// Output modes selecting what is printed for a flattened result.
+const (
+	outputList   = "list"
+	outputRecord = "record"
+	outputSplit  = "split"
+)
+
+// recordFormats lists the output formats that publish records on -domain.
+var recordFormats = []string{formatTerraform, formatDNSControl, formatOctoDNS, formatNsupdate}
+
+// Register the built-in formats, in the order they are documented.
+func init() {
+	spfflatten.RegisterFormat(formatText, spfflatten.FormatterFunc(writeText))
+	spfflatten.RegisterFormat(formatJSON, spfflatten.FormatterFunc(writeJSON))
+	spfflatten.RegisterFormat(formatCSV, resultOnly(writeCSV))
+	spfflatten.RegisterFormat(formatTerraform, publishing(writeTerraform))
+	spfflatten.RegisterFormat(formatDNSControl, publishing(writeDNSControl))
+	spfflatten.RegisterFormat(formatOctoDNS, publishing(writeOctoDNS))
+	spfflatten.RegisterFormat(formatNsupdate, publishing(writeNsupdate))
+	spfflatten.RegisterFormat(formatDOT, resultOnly(writeDOT))
+	spfflatten.RegisterFormat(formatMermaid, resultOnly(writeMermaid))
+	spfflatten.RegisterFormat(formatNftables, spfflatten.FormatterFunc(writeNftables))
+	spfflatten.RegisterFormat(formatIpset, spfflatten.FormatterFunc(writeIpset))
+	spfflatten.RegisterFormat(formatPF, spfflatten.FormatterFunc(writePF))
+	spfflatten.RegisterFormat(formatHAProxy, resultOnly(writeHAProxy))
+	spfflatten.RegisterFormat(formatNginx, spfflatten.FormatterFunc(writeNginx))
+	spfflatten.RegisterFormat(formatPostfix, spfflatten.FormatterFunc(writePostfix))
+	spfflatten.RegisterFormat(formatExim, spfflatten.FormatterFunc(writeExim))
+	// The entries of ndjson are written by streamNDJSON during resolution.
+	spfflatten.RegisterFormat(formatNDJSON, resultOnly(func(io.Writer, *spfflatten.Result) error { return nil }))
+	spfflatten.RegisterFormat(formatProm, spfflatten.FormatterFunc(writeProm))
+	spfflatten.RegisterFormat(formatMarkdown, spfflatten.FormatterFunc(writeMarkdown))
+	spfflatten.RegisterFormat(formatHTML, spfflatten.FormatterFunc(writeHTML))
+}
+
+// resultOnly adapts a writer that takes no options to a Formatter.
+func resultOnly(write func(w io.Writer, result *spfflatten.Result) error) spfflatten.Formatter {
+	return spfflatten.FormatterFunc(func(w io.Writer, result *spfflatten.Result, _ spfflatten.FormatOptions) error {
+		return write(w, result)
+	})
+}
+
+// publishing adapts a writer of the records to publish on opts.Domain to a
+// Formatter.
+func publishing(write func(w io.Writer, records []PublishedRecord, opts spfflatten.FormatOptions) error) spfflatten.Formatter {
+	return spfflatten.FormatterFunc(func(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+		records, err := buildRecords(result, opts)
+		if err != nil {
+			return err
+		}
+		return write(w, records, opts)
+	})
+}
+
+// writeOutput writes result to w in the given registered format.
+func writeOutput(w io.Writer, format string, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	formatter, ok := spfflatten.LookupFormat(format)
+	if !ok {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return formatter.Format(w, result, opts)
+}
+
+// writeText writes result in the text format, as selected by opts.Output.
+func writeText(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	switch opts.Output {
+	case outputRecord:
+		record, err := generatedRecord(result, opts)
+		if err != nil {
+			return err
+		}
+		if chunks := spf.Chunk(record); len(chunks) > 1 {
+			fmt.Fprintln(w, quoteChunks(chunks))
+			printChunkSizes("record", chunks)
+		} else {
+			fmt.Fprintln(w, record)
+		}
+	case outputSplit:
+		records, err := splitRecords(result, opts)
+		if err != nil {
+			return err
+		}
+		printRecords(w, records)
+	default:
+		printList(w, result, opts)
+	}
+	return nil
+}
+
+// tagIP prefixes ip with its ip4 or ip6 mechanism name.
+func tagIP(ip string) string {
+	tag := "ip6"
+	if spfflatten.IsIPv4(ip) {
+		tag = "ip4"
+	}
+	return tag + ":" + ip
+}
+
+// Address families selected with -family.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// filterFamily returns the entries of the given address family.
+func filterFamily(entries []spfflatten.Entry, family string) []spfflatten.Entry {
+	var filtered []spfflatten.Entry
+	for _, entry := range entries {
+		if spfflatten.IsIPv4(entry.IP) == (family == familyIPv4) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// Orders of the entries selected with -sort.
+const (
+	sortDiscovery = "discovery"
+	sortNumeric   = "numeric"
+)
+
+// sortNumerically orders entries with IPv4 before IPv6, then by address and
+// prefix length, so that output is stable between runs regardless of the
+// order records are resolved in.
+func sortNumerically(entries []spfflatten.Entry) {
+	slices.SortStableFunc(entries, func(a, b spfflatten.Entry) int {
+		pa, pb := a.Prefix(), b.Prefix()
+		if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(pa.Bits(), pb.Bits())
+	})
+}
+
+// allTerm returns the all mechanism that ends the output, if any.
+func allTerm(result *spfflatten.Result, opts spfflatten.FormatOptions) string {
+	if opts.All != "" {
+		return opts.All
+	}
+	return result.All
+}
+
+// printList prints the flattened addresses one per line, followed by the
+// passed-through mechanisms and the requested all mechanism and modifiers.
+func printList(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) {
+	for _, entry := range result.Entries {
+		ip := entry.IP
+		if opts.Tags {
+			ip = tagIP(ip)
+		}
+		if opts.Annotate {
+			ip += " " + annotation(entry)
+		}
+		fmt.Fprintln(w, ip)
+	}
+
+	for _, term := range result.Terms {
+		fmt.Fprintln(w, term)
+	}
+
+	if all := allTerm(result, opts); all != "" && (opts.Tags || opts.All != "") {
+		fmt.Fprintln(w, all)
+	}
+
+	if opts.KeepModifiers {
+		for _, modifier := range result.Modifiers {
+			fmt.Fprintln(w, modifier)
+		}
+	}
+}
+
+// annotation returns a comment tracing entry back to its origin, such as
+// "# via include:example.com -> _spf.provider.test (mx)".
+func annotation(entry spfflatten.Entry) string {
+	if len(entry.Path) == 0 {
+		return "# via -" + entry.Mechanism
+	}
+	comment := "# via include:" + strings.Join(entry.Path, " -> ")
+	if entry.Mechanism != "ip4" && entry.Mechanism != "ip6" {
+		comment += " (" + entry.Mechanism + ")"
+	}
+	return comment
+}
+
+// recordTerms returns the terms of the flattened record in a deterministic
+// order: ip4 mechanisms, ip6 mechanisms, passed-through mechanisms, the all
+// mechanism, and finally the modifiers.
+func recordTerms(result *spfflatten.Result, opts spfflatten.FormatOptions) []string {
+	return append(addressTerms(result), trailingTerms(result, opts)...)
+}
+
+// addressTerms returns the ip4 mechanisms followed by the ip6 mechanisms.
+func addressTerms(result *spfflatten.Result) []string {
+	var ip4Terms, ip6Terms []string
+	for _, ip := range result.IPs() {
+		term := tagIP(ip)
+		if strings.HasPrefix(term, "ip4:") {
+			ip4Terms = append(ip4Terms, term)
+		} else {
+			ip6Terms = append(ip6Terms, term)
+		}
+	}
+	return append(ip4Terms, ip6Terms...)
+}
+
+// trailingTerms returns the terms following the addresses: passed-through
+// mechanisms, the all mechanism and the modifiers.
+func trailingTerms(result *spfflatten.Result, opts spfflatten.FormatOptions) []string {
+	terms := append([]string{}, result.Terms...)
+	if all := allTerm(result, opts); all != "" {
+		terms = append(terms, all)
+	}
+	if opts.KeepModifiers {
+		terms = append(terms, result.Modifiers...)
+	}
+	return terms
+}
+
+// validateRecord checks the record generated from result against the
+// grammar of RFC 7208, reporting every invalid term at once, and then
+// checks that it can be assembled, which fails on a second all mechanism
+// or an all mechanism along with redirect=.
+func validateRecord(result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	if err := spf.Validate(strings.Join(append([]string{"v=spf1"}, recordTerms(result, opts)...), " ")); err != nil {
+		return err
+	}
+	_, err := generatedRecord(result, opts)
+	return err
+}
+
+// generatedRecord returns the record generated from result.
+func generatedRecord(result *spfflatten.Result, opts spfflatten.FormatOptions) (string, error) {
+	return formatRecord(recordTerms(result, opts))
+}
+
+// formatRecord assembles terms into a complete SPF record, keeping the all
+// mechanism after the other mechanisms and the modifiers last. It fails on
+// the first term that cannot be added rather than leave it out.
+func formatRecord(terms []string) (string, error) {
+	var b spf.Builder
+	return b.Add(terms...).Record()
+}
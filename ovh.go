@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerOVH = "ovh"
+
+func init() {
+	spfpublish.Register(providerOVH, newOVH)
+}
+
+// ovhEndpoints maps the names of the OVHcloud API endpoints to their base
+// URL.
+var ovhEndpoints = map[string]string{
+	"ovh-eu": "https://eu.api.ovh.com/1.0",
+	"ovh-ca": "https://ca.api.ovh.com/1.0",
+	"ovh-us": "https://api.us.ovhcloud.com/1.0",
+}
+
+// ovhCredentials are the keys of an OVHcloud API application, with the
+// consumer key it was granted access to the zone with.
+type ovhCredentials struct {
+	Endpoint          string
+	ApplicationKey    string
+	ApplicationSecret string
+	ConsumerKey       string
+}
+
+// ovh publishes records through the OVHcloud API, signing requests with the
+// application and consumer keys of OVH_APPLICATION_KEY,
+// OVH_APPLICATION_SECRET and OVH_CONSUMER_KEY, or of the ovh.conf file
+// given by -credentials. The zone is refreshed after each change so that
+// its nameservers serve it.
+type ovh struct {
+	spfpublish.Config
+	credentials ovhCredentials
+	// offset is the difference between the clocks of the API and of the
+	// host, which requests are timestamped with.
+	offset time.Duration
+	synced bool
+}
+
+// ovhRecord is a record of a DNS zone of the OVHcloud API, whose name is
+// relative to the zone, empty for the zone itself.
+type ovhRecord struct {
+	ID        int    `json:"id,omitempty"`
+	FieldType string `json:"fieldType,omitempty"`
+	SubDomain string `json:"subDomain"`
+	Target    string `json:"target"`
+	TTL       int    `json:"ttl"`
+}
+
+// newOVH returns a publisher for the OVHcloud DNS zone of config.
+func newOVH(config spfpublish.Config) (spfpublish.Publisher, error) {
+	credentials, err := loadOVHCredentials(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = credentials.Endpoint
+		if endpoint, ok := ovhEndpoints[credentials.Endpoint]; ok {
+			config.Endpoint = endpoint
+		}
+	}
+	if !strings.HasPrefix(config.Endpoint, "https://") && !strings.HasPrefix(config.Endpoint, "http://") {
+		return nil, fmt.Errorf("unknown OVHcloud API endpoint %q", credentials.Endpoint)
+	}
+	return &ovh{Config: config, credentials: credentials}, nil
+}
+
+// loadOVHCredentials returns the credentials of the environment, or of the
+// ovh.conf file when not empty. The endpoint is OVH_ENDPOINT, or the one of
+// the default section of the file, defaulting to ovh-eu.
+func loadOVHCredentials(file string) (ovhCredentials, error) {
+	credentials := ovhCredentials{
+		Endpoint:          os.Getenv("OVH_ENDPOINT"),
+		ApplicationKey:    os.Getenv("OVH_APPLICATION_KEY"),
+		ApplicationSecret: os.Getenv("OVH_APPLICATION_SECRET"),
+		ConsumerKey:       os.Getenv("OVH_CONSUMER_KEY"),
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return ovhCredentials{}, err
+		}
+		defer f.Close()
+		sections := map[string]map[string]string{}
+		section := ""
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			if sections[section] == nil {
+				sections[section] = map[string]string{}
+			}
+			sections[section][strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		if err := scanner.Err(); err != nil {
+			return ovhCredentials{}, err
+		}
+		if credentials.Endpoint == "" {
+			credentials.Endpoint = sections["default"]["endpoint"]
+		}
+		if credentials.Endpoint == "" {
+			credentials.Endpoint = "ovh-eu"
+		}
+		keys := sections[credentials.Endpoint]
+		credentials.ApplicationKey = keys["application_key"]
+		credentials.ApplicationSecret = keys["application_secret"]
+		credentials.ConsumerKey = keys["consumer_key"]
+		if credentials.ApplicationKey == "" || credentials.ApplicationSecret == "" || credentials.ConsumerKey == "" {
+			return ovhCredentials{}, fmt.Errorf("no application_key, application_secret or consumer_key for endpoint %s in %s", credentials.Endpoint, file)
+		}
+		return credentials, nil
+	}
+	if credentials.ApplicationKey == "" || credentials.ApplicationSecret == "" || credentials.ConsumerKey == "" {
+		return ovhCredentials{}, errors.New("no credentials: set OVH_APPLICATION_KEY, OVH_APPLICATION_SECRET and OVH_CONSUMER_KEY or pass -credentials")
+	}
+	if credentials.Endpoint == "" {
+		credentials.Endpoint = "ovh-eu"
+	}
+	return credentials, nil
+}
+
+// call sends a request to the API path signed with the application secret
+// and consumer key.
+func (o *ovh) call(ctx context.Context, method, path string, in, out any) error {
+	endpoint := strings.TrimSuffix(o.Endpoint, "/")
+	if !o.synced {
+		// Requests are refused when their timestamp is off by more than a
+		// few minutes
+		var now int64
+		if err := doJSON(ctx, o.Client, http.MethodGet, endpoint+"/auth/time", nil, nil, &now); err != nil {
+			return fmt.Errorf("failed to get the time of the API: %w", err)
+		}
+		o.offset, o.synced = time.Until(time.Unix(now, 0)), true
+	}
+
+	// The body is signed as sent, so it is encoded here rather than by
+	// doJSON, which sends json.RawMessage as is
+	var body []byte
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, in = data, json.RawMessage(data)
+	}
+	timestamp := strconv.FormatInt(time.Now().Add(o.offset).Unix(), 10)
+	signature := sha1.Sum([]byte(strings.Join([]string{
+		o.credentials.ApplicationSecret, o.credentials.ConsumerKey, method, endpoint + path, string(body), timestamp,
+	}, "+")))
+	header := http.Header{
+		"X-Ovh-Application": {o.credentials.ApplicationKey},
+		"X-Ovh-Consumer":    {o.credentials.ConsumerKey},
+		"X-Ovh-Timestamp":   {timestamp},
+		"X-Ovh-Signature":   {"$1$" + hex.EncodeToString(signature[:])},
+	}
+	err := doJSON(ctx, o.Client, method, endpoint+path, header, in, out)
+	// Failed requests come with a message describing the error
+	var apiErr *apiError
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && resp.Message != "" {
+		return errors.New(resp.Message)
+	}
+	return err
+}
+
+// spfRecords returns the SPF records of name, which are listed by ID and
+// then read one by one.
+func (o *ovh) spfRecords(ctx context.Context, name string) ([]ovhRecord, error) {
+	zone := "/domain/zone/" + url.PathEscape(o.Zone)
+	label := ovhLabel(name, o.Zone)
+	var ids []int
+	query := url.Values{"fieldType": {"TXT"}, "subDomain": {label}}
+	if err := o.call(ctx, http.MethodGet, zone+"/record?"+query.Encode(), nil, &ids); err != nil {
+		return nil, err
+	}
+	var records []ovhRecord
+	for _, id := range ids {
+		var record ovhRecord
+		if err := o.call(ctx, http.MethodGet, zone+"/record/"+strconv.Itoa(id), nil, &record); err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(record.SubDomain, label) && spf.IsRecord(unquoteTXT(record.Target)) {
+			record.ID = id
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// ovhLabel returns the subdomain of name in the zone, which is empty for
+// the zone itself.
+func ovhLabel(name, zone string) string {
+	label := relativeName(name, zone)
+	if label == "@" {
+		return ""
+	}
+	return label
+}
+
+// Current returns the SPF records of name.
+func (o *ovh) Current(ctx context.Context, name string) ([]string, error) {
+	records, err := o.spfRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range records {
+		values = append(values, unquoteTXT(record.Target))
+	}
+	return values, nil
+}
+
+// Apply updates the SPF record of name in place when there is one, creating
+// it otherwise, and deletes any other SPF record of name, then refreshes
+// the zone to apply the changes.
+func (o *ovh) Apply(ctx context.Context, name, value string) error {
+	records, err := o.spfRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// The first SPF record is updated and the others deleted, all of them
+	// when there is no value.
+	zone := "/domain/zone/" + url.PathEscape(o.Zone)
+	label := ovhLabel(name, o.Zone)
+	changed := false
+	replaced := value == ""
+	for _, record := range records {
+		path := zone + "/record/" + strconv.Itoa(record.ID)
+		if replaced {
+			if err := o.call(ctx, http.MethodDelete, path, nil, nil); err != nil {
+				return err
+			}
+			changed = true
+			continue
+		}
+		update := ovhRecord{SubDomain: label, Target: quoteChunks(spf.Chunk(value)), TTL: o.TTL}
+		if err := o.call(ctx, http.MethodPut, path, update, nil); err != nil {
+			return err
+		}
+		changed, replaced = true, true
+	}
+	if !replaced {
+		record := ovhRecord{FieldType: "TXT", SubDomain: label, Target: quoteChunks(spf.Chunk(value)), TTL: o.TTL}
+		if err := o.call(ctx, http.MethodPost, zone+"/record", record, nil); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return o.call(ctx, http.MethodPost, zone+"/refresh", nil, nil)
+}
+
+// Verify checks that name holds value, see verifySPF.
+func (o *ovh) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, o, name, value)
+}
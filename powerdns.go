@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerPowerDNS = "powerdns"
+
+func init() {
+	spfpublish.Register(providerPowerDNS, newPowerDNS)
+}
+
+// powerDNS publishes records through the HTTP API of a PowerDNS
+// Authoritative Server, whose webserver URL is given by -endpoint,
+// authenticating with the API key from PDNS_API_KEY or -credentials.
+type powerDNS struct {
+	spfpublish.Config
+	header http.Header
+}
+
+// powerDNSRecordSet is an RRset of the PowerDNS API, whose TXT contents are
+// in zone file presentation format.
+type powerDNSRecordSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int              `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype,omitempty"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+// powerDNSRecord is a record of a PowerDNS RRset.
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// newPowerDNS returns a publisher for the PowerDNS zone of config.
+func newPowerDNS(config spfpublish.Config) (spfpublish.Publisher, error) {
+	key, err := readCredentials(config.Credentials, "PDNS_API_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		return nil, errors.New("no endpoint: pass -endpoint with the URL of the PowerDNS webserver, such as http://127.0.0.1:8081")
+	}
+	return &powerDNS{
+		Config: config,
+		header: http.Header{"X-Api-Key": {key}},
+	}, nil
+}
+
+// call sends a request for the zone to the API path, such as a query.
+func (p *powerDNS) call(ctx context.Context, method, path string, in, out any) error {
+	endpoint := strings.TrimSuffix(p.Endpoint, "/") + "/api/v1/servers/localhost/zones/" + url.PathEscape(p.Zone+".") + path
+	err := doJSON(ctx, p.Client, method, endpoint, p.header, in, out)
+	// Failed requests come with a message describing the error
+	var apiErr *apiError
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if errors.As(err, &apiErr) && json.Unmarshal([]byte(apiErr.Body), &resp) == nil && resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return err
+}
+
+// recordSet returns the TXT RRset of name, reporting whether it exists.
+func (p *powerDNS) recordSet(ctx context.Context, name string) (powerDNSRecordSet, bool, error) {
+	var zone struct {
+		RRSets []powerDNSRecordSet `json:"rrsets"`
+	}
+	query := url.Values{"rrset_name": {name + "."}, "rrset_type": {"TXT"}}
+	if err := p.call(ctx, http.MethodGet, "?"+query.Encode(), nil, &zone); err != nil {
+		return powerDNSRecordSet{}, false, err
+	}
+	// Servers before 4.8 ignore the filter and return every RRset
+	for _, existing := range zone.RRSets {
+		if existing.Type == "TXT" && strings.EqualFold(existing.Name, name+".") {
+			return existing, true, nil
+		}
+	}
+	return powerDNSRecordSet{}, false, nil
+}
+
+// Current returns the SPF records of the TXT RRset of name that are not
+// disabled, which the server does not serve.
+func (p *powerDNS) Current(ctx context.Context, name string) ([]string, error) {
+	existing, _, err := p.recordSet(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing.Records {
+		if value := unquoteTXT(record.Content); !record.Disabled && spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT RRset of name in a single patch of the zone,
+// keeping its records other than SPF records, disabled or not.
+func (p *powerDNS) Apply(ctx context.Context, name, value string) error {
+	existing, found, err := p.recordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+	set := powerDNSRecordSet{Name: name + ".", Type: "TXT", TTL: p.TTL, ChangeType: "REPLACE"}
+	set.Records = slices.DeleteFunc(existing.Records, func(record powerDNSRecord) bool {
+		return spf.IsRecord(unquoteTXT(record.Content))
+	})
+	if value != "" {
+		set.Records = append(set.Records, powerDNSRecord{Content: quoteChunks(spf.Chunk(value))})
+	}
+	if len(set.Records) == 0 {
+		if !found {
+			return nil
+		}
+		set.ChangeType, set.TTL = "DELETE", 0
+	}
+	return p.call(ctx, http.MethodPatch, "", map[string]any{"rrsets": []powerDNSRecordSet{set}}, nil)
+}
+
+// Verify checks that the TXT RRset of name holds value, see verifySPF.
+func (p *powerDNS) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, p, name, value)
+}
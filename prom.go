@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatProm = "prom"
+
+// writeProm writes metrics about the flattened result in the Prometheus
+// text exposition format, for the node_exporter textfile collector to
+// report the health of scheduled runs.
+func writeProm(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	ip4, ip6 := splitFamilies(result)
+	metric := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	}
+
+	metric("spf_flatten_entries", "Number of entries in the flattened record.")
+	fmt.Fprintf(w, "spf_flatten_entries{family=%q} %d\n", familyIPv4, len(ip4))
+	fmt.Fprintf(w, "spf_flatten_entries{family=%q} %d\n", familyIPv6, len(ip6))
+	metric("spf_flatten_record_bytes", "Length of the flattened record in bytes.")
+	fmt.Fprintf(w, "spf_flatten_record_bytes %d\n", len(record))
+	metric("spf_flatten_lookups", "DNS lookups the flattened record consumes.")
+	fmt.Fprintf(w, "spf_flatten_lookups %d\n", result.Lookups)
+	metric("spf_flatten_original_lookups", "DNS lookups the original records consume.")
+	fmt.Fprintf(w, "spf_flatten_original_lookups %d\n", originalLookups(result.Tree))
+	metric("spf_flatten_dns_queries", "DNS queries performed while flattening.")
+	fmt.Fprintf(w, "spf_flatten_dns_queries %d\n", result.Queries)
+	metric("spf_flatten_warnings", "Warnings reported while flattening.")
+	fmt.Fprintf(w, "spf_flatten_warnings %d\n", len(result.Warnings))
+	metric("spf_flatten_last_success_timestamp_seconds", "Unix time of the last successful flattening.")
+	fmt.Fprintf(w, "spf_flatten_last_success_timestamp_seconds %d\n", time.Now().Unix())
+	return nil
+}
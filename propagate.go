@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// propagationResolvers are the public resolvers the publish command waits
+// for the changes to reach, unless -propagation-resolver is given.
+var propagationResolvers = []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53", "208.67.222.222:53"}
+
+// propagationInterval is the time between the queries of a resolver that
+// does not return the changes yet.
+const propagationInterval = 10 * time.Second
+
+// waitPropagation queries each resolver of config for the names of changes
+// until it returns the records written, or timeout elapses, writing when
+// each resolver returns all of them and, on timeout, what the others still
+// return. The answers are not cached between queries, though resolvers
+// keep returning the records they cached until their TTL expires. It
+// reports whether every resolver returned the changes.
+func waitPropagation(ctx context.Context, w io.Writer, config spfflatten.Options, changes []publishChange, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	fmt.Fprintf(w, "\nWaiting up to %s for the changes to reach %s\n", timeout, strings.Join(config.Resolvers, ", "))
+
+	// pending holds the changes each resolver does not return yet, in
+	// order, and answers what it returned for the first of them.
+	start := time.Now()
+	pending := make(map[string][]publishChange, len(config.Resolvers))
+	answers := make(map[string]string, len(config.Resolvers))
+	for _, resolver := range config.Resolvers {
+		pending[resolver] = changes
+	}
+	for {
+		for _, resolver := range config.Resolvers {
+			remaining, ok := pending[resolver]
+			if !ok {
+				continue
+			}
+			options := config
+			options.Resolvers = []string{resolver}
+			options.Authoritative = false
+			options.Cache = nil
+			f := spfflatten.New(options)
+			for len(remaining) > 0 {
+				ok, answer := propagated(ctx, f, remaining[0])
+				if !ok {
+					// Queries cut short by the timeout tell nothing
+					if ctx.Err() == nil {
+						answers[resolver] = answer
+					}
+					break
+				}
+				remaining = remaining[1:]
+			}
+			if len(remaining) == 0 {
+				delete(pending, resolver)
+				fmt.Fprintf(w, "%s: propagated after %s\n", resolver, time.Since(start).Round(time.Second))
+				continue
+			}
+			pending[resolver] = remaining
+		}
+		if len(pending) == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, resolver := range config.Resolvers {
+				if remaining, ok := pending[resolver]; ok {
+					fmt.Fprintf(w, "%s: %s not propagated after %s, %s\n", resolver, remaining[0].Name, time.Since(start).Round(time.Second), answers[resolver])
+				}
+			}
+			return false
+		case <-time.After(propagationInterval):
+		}
+	}
+}
+
+// propagated reports whether f returns the record written by c, which is
+// none when c removed it, describing what it returned otherwise.
+func propagated(ctx context.Context, f *spfflatten.Flattener, c publishChange) (bool, string) {
+	published, err := f.LookupPublished(ctx, c.Name)
+	if err != nil {
+		return false, err.Error()
+	}
+	values := make([]string, len(published))
+	for i, strs := range published {
+		values[i] = strings.Join(strs, "")
+	}
+	switch {
+	case len(values) == 0 && c.Value == "", len(values) == 1 && values[0] == c.Value:
+		return true, ""
+	case len(values) == 0:
+		return false, "no SPF record returned"
+	}
+	for i, value := range values {
+		values[i] = strconv.Quote(value)
+	}
+	return false, "still returned " + strings.Join(values, " and ")
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+// commandPublish is the command updating the records of -domain through the
+// API of the DNS provider of -provider instead of printing them.
+const commandPublish = "publish"
+
+// publishChange is a change of the SPF record published on a name.
+type publishChange struct {
+	Name string
+	// Published holds the SPF records currently published on the name.
+	Published []string
+	// Value is the record to publish, empty to remove the published ones.
+	Value string
+}
+
+// planChanges returns the changes needed to publish the records generated
+// from result with p, from the records p currently holds. The included
+// records of -output split are published before the root record
+// referencing them, and the records of an earlier split that are no longer
+// referenced are removed after it. Names whose single current record has
+// the same terms as the generated one are left alone.
+func planChanges(ctx context.Context, p spfpublish.Publisher, result *spfflatten.Result, opts spfflatten.FormatOptions) ([]publishChange, error) {
+	records, err := buildRecords(result, opts)
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(name string) ([]string, error) {
+		current, err := p.Current(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the SPF record of %s: %w", name, err)
+		}
+		return current, nil
+	}
+	stale, err := staleRecords(records, opts, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []publishChange
+	for _, record := range slices.Backward(records) {
+		name := strings.TrimSuffix(record.Name, ".")
+		published, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(published) == 1 {
+			if removed, added := diffTerms(published[0], record.Value); len(removed) == 0 && len(added) == 0 {
+				continue
+			}
+		}
+		changes = append(changes, publishChange{Name: name, Published: published, Value: record.Value})
+	}
+	for _, name := range stale {
+		published, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(published) == 0 {
+			continue
+		}
+		changes = append(changes, publishChange{Name: name, Published: published})
+	}
+	return changes, nil
+}
+
+// ANSI escape sequences coloring the plan.
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// writePlan writes changes in the manner of a Terraform plan: the records
+// currently published on each name and the one that would be written, with
+// the terms that differ between them, colored when color is set.
+func writePlan(w io.Writer, changes []publishChange, color bool) {
+	line := func(code, format string, args ...any) {
+		if color {
+			format = code + format + colorReset
+		}
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes: the published records match the flattened result")
+		return
+	}
+
+	var add, change, remove int
+	for _, c := range changes {
+		switch {
+		case c.Value == "":
+			remove++
+			line(colorRed, "- %s", c.Name)
+		case len(c.Published) == 0:
+			add++
+			line(colorGreen, "+ %s", c.Name)
+		default:
+			change++
+			line(colorYellow, "~ %s", c.Name)
+		}
+		for _, value := range c.Published {
+			line(colorRed, "    - %s", value)
+		}
+		if c.Value != "" {
+			line(colorGreen, "    + %s", c.Value)
+		}
+		if len(c.Published) != 1 || c.Value == "" {
+			continue
+		}
+		removed, added := diffTerms(c.Published[0], c.Value)
+		for _, term := range removed {
+			line(colorRed, "        - %s", term)
+		}
+		for _, term := range added {
+			line(colorGreen, "        + %s", term)
+		}
+	}
+	fmt.Fprintf(w, "\nPlan: %d to add, %d to change, %d to remove\n", add, change, remove)
+}
+
+// applyChanges makes changes with p, in order, writing each name once its
+// change is made and verified, so that records referencing a name are only
+// published once p holds it.
+func applyChanges(ctx context.Context, w io.Writer, p spfpublish.Publisher, changes []publishChange) error {
+	for _, c := range changes {
+		if err := p.Apply(ctx, c.Name, c.Value); err != nil {
+			if c.Value == "" {
+				return fmt.Errorf("failed to remove the SPF record of %s: %w", c.Name, err)
+			}
+			return fmt.Errorf("failed to publish the SPF record of %s: %w", c.Name, err)
+		}
+		if err := p.Verify(ctx, c.Name, c.Value); err != nil {
+			return fmt.Errorf("failed to verify the SPF record of %s: %w", c.Name, err)
+		}
+		if c.Value == "" {
+			fmt.Fprintf(w, "%s: removed\n", c.Name)
+		} else {
+			fmt.Fprintf(w, "%s: published\n", c.Name)
+		}
+	}
+	return nil
+}
+
+// confirmApply asks on the terminal whether to apply the plan, reporting
+// whether the answer was yes.
+func confirmApply(w io.Writer, r io.Reader) bool {
+	fmt.Fprint(w, "\nApply these changes? Only 'yes' will be accepted: ")
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// The null device, which cron and services read from, is a character
+	// device too
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// staleRecords returns the names of the included records left over from an
+// earlier run of -output split that are not among records: those that the
+// root record currently held for the domain, as returned by lookup,
+// includes and whose names follow the split template. Other records that
+// happen to be published on names of the template, such as those of
+// another tool, are left alone.
+func staleRecords(records []PublishedRecord, opts spfflatten.FormatOptions, lookup func(name string) ([]string, error)) ([]string, error) {
+	domain := strings.TrimSuffix(opts.Domain, ".")
+	published, err := lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+	template := regexp.MustCompile("(?i)^" + strings.Replace(regexp.QuoteMeta(opts.SplitTemplate), "%d", "[1-9][0-9]*", 1) + `\.` + regexp.QuoteMeta(domain) + "$")
+
+	var stale []string
+	for _, value := range published {
+		root, err := spf.Parse(value)
+		if err != nil {
+			continue
+		}
+		for _, term := range root.Terms {
+			m, ok := term.(*spf.Mechanism)
+			if !ok || m.Name != "include" {
+				continue
+			}
+			name := strings.TrimSuffix(m.Domain.Raw, ".")
+			kept := slices.ContainsFunc(records, func(r PublishedRecord) bool {
+				return strings.EqualFold(strings.TrimSuffix(r.Name, "."), name)
+			})
+			seen := slices.ContainsFunc(stale, func(s string) bool { return strings.EqualFold(s, name) })
+			if template.MatchString(name) && !kept && !seen {
+				stale = append(stale, name)
+			}
+		}
+	}
+	return stale, nil
+}
+
+// verifySPF checks that the SPF records p currently holds for name are the
+// single record of value, or none when value is empty, as the built-in
+// publishers verify their changes.
+func verifySPF(ctx context.Context, p spfpublish.Publisher, name, value string) error {
+	current, err := p.Current(ctx, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(current) == 0 && value == "", len(current) == 1 && current[0] == value:
+		return nil
+	case len(current) == 0:
+		return errors.New("the provider holds no SPF record")
+	}
+	quoted := make([]string, len(current))
+	for i, value := range current {
+		quoted[i] = strconv.Quote(value)
+	}
+	return fmt.Errorf("the provider holds %s", strings.Join(quoted, " and "))
+}
+
+// unquoteTXT returns the value of a TXT record given in zone file
+// presentation format, such as "v=spf1 " "-all", concatenating its
+// character-strings. Values that are not quoted are returned as is.
+func unquoteTXT(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, `"`) {
+		return content
+	}
+	var b strings.Builder
+	quoted, escaped := false, false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case escaped:
+			b.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readCredentials returns the content of file, or the value of the
+// environment variable env when file is empty, failing when neither is set.
+func readCredentials(file, env string) (string, error) {
+	if file == "" {
+		if value := os.Getenv(env); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("no credentials: set %s or pass -credentials", env)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// requestToken posts an OAuth 2.0 token request and returns the access
+// token of the response.
+func requestToken(ctx context.Context, client *http.Client, tokenURL string, form url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain an access token: %w", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to obtain an access token: %s", http.StatusText(resp.StatusCode))
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("failed to obtain an access token: %s %s", token.Error, token.ErrorDescription)
+	}
+	return token.AccessToken, nil
+}
+
+// apiError is a response of an API with a status other than 2xx.
+type apiError struct {
+	Status int
+	Body   string
+}
+
+// Error returns the status of the response along with its body.
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.Status), strings.TrimSpace(e.Body))
+}
+
+// doJSON sends a request to a JSON API with in encoded as its body, unless
+// it is nil, and decodes the response into out, unless it is nil. Responses
+// with a status other than 2xx are returned as an *apiError.
+func doJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{Status: resp.StatusCode, Body: string(data)}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// fakePublisher is a spfpublish.Publisher holding the SPF records of each
+// name in memory.
+type fakePublisher struct {
+	records map[string][]string
+}
+
+// Current returns the records held for name.
+func (p *fakePublisher) Current(ctx context.Context, name string) ([]string, error) {
+	return p.records[name], nil
+}
+
+// Apply replaces the records held for name with value.
+func (p *fakePublisher) Apply(ctx context.Context, name, value string) error {
+	if value == "" {
+		delete(p.records, name)
+	} else {
+		p.records[name] = []string{value}
+	}
+	return nil
+}
+
+// Verify checks the records held for name with verifySPF.
+func (p *fakePublisher) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, p, name, value)
+}
+
+// The records the tests split six networks into with splitOptions.
+const (
+	splitRoot   = "v=spf1 include:spf1.example.com include:spf2.example.com -all"
+	splitFirst  = "v=spf1 ip4:10.1.0.0/16 ip4:10.2.0.0/16 ip4:10.3.0.0/16 ip4:10.4.0.0/16"
+	splitSecond = "v=spf1 ip4:10.5.0.0/16 ip4:10.6.0.0/16"
+)
+
+// splitResult returns a result of six networks, which splitOptions splits
+// into two included records.
+func splitResult() *spfflatten.Result {
+	result := &spfflatten.Result{}
+	for _, ip := range []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16", "10.4.0.0/16", "10.5.0.0/16", "10.6.0.0/16"} {
+		result.Entries = append(result.Entries, spfflatten.Entry{IP: ip, Qualifier: "+", Mechanism: "ip4"})
+	}
+	return result
+}
+
+// splitOptions are the options of -output split on example.com.
+var splitOptions = spfflatten.FormatOptions{
+	Output:        outputSplit,
+	Domain:        "example.com",
+	SplitTemplate: "spf%d",
+	SplitSize:     80,
+	All:           "-all",
+	LookupBudget:  spfflatten.MaxLookups,
+}
+
+func TestPlanChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		published map[string][]string
+		want      []publishChange
+	}{
+		{
+			name:      "nothing published",
+			published: map[string][]string{},
+			// The included records are published before the root record.
+			want: []publishChange{
+				{Name: "spf2.example.com", Value: splitSecond},
+				{Name: "spf1.example.com", Value: splitFirst},
+				{Name: "example.com", Value: splitRoot},
+			},
+		},
+		{
+			name: "up to date",
+			published: map[string][]string{
+				"example.com":      {splitRoot},
+				"spf1.example.com": {splitFirst},
+				"spf2.example.com": {splitSecond},
+			},
+		},
+		{
+			name: "reordered terms",
+			published: map[string][]string{
+				"example.com":      {"v=spf1 include:spf2.example.com include:spf1.example.com -all"},
+				"spf1.example.com": {"v=spf1 ip4:10.4.0.0/16 ip4:10.3.0.0/16 ip4:10.2.0.0/16 ip4:10.1.0.0/16"},
+				"spf2.example.com": {splitSecond},
+			},
+		},
+		{
+			name: "changed included record",
+			published: map[string][]string{
+				"example.com":      {splitRoot},
+				"spf1.example.com": {splitFirst},
+				"spf2.example.com": {"v=spf1 ip4:10.5.0.0/16"},
+			},
+			want: []publishChange{
+				{Name: "spf2.example.com", Published: []string{"v=spf1 ip4:10.5.0.0/16"}, Value: splitSecond},
+			},
+		},
+		{
+			name: "several records on the root",
+			published: map[string][]string{
+				"example.com":      {splitRoot, "v=spf1 -all"},
+				"spf1.example.com": {splitFirst},
+				"spf2.example.com": {splitSecond},
+			},
+			want: []publishChange{
+				{Name: "example.com", Published: []string{splitRoot, "v=spf1 -all"}, Value: splitRoot},
+			},
+		},
+		{
+			name: "stale split",
+			published: map[string][]string{
+				"example.com":      {"v=spf1 include:spf1.example.com include:spf2.example.com include:spf3.example.com -all"},
+				"spf1.example.com": {splitFirst},
+				"spf2.example.com": {splitSecond},
+				"spf3.example.com": {"v=spf1 ip4:10.7.0.0/16"},
+			},
+			// The stale record is removed once the root no longer includes it.
+			want: []publishChange{
+				{Name: "example.com", Published: []string{"v=spf1 include:spf1.example.com include:spf2.example.com include:spf3.example.com -all"}, Value: splitRoot},
+				{Name: "spf3.example.com", Published: []string{"v=spf1 ip4:10.7.0.0/16"}},
+			},
+		},
+		{
+			name: "stale split already removed",
+			published: map[string][]string{
+				"example.com":      {"v=spf1 include:spf1.example.com include:spf2.example.com include:spf3.example.com -all"},
+				"spf1.example.com": {splitFirst},
+				"spf2.example.com": {splitSecond},
+			},
+			want: []publishChange{
+				{Name: "example.com", Published: []string{"v=spf1 include:spf1.example.com include:spf2.example.com include:spf3.example.com -all"}, Value: splitRoot},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakePublisher{records: tt.published}
+			got, err := planChanges(context.Background(), p, splitResult(), splitOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planChanges() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleRecords(t *testing.T) {
+	records := []PublishedRecord{
+		{Name: "example.com", Value: splitRoot},
+		{Name: "spf1.example.com", Value: splitFirst},
+	}
+	tests := []struct {
+		name      string
+		published []string
+		want      []string
+	}{
+		{
+			name: "no root record",
+		},
+		{
+			name:      "current split",
+			published: []string{"v=spf1 include:spf1.example.com -all"},
+		},
+		{
+			name:      "shorter split",
+			published: []string{"v=spf1 include:spf1.example.com include:spf2.example.com include:spf3.example.com -all"},
+			want:      []string{"spf2.example.com", "spf3.example.com"},
+		},
+		{
+			name:      "case and trailing dot",
+			published: []string{"v=spf1 include:SPF1.example.com. include:SPF2.Example.com. -all"},
+			want:      []string{"SPF2.Example.com"},
+		},
+		{
+			name:      "several root records",
+			published: []string{"v=spf1 include:spf2.example.com -all", "v=spf1 include:spf2.example.com include:spf3.example.com ~all"},
+			want:      []string{"spf2.example.com", "spf3.example.com"},
+		},
+		{
+			name:      "names outside the template",
+			published: []string{"v=spf1 include:_spf.google.com include:spf.example.com include:spf0.example.com include:spf2.example.org include:spf2.sub.example.com include:xspf2.example.com -all"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := func(name string) ([]string, error) {
+				if name != "example.com" {
+					t.Errorf("lookup(%q), want the root record only", name)
+				}
+				return tt.published, nil
+			}
+			got, err := staleRecords(records, splitOptions, lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staleRecords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	errLookup := errors.New("lookup failed")
+	_, err := staleRecords(records, splitOptions, func(string) ([]string, error) { return nil, errLookup })
+	if !errors.Is(err, errLookup) {
+		t.Errorf("staleRecords() error = %v, want %v", err, errLookup)
+	}
+}
+
+func TestUnquoteTXT(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`"v=spf1 -all"`, "v=spf1 -all"},
+		{`"v=spf1 " "-all"`, "v=spf1 -all"},
+		{`  "v=spf1 -all"  `, "v=spf1 -all"},
+		{`v=spf1 -all`, "v=spf1 -all"},
+		{`"a \"quoted\" \\ value"`, `a "quoted" \ value`},
+		{`""`, ""},
+	}
+	for _, tt := range tests {
+		if got := unquoteTXT(tt.content); got != tt.want {
+			t.Errorf("unquoteTXT(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
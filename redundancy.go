@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// writeRedundancy writes the entries that broader entries fully cover,
+// which aggregating the networks would remove, along with the record each
+// of them came from.
+func writeRedundancy(w io.Writer, entries []spfflatten.Entry) {
+	redundant := 0
+	for i, entry := range entries {
+		prefix := entry.Prefix().Masked()
+		if !prefix.IsValid() {
+			continue
+		}
+		for j, broader := range entries {
+			other := broader.Prefix().Masked()
+			if i == j || !other.IsValid() || other.Bits() > prefix.Bits() || !other.Contains(prefix.Addr()) {
+				continue
+			}
+			// Of two identical networks, only the later one is redundant
+			if other.Bits() == prefix.Bits() && j > i {
+				continue
+			}
+			fmt.Fprintf(w, "%s is covered by %s\n", describeEntry(entry), describeEntry(broader))
+			redundant++
+			break
+		}
+	}
+	if redundant == 0 {
+		fmt.Fprintln(w, "No entry is covered by a broader one")
+		return
+	}
+	fmt.Fprintf(w, "%d of %d entries are covered by broader ones\n", redundant, len(entries))
+}
+
+// describeEntry returns the address or network of entry with the mechanism
+// and record it came from.
+func describeEntry(entry spfflatten.Entry) string {
+	if entry.Source == "" {
+		return fmt.Sprintf("%s (%s from the command line)", entry.IP, entry.Mechanism)
+	}
+	return fmt.Sprintf("%s (%s in %s)", entry.IP, entry.Mechanism, entry.Source)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// Formats writing a human-readable report of the flattening.
+const (
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// reportData is the data the report templates are executed with.
+type reportData struct {
+	Generated string
+	Domain    string
+	// Tree is the include tree as written by writeTree.
+	Tree      string
+	Providers []providerContribution
+	Warnings  []string
+	Skipped   []spfflatten.SkippedTerm
+	IP4, IP6  int
+	// Bytes is the length of the flattened record.
+	Bytes           int
+	OriginalLookups int
+	Lookups         int
+	MaxLookups      int
+	Queries         int
+	Depth           int
+	// Before holds the records currently published on Domain, or the
+	// records of the include domains when no Domain is given.
+	Before []PublishedRecord
+	// After holds the records to publish.
+	After []PublishedRecord
+}
+
+// providerContribution is what a top-level include domain, or the command
+// line, contributes to the flattened record.
+type providerContribution struct {
+	Domain   string
+	IP4, IP6 int
+	// Lookups is the number of DNS lookups its records consume unflattened.
+	Lookups int
+}
+
+// buildReport collects the report of result. The records before flattening
+// are looked up with opts.LookupPublished.
+func buildReport(result *spfflatten.Result, opts spfflatten.FormatOptions) (*reportData, error) {
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return nil, err
+	}
+	var tree strings.Builder
+	writeTree(&tree, result)
+	ip4, ip6 := splitFamilies(result)
+	data := &reportData{
+		Generated:       time.Now().UTC().Format(time.RFC3339),
+		Domain:          opts.Domain,
+		Tree:            tree.String(),
+		Warnings:        result.Warnings,
+		Skipped:         result.Skipped,
+		IP4:             len(ip4),
+		IP6:             len(ip6),
+		Bytes:           len(record),
+		OriginalLookups: originalLookups(result.Tree),
+		Lookups:         result.Lookups,
+		MaxLookups:      spfflatten.MaxLookups,
+		Queries:         result.Queries,
+		Depth:           maxDepth(result.Tree),
+	}
+
+	// Entries are attributed to the top-level include domain of their path
+	index := make(map[string]int)
+	data.Providers = []providerContribution{{Domain: "command line"}}
+	for _, root := range result.Tree {
+		if _, ok := index[root.Domain]; !ok {
+			index[root.Domain] = len(data.Providers)
+			data.Providers = append(data.Providers, providerContribution{Domain: root.Domain})
+		}
+		data.Providers[index[root.Domain]].Lookups += root.Lookups + originalLookups(root.Children)
+	}
+	for _, entry := range result.Entries {
+		provider := &data.Providers[0]
+		if len(entry.Path) > 0 {
+			provider = &data.Providers[index[entry.Path[0]]]
+		}
+		if spfflatten.IsIPv4(entry.IP) {
+			provider.IP4++
+		} else {
+			provider.IP6++
+		}
+	}
+	if data.Providers[0].IP4+data.Providers[0].IP6 == 0 {
+		data.Providers = data.Providers[1:]
+	}
+
+	names := []string{opts.Domain}
+	if opts.Domain == "" {
+		names = names[:0]
+		for _, root := range result.Tree {
+			names = append(names, root.Domain)
+		}
+	}
+	if opts.LookupPublished != nil {
+		for _, name := range names {
+			published, err := opts.LookupPublished(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range published {
+				data.Before = append(data.Before, PublishedRecord{Name: name, Value: strings.Join(record, "")})
+			}
+		}
+	}
+
+	if opts.Domain != "" {
+		records, err := buildRecords(result, opts)
+		if err != nil {
+			return nil, err
+		}
+		data.After = records
+	} else {
+		data.After = []PublishedRecord{{Value: record}}
+	}
+	return data, nil
+}
+
+// markdownReport is the template of the markdown report.
+var markdownReport = template.Must(template.New(formatMarkdown).Parse(`# SPF flattening report{{if .Domain}} for {{.Domain}}{{end}}
+
+Generated on {{.Generated}}.
+
+## Summary
+
+| | |
+|---|---|
+| Entries | {{.IP4}} ip4, {{.IP6}} ip6 |
+| Record length | {{.Bytes}} bytes |
+| DNS lookups before flattening | {{.OriginalLookups}} of {{.MaxLookups}} |
+| DNS lookups after flattening | {{.Lookups}} of {{.MaxLookups}} |
+| DNS queries performed | {{.Queries}} |
+| Maximum include depth | {{.Depth}} |
+
+## Providers
+
+| Source | ip4 | ip6 | DNS lookups |
+|---|---:|---:|---:|
+{{range .Providers}}| {{.Domain}} | {{.IP4}} | {{.IP6}} | {{.Lookups}} |
+{{end}}
+## Include tree
+
+` + "```" + `
+{{.Tree}}` + "```" + `
+
+## Warnings
+
+{{range .Warnings}}- {{.}}
+{{else}}None.
+{{end}}{{if .Skipped}}
+Skipped terms, which the flattened record does not represent:
+
+{{range .Skipped}}- ` + "`{{.Term}}`" + ` in {{.Domain}}: {{.Reason}}
+{{end}}{{end}}
+## Before
+
+{{range .Before}}{{if .Name}}{{.Name}}:
+
+{{end}}` + "```" + `
+{{.Value}}
+` + "```" + `
+
+{{else}}No SPF record published.
+
+{{end}}## After
+
+{{range .After}}{{if .Name}}{{.Name}}:
+
+{{end}}` + "```" + `
+{{.Value}}
+` + "```" + `
+
+{{end}}`))
+
+// htmlReport is the template of the HTML report.
+var htmlReport = htmltemplate.Must(htmltemplate.New(formatHTML).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SPF flattening report{{if .Domain}} for {{.Domain}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+pre { background: #f4f4f4; padding: 0.6em; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>SPF flattening report{{if .Domain}} for {{.Domain}}{{end}}</h1>
+<p>Generated on {{.Generated}}.</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Entries</th><td>{{.IP4}} ip4, {{.IP6}} ip6</td></tr>
+<tr><th>Record length</th><td>{{.Bytes}} bytes</td></tr>
+<tr><th>DNS lookups before flattening</th><td>{{.OriginalLookups}} of {{.MaxLookups}}</td></tr>
+<tr><th>DNS lookups after flattening</th><td>{{.Lookups}} of {{.MaxLookups}}</td></tr>
+<tr><th>DNS queries performed</th><td>{{.Queries}}</td></tr>
+<tr><th>Maximum include depth</th><td>{{.Depth}}</td></tr>
+</table>
+
+<h2>Providers</h2>
+<table>
+<tr><th>Source</th><th>ip4</th><th>ip6</th><th>DNS lookups</th></tr>
+{{range .Providers}}<tr><td>{{.Domain}}</td><td>{{.IP4}}</td><td>{{.IP6}}</td><td>{{.Lookups}}</td></tr>
+{{end}}</table>
+
+<h2>Include tree</h2>
+<pre>{{.Tree}}</pre>
+
+<h2>Warnings</h2>
+{{if .Warnings}}<ul>
+{{range .Warnings}}<li>{{.}}</li>
+{{end}}</ul>
+{{else}}<p>None.</p>
+{{end}}{{if .Skipped}}<p>Skipped terms, which the flattened record does not represent:</p>
+<ul>
+{{range .Skipped}}<li><code>{{.Term}}</code> in {{.Domain}}: {{.Reason}}</li>
+{{end}}</ul>
+{{end}}
+<h2>Before</h2>
+{{range .Before}}{{if .Name}}<p>{{.Name}}:</p>
+{{end}}<pre>{{.Value}}</pre>
+{{else}}<p>No SPF record published.</p>
+{{end}}
+<h2>After</h2>
+{{range .After}}{{if .Name}}<p>{{.Name}}:</p>
+{{end}}<pre>{{.Value}}</pre>
+{{end}}</body>
+</html>
+`))
+
+// writeMarkdown writes a report of the flattening in Markdown, suitable for
+// attaching to change requests and compliance reviews: the statistics, the
+// entries each provider contributes, the include tree, the warnings and
+// the records before and after flattening.
+func writeMarkdown(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	data, err := buildReport(result, opts)
+	if err != nil {
+		return err
+	}
+	return markdownReport.Execute(w, data)
+}
+
+// writeHTML writes the report of writeMarkdown as a standalone HTML page.
+func writeHTML(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	data, err := buildReport(result, opts)
+	if err != nil {
+		return err
+	}
+	return htmlReport.Execute(w, data)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerRFC2136 = "rfc2136"
+
+func init() {
+	spfpublish.Register(providerRFC2136, newRFC2136)
+}
+
+// tsigAlgorithms maps the algorithm names of key files to their TSIG
+// algorithms.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKey is a TSIG key shared with the primary nameserver.
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// rfc2136 publishes records with RFC 2136 dynamic updates sent to the
+// primary nameserver of -endpoint, signed with the TSIG key of the key file
+// given by -credentials, such as written by tsig-keygen or keymgr -t.
+type rfc2136 struct {
+	spfpublish.Config
+	server string
+	key    tsigKey
+	client *dns.Client
+}
+
+// newRFC2136 returns a publisher for the zone of config on its primary
+// nameserver.
+func newRFC2136(config spfpublish.Config) (spfpublish.Publisher, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("no endpoint: pass -endpoint with the address of the primary nameserver, such as 192.0.2.1:53")
+	}
+	if config.Credentials == "" {
+		return nil, errors.New("no credentials: pass -credentials with a TSIG key file")
+	}
+	key, err := readTSIGKey(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	server := config.Endpoint
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	// Updates go over TCP as they may not fit in a UDP message
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{key.Name: key.Secret}}
+	if config.Client != nil {
+		client.Timeout = config.Client.Timeout
+	}
+	return &rfc2136{Config: config, server: server, key: key, client: client}, nil
+}
+
+// readTSIGKey reads the first key statement of a key file in the named.conf
+// syntax understood by nsupdate -k, BIND and Knot:
+//
+//	key "name" {
+//		algorithm hmac-sha256;
+//		secret "base64";
+//	};
+func readTSIGKey(file string) (tsigKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return tsigKey{}, err
+	}
+	var key tsigKey
+	// Splitting on the punctuation leaves the keywords followed by their
+	// values
+	fields := strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == '{' || r == '}' || r == ';' || r == '"' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for i := 0; i+1 < len(fields); i++ {
+		switch {
+		case fields[i] == "key" && key.Name == "":
+			key.Name = dns.CanonicalName(fields[i+1])
+		case fields[i] == "algorithm":
+			key.Algorithm = strings.ToLower(fields[i+1])
+		case fields[i] == "secret":
+			key.Secret = fields[i+1]
+		}
+	}
+	if key.Name == "" || key.Secret == "" {
+		return tsigKey{}, fmt.Errorf("invalid TSIG key file %s: no key name or secret", file)
+	}
+	algorithm, ok := tsigAlgorithms[key.Algorithm]
+	if !ok {
+		return tsigKey{}, fmt.Errorf("invalid TSIG key file %s: unsupported algorithm %q", file, key.Algorithm)
+	}
+	key.Algorithm = algorithm
+	return key, nil
+}
+
+// exchange sends m to the primary nameserver signed with the TSIG key and
+// returns its response, whose signature the client verifies.
+func (r *rfc2136) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	m.SetTsig(r.key.Name, r.key.Algorithm, 300, time.Now().Unix())
+	resp, _, err := r.client.ExchangeContext(ctx, m, r.server)
+	return resp, err
+}
+
+// txtRecords returns the TXT records of name on the primary nameserver.
+func (r *rfc2136) txtRecords(ctx context.Context, name string) ([]*dns.TXT, error) {
+	fqdn := dns.Fqdn(name)
+	query := new(dns.Msg)
+	query.SetQuestion(fqdn, dns.TypeTXT)
+	resp, err := r.exchange(ctx, query)
+	if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("%s answered %s", r.server, dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the TXT records of %s: %w", name, err)
+	}
+	var records []*dns.TXT
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, fqdn) {
+			records = append(records, txt)
+		}
+	}
+	return records, nil
+}
+
+// Current returns the SPF records of name on the primary nameserver.
+func (r *rfc2136) Current(ctx context.Context, name string) ([]string, error) {
+	records, err := r.txtRecords(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, txt := range records {
+		if value := strings.Join(txt.Txt, ""); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply deletes the SPF records of name and adds the one of value in a
+// single update. The TXT records of name are read from the primary
+// nameserver, and the update is only applied by it when they are unchanged,
+// so concurrent changes are not lost.
+func (r *rfc2136) Apply(ctx context.Context, name, value string) error {
+	records, err := r.txtRecords(ctx, name)
+	if err != nil {
+		return err
+	}
+	fqdn := dns.Fqdn(name)
+	var existing, stale []dns.RR
+	for _, txt := range records {
+		existing = append(existing, dns.Copy(txt))
+		if spf.IsRecord(strings.Join(txt.Txt, "")) {
+			stale = append(stale, dns.Copy(txt))
+		}
+	}
+	if len(stale) == 0 && value == "" {
+		return nil
+	}
+
+	update := new(dns.Msg)
+	update.SetUpdate(dns.Fqdn(r.Zone))
+	if len(existing) > 0 {
+		update.Used(existing)
+	} else {
+		update.RRsetNotUsed([]dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT}}})
+	}
+	update.Remove(stale)
+	if value != "" {
+		header := dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Ttl: uint32(r.TTL)}
+		update.Insert([]dns.RR{&dns.TXT{Hdr: header, Txt: spf.Chunk(value)}})
+	}
+	resp, err := r.exchange(ctx, update)
+	if err != nil {
+		return err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeNXRrset, dns.RcodeYXRrset:
+		return fmt.Errorf("the TXT records of %s changed on %s while updating them", name, r.server)
+	}
+	return fmt.Errorf("%s refused the update with %s", r.server, dns.RcodeToString[resp.Rcode])
+}
+
+// Verify checks that the primary nameserver holds value for name, see
+// verifySPF.
+func (r *rfc2136) Verify(ctx context.Context, name, value string) error {
+	return verifySPF(ctx, r, name, value)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerRoute53 = "route53"
+
+func init() {
+	spfpublish.Register(providerRoute53, newRoute53)
+}
+
+// Route 53 is a global service whose requests are signed for us-east-1.
+const (
+	route53Endpoint = "https://route53.amazonaws.com"
+	route53Region   = "us-east-1"
+	route53Version  = "2013-04-01"
+)
+
+// route53ChangeInterval is the time between checks of whether a change was
+// propagated to all the Route 53 nameservers.
+const route53ChangeInterval = 5 * time.Second
+
+// awsCredentials are the access keys requests are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// route53 publishes records through the Route 53 API, signing requests
+// with the access keys of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, or of the AWS_PROFILE profile of the shared
+// credentials file given by -credentials, ~/.aws/credentials by default.
+type route53 struct {
+	spfpublish.Config
+	credentials awsCredentials
+	zoneID      string
+	// changes holds the change batch last submitted for each name, which
+	// Verify waits for.
+	changes map[string]route53ChangeInfo
+}
+
+// route53RecordSet is a resource record set of the Route 53 API.
+type route53RecordSet struct {
+	Name    string          `xml:"Name"`
+	Type    string          `xml:"Type"`
+	TTL     int             `xml:"TTL"`
+	Records []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+// route53Record is a value of a resource record set, which for TXT records
+// is made of quoted character-strings.
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+// route53Change is a change of a ChangeResourceRecordSets request.
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+// route53ChangeInfo is the status of a submitted change batch.
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+// newRoute53 returns a publisher for the Route 53 hosted zone of config.
+func newRoute53(config spfpublish.Config) (spfpublish.Publisher, error) {
+	credentials, err := loadAWSCredentials(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = route53Endpoint
+	}
+	return &route53{Config: config, credentials: credentials, changes: make(map[string]route53ChangeInfo)}, nil
+}
+
+// loadAWSCredentials returns the access keys of the environment, or of the
+// shared credentials file when file is given or the environment has none.
+func loadAWSCredentials(file string) (awsCredentials, error) {
+	if file == "" {
+		if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+			return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("no credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or pass -credentials")
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer f.Close()
+	var credentials awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			credentials.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, err
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no access keys for profile %s in %s", profile, file)
+	}
+	return credentials, nil
+}
+
+// call sends a signed request to the API path with in encoded as its XML
+// body, unless it is nil, and decodes the XML response into out.
+func (r *route53) call(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body []byte
+	if in != nil {
+		data, err := xml.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = append([]byte(xml.Header), data...)
+	}
+	endpoint := strings.TrimSuffix(r.Endpoint, "/") + "/" + route53Version + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signAWS(req, body, r.credentials, route53Region, "route53", time.Now())
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("%s: %s", e.Code, e.Message)
+		}
+		return &apiError{Status: resp.StatusCode, Body: string(data)}
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// zone returns the ID of the hosted zone, looking it up by name the first
+// time.
+func (r *route53) zone(ctx context.Context) (string, error) {
+	if r.zoneID != "" {
+		return r.zoneID, nil
+	}
+	var zones struct {
+		HostedZones []struct {
+			ID   string `xml:"Id"`
+			Name string `xml:"Name"`
+		} `xml:"HostedZones>HostedZone"`
+	}
+	query := url.Values{"dnsname": {r.Zone}, "maxitems": {"1"}}
+	if err := r.call(ctx, http.MethodGet, "/hostedzonesbyname", query, nil, &zones); err != nil {
+		return "", fmt.Errorf("failed to look up zone %s: %w", r.Zone, err)
+	}
+	if len(zones.HostedZones) == 0 || !strings.EqualFold(zones.HostedZones[0].Name, r.Zone+".") {
+		return "", fmt.Errorf("hosted zone %s not found, or not accessible with the access keys", r.Zone)
+	}
+	r.zoneID = strings.TrimPrefix(zones.HostedZones[0].ID, "/hostedzone/")
+	return r.zoneID, nil
+}
+
+// recordSet returns the ID of the hosted zone along with the TXT record set
+// of name, which is nil when it does not exist.
+func (r *route53) recordSet(ctx context.Context, name string) (string, *route53RecordSet, error) {
+	zoneID, err := r.zone(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var sets struct {
+		RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	query := url.Values{"name": {name + "."}, "type": {"TXT"}, "maxitems": {"1"}}
+	if err := r.call(ctx, http.MethodGet, "/hostedzone/"+zoneID+"/rrset", query, nil, &sets); err != nil {
+		return "", nil, err
+	}
+	// Record sets are listed from the given name onwards
+	if len(sets.RecordSets) > 0 && sets.RecordSets[0].Type == "TXT" && strings.EqualFold(unescapeRoute53Name(sets.RecordSets[0].Name), name+".") {
+		return zoneID, &sets.RecordSets[0], nil
+	}
+	return zoneID, nil, nil
+}
+
+// Current returns the SPF records of the TXT record set of name.
+func (r *route53) Current(ctx context.Context, name string) ([]string, error) {
+	_, existing, err := r.recordSet(ctx, name)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	var values []string
+	for _, record := range existing.Records {
+		if value := unquoteTXT(record.Value); spf.IsRecord(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Apply replaces the TXT record set of name in a single change batch,
+// keeping its values other than SPF records.
+func (r *route53) Apply(ctx context.Context, name, value string) error {
+	zoneID, existing, err := r.recordSet(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	set := route53RecordSet{Name: name + ".", Type: "TXT", TTL: r.TTL}
+	if existing != nil {
+		set.Records = slices.DeleteFunc(slices.Clone(existing.Records), func(record route53Record) bool {
+			return spf.IsRecord(unquoteTXT(record.Value))
+		})
+	}
+	if value != "" {
+		// Values longer than 255 bytes are made of several character-strings
+		set.Records = append(set.Records, route53Record{Value: quoteChunks(spf.Chunk(value))})
+	}
+
+	var change route53Change
+	switch {
+	case len(set.Records) > 0:
+		change = route53Change{Action: "UPSERT", RecordSet: set}
+	case existing != nil:
+		// Deletions must match the record set exactly
+		change = route53Change{Action: "DELETE", RecordSet: *existing}
+	default:
+		return nil
+	}
+	request := struct {
+		XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Comment string          `xml:"ChangeBatch>Comment"`
+		Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+	}{
+		Comment: "SPF record of " + name,
+		Changes: []route53Change{change},
+	}
+	var info route53ChangeInfo
+	if err := r.call(ctx, http.MethodPost, "/hostedzone/"+zoneID+"/rrset/", nil, request, &info); err != nil {
+		return err
+	}
+	r.changes[name] = info
+	return nil
+}
+
+// Verify waits until the change batch Apply submitted for name is
+// propagated to all the Route 53 nameservers, so that records referencing
+// name are only published after it, then checks that the TXT record set of
+// name holds value, see verifySPF.
+func (r *route53) Verify(ctx context.Context, name, value string) error {
+	if info, ok := r.changes[name]; ok {
+		if err := r.waitForChange(ctx, info); err != nil {
+			return err
+		}
+		delete(r.changes, name)
+	}
+	return verifySPF(ctx, r, name, value)
+}
+
+// waitForChange polls the status of a change batch until it is INSYNC.
+func (r *route53) waitForChange(ctx context.Context, info route53ChangeInfo) error {
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(route53ChangeInterval):
+		}
+		if err := r.call(ctx, http.MethodGet, "/change/"+strings.TrimPrefix(info.ID, "/change/"), nil, nil, &info); err != nil {
+			return fmt.Errorf("failed to get the status of change %s: %w", info.ID, err)
+		}
+	}
+	return nil
+}
+
+// unescapeRoute53Name returns a name listed by Route 53, which escapes
+// characters such as * in octal, in presentation format.
+func unescapeRoute53Name(name string) string {
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) {
+			var c byte
+			if _, err := fmt.Sscanf(name[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// signAWS signs req with Signature Version 4 for service in region.
+func signAWS(req *http.Request, body []byte, credentials awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := []string{"host"}
+	for key := range req.Header {
+		if key := strings.ToLower(key); key == "content-type" || strings.HasPrefix(key, "x-amz-") {
+			headers = append(headers, key)
+		}
+	}
+	slices.Sort(headers)
+	var canonicalHeaders strings.Builder
+	for _, key := range headers {
+		value := req.Header.Get(key)
+		if key == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", key, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// Query values are encoded with %20 rather than + for spaces
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{req.Method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", credentials.AccessKeyID, scope, signedHeaders, hex.EncodeToString(key)))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/miekg/dns"
+	"github.com/perryh/dns-spf-flatten/spf"
+)
+
+// maxUDPSize is the largest DNS message receivers that do not support EDNS0
+// accept over UDP (RFC 1035 section 4.2.1).
+const maxUDPSize = 512
+
+// warnRecordSize warns about the size limits of DNS that the record
+// published on name exceeds: the length of a single character-string, the
+// size of a plain UDP response, and budget bytes when positive.
+func warnRecordSize(w io.Writer, name, record string, budget int) {
+	const suggestion = "split it with -output split or aggregate adjacent networks"
+	chunks := spf.Chunk(record)
+	if len(chunks) > 1 {
+		fmt.Fprintf(w, "Warning: generated record of %d bytes exceeds the %d bytes of a character-string and must be published as %d strings, which some DNS providers do not support\n", len(record), spf.MaxStringLength, len(chunks))
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	msg.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: chunks,
+	}}
+	msg.Compress = true
+	if size := msg.Len(); size > maxUDPSize {
+		fmt.Fprintf(w, "Warning: DNS responses carrying the generated record take %d bytes, exceeding the %d bytes of plain UDP, so receivers without EDNS0 have to retry over TCP; %s\n", size, maxUDPSize, suggestion)
+	}
+
+	if budget > 0 && len(record) > budget {
+		fmt.Fprintf(w, "Warning: generated record of %d bytes exceeds the -size-budget of %d bytes; %s\n", len(record), budget, suggestion)
+	}
+}
@@ -0,0 +1,138 @@
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Builder assembles an SPF record term by term. The zero value is an empty
+// record.
+//
+// Terms are serialized in the order they are added, except that the all
+// mechanism comes after every other mechanism, since mechanisms following it
+// are never evaluated, and modifiers come last. Invalid terms are left out
+// of the record and reported by Err.
+type Builder struct {
+	mechanisms []*Mechanism
+	all        *Mechanism
+	modifiers  []*Modifier
+	err        error
+}
+
+// Add parses each term, such as ip4:192.0.2.0/24, -all or
+// exp=explain.%{d}, and adds it to the record.
+func (b *Builder) Add(terms ...string) *Builder {
+	for _, term := range terms {
+		if term == "" {
+			b.fail(&SyntaxError{Msg: "empty term"})
+			continue
+		}
+		t, err := parseTerm(term, 0)
+		if err != nil {
+			b.fail(err)
+			continue
+		}
+		b.AddTerm(t)
+	}
+	return b
+}
+
+// AddTerm adds a parsed term to the record.
+func (b *Builder) AddTerm(term Term) *Builder {
+	switch t := term.(type) {
+	case *Mechanism:
+		switch {
+		case t.Name != "all":
+			b.mechanisms = append(b.mechanisms, t)
+		case b.all != nil:
+			b.fail(fmt.Errorf("%s after %s: a record has at most one all mechanism", t.Raw, b.all.Raw))
+		case b.modifier("redirect") != nil:
+			b.fail(fmt.Errorf("%s with redirect=: redirect is ignored when all is present", t.Raw))
+		default:
+			b.all = t
+		}
+	case *Modifier:
+		switch {
+		case (t.Name == "redirect" || t.Name == "exp") && b.modifier(t.Name) != nil:
+			b.fail(fmt.Errorf("%s after %s: a record has at most one %s modifier", t.Raw, b.modifier(t.Name).Raw, t.Name))
+		case t.Name == "redirect" && b.all != nil:
+			b.fail(fmt.Errorf("%s with %s: redirect is ignored when all is present", t.Raw, b.all.Raw))
+		default:
+			b.modifiers = append(b.modifiers, t)
+		}
+	}
+	return b
+}
+
+// modifier returns the modifier of the record with the given name, if any.
+func (b *Builder) modifier(name string) *Modifier {
+	for _, m := range b.modifiers {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// fail records err unless an earlier term failed.
+func (b *Builder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Err returns the error of the first term that could not be added.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+// Terms returns the terms of the record in the order they are serialized.
+func (b *Builder) Terms() []Term {
+	var terms []Term
+	for _, m := range b.mechanisms {
+		terms = append(terms, m)
+	}
+	if b.all != nil {
+		terms = append(terms, b.all)
+	}
+	for _, m := range b.modifiers {
+		terms = append(terms, m)
+	}
+	return terms
+}
+
+// String returns the record, starting with the v=spf1 version.
+func (b *Builder) String() string {
+	parts := []string{"v=spf1"}
+	for _, t := range b.Terms() {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Record returns the record along with the error of the first term that
+// could not be added.
+func (b *Builder) Record() (string, error) {
+	return b.String(), b.err
+}
+
+// MaxStringLength is the maximum length of a single DNS character-string.
+const MaxStringLength = 255
+
+// Chunk splits record into character-strings of at most MaxStringLength
+// bytes. Receivers concatenate the strings of a TXT record without any
+// separator (RFC 7208 section 3.3), so splits happen after the space that
+// separates two terms. Only terms longer than a whole string are split
+// inside.
+func Chunk(record string) []string {
+	var chunks []string
+	for len(record) > MaxStringLength {
+		cut := strings.LastIndexByte(record[:MaxStringLength], ' ') + 1
+		if cut == 0 {
+			cut = MaxStringLength
+		}
+		chunks = append(chunks, record[:cut])
+		record = record[cut:]
+	}
+	return append(chunks, record)
+}
@@ -0,0 +1,113 @@
+package spf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuilderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		want  string
+	}{
+		{"empty", nil, "v=spf1"},
+		{"in order", []string{"ip4:192.0.2.0/24", "ip6:2001:db8::/32", "include:_spf.example.com", "-all"}, "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 include:_spf.example.com -all"},
+		{"all last", []string{"~all", "a", "mx:example.com/24"}, "v=spf1 a mx:example.com/24 ~all"},
+		{"modifiers last", []string{"exp=explain.%{d}", "ip4:192.0.2.1", "-all"}, "v=spf1 ip4:192.0.2.1 -all exp=explain.%{d}"},
+		{"redirect", []string{"redirect=_spf.example.com", "ip4:192.0.2.1"}, "v=spf1 ip4:192.0.2.1 redirect=_spf.example.com"},
+		{"case kept", []string{"IP4:192.0.2.1", "exists:%{I}.Example.com", "-ALL"}, "v=spf1 IP4:192.0.2.1 exists:%{I}.Example.com -ALL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			record, err := b.Add(tt.terms...).Record()
+			if err != nil {
+				t.Fatalf("Record() error = %v", err)
+			}
+			if record != tt.want {
+				t.Errorf("Record() = %q, want %q", record, tt.want)
+			}
+
+			// Parsing the record and building it again gives it back.
+			r, err := Parse(record)
+			if err != nil || len(r.Errors) > 0 {
+				t.Fatalf("Parse(%q) error = %v, %v", record, err, r.Errors)
+			}
+			var rebuilt Builder
+			for _, term := range r.Terms {
+				rebuilt.AddTerm(term)
+			}
+			if got := rebuilt.String(); got != record {
+				t.Errorf("rebuilt record = %q, want %q", got, record)
+			}
+		})
+	}
+}
+
+func TestBuilderErr(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		want  string
+		// err is a substring of the error, which is that of the first
+		// term that could not be added.
+		err string
+	}{
+		{"empty term", []string{"a", ""}, "v=spf1 a", "empty term"},
+		{"invalid term", []string{"ip4:192.0.2.0/33", "foo", "-all"}, "v=spf1 -all", "invalid ip4 network"},
+		{"two all", []string{"-all", "~all"}, "v=spf1 -all", "at most one all mechanism"},
+		{"all then redirect", []string{"-all", "redirect=example.com"}, "v=spf1 -all", "redirect is ignored when all is present"},
+		{"redirect then all", []string{"redirect=example.com", "-all"}, "v=spf1 redirect=example.com", "redirect is ignored when all is present"},
+		{"two exp", []string{"exp=a.example.com", "exp=b.example.com"}, "v=spf1 exp=a.example.com", "at most one exp modifier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			record, err := b.Add(tt.terms...).Record()
+			if record != tt.want {
+				t.Errorf("Record() = %q, want %q", record, tt.want)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Record() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestChunk(t *testing.T) {
+	// term returns an include term of exactly n bytes.
+	term := func(n int) string {
+		return "include:" + strings.Repeat("a", n-len("include:.com")) + ".com"
+	}
+	tests := []struct {
+		name   string
+		record string
+		want   []int
+	}{
+		{"empty", "", []int{0}},
+		{"short", "v=spf1 -all", []int{11}},
+		{"exactly one string", "v=spf1 " + term(MaxStringLength-len("v=spf1 ")), []int{255}},
+		{"one byte over", "v=spf1 " + term(MaxStringLength-len("v=spf1 ")+1), []int{7, 249}},
+		{"split after the space", "v=spf1 " + term(240) + " " + term(20), []int{248, 20}},
+		{"space at the boundary", "v=spf1 " + term(247) + " " + term(20), []int{255, 20}},
+		{"long term", term(600), []int{255, 255, 90}},
+		{"several strings", strings.Repeat(term(99)+" ", 6) + "-all", []int{200, 200, 204}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := Chunk(tt.record)
+			var lengths []int
+			for _, chunk := range chunks {
+				lengths = append(lengths, len(chunk))
+			}
+			if !slices.Equal(lengths, tt.want) {
+				t.Errorf("lengths of Chunk() = %v, want %v", lengths, tt.want)
+			}
+			if joined := strings.Join(chunks, ""); joined != tt.record {
+				t.Errorf("Chunk() joined = %q, want %q", joined, tt.record)
+			}
+		})
+	}
+}
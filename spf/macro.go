@@ -0,0 +1,300 @@
+package spf
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MacroString is a domain-spec or modifier value made of literal text and
+// macro expressions (RFC 7208 section 7.1).
+type MacroString struct {
+	// Offset is the byte offset of the macro-string in the record.
+	Offset int
+	Parts  []MacroPart
+	Raw    string
+}
+
+// String returns s as published.
+func (s *MacroString) String() string { return s.Raw }
+
+// Macros returns the macro expressions of s.
+func (s *MacroString) Macros() []*Macro {
+	var macros []*Macro
+	for _, part := range s.Parts {
+		if m, ok := part.(*Macro); ok {
+			macros = append(macros, m)
+		}
+	}
+	return macros
+}
+
+// MacroPart is a Literal, an Escape or a *Macro.
+type MacroPart interface {
+	// String returns the part as published.
+	String() string
+}
+
+// Literal is text of a macro-string that is used as is.
+type Literal string
+
+// String returns l.
+func (l Literal) String() string { return string(l) }
+
+// Escape is one of the %%, %_ and %- escapes, standing for a percent sign, a
+// space and a URL-encoded space. Its value is the character after the %.
+type Escape byte
+
+// String returns e as published.
+func (e Escape) String() string { return "%" + string(e) }
+
+// Macro is a %{...} macro expression.
+type Macro struct {
+	// Offset is the byte offset of the expression in the record.
+	Offset int
+	// Letter is the lowercased macro letter, such as d for the domain.
+	Letter byte
+	// URLEscape is set when the letter is uppercase, which URL-encodes the
+	// expansion.
+	URLEscape bool
+	// Digits is the number of rightmost parts kept, all of them when zero.
+	Digits int
+	// Reverse reverses the order of the parts before they are kept.
+	Reverse bool
+	// Delimiters are the characters splitting the expansion into parts,
+	// which defaults to a dot when empty.
+	Delimiters string
+	Raw        string
+}
+
+// String returns m as published.
+func (m *Macro) String() string { return m.Raw }
+
+// Expand returns s with its macro expressions and escapes replaced as
+// described in RFC 7208 section 7.3, value returning the value of each
+// lowercase macro letter.
+func (s *MacroString) Expand(value func(letter byte) string) string {
+	var b strings.Builder
+	for _, part := range s.Parts {
+		switch p := part.(type) {
+		case Literal:
+			b.WriteString(string(p))
+		case Escape:
+			switch p {
+			case '%':
+				b.WriteByte('%')
+			case '_':
+				b.WriteByte(' ')
+			case '-':
+				b.WriteString("%20")
+			}
+		case *Macro:
+			b.WriteString(p.Expand(value(p.Letter)))
+		}
+	}
+	return b.String()
+}
+
+// Expand applies the transformers of m to value, the value of its letter:
+// value is split around the delimiters, reversed, cut down to the rightmost
+// Digits parts and joined with dots, then URL-encoded when the letter is
+// uppercase.
+func (m *Macro) Expand(value string) string {
+	delimiters := m.Delimiters
+	if delimiters == "" {
+		delimiters = "."
+	}
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if strings.IndexByte(delimiters, value[i]) >= 0 {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, value[start:])
+	if m.Reverse {
+		slices.Reverse(parts)
+	}
+	if m.Digits > 0 && m.Digits < len(parts) {
+		parts = parts[len(parts)-m.Digits:]
+	}
+	expanded := strings.Join(parts, ".")
+	if m.URLEscape {
+		expanded = urlEscape(expanded)
+	}
+	return expanded
+}
+
+// urlEscape percent-encodes the characters of s other than the unreserved
+// characters of RFC 3986.
+func urlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// ParseMacroString parses s, a domain-spec or modifier value given outside
+// of a record, into a macro-string.
+func ParseMacroString(s string) *MacroString {
+	return parseMacroString(s, 0)
+}
+
+// parseMacroString parses the macro-string s published at offset. Percent
+// signs that do not start a valid macro expression or escape are kept as
+// literal text.
+func parseMacroString(s string, offset int) *MacroString {
+	ms := &MacroString{Offset: offset, Raw: s}
+	literal := 0
+	flush := func(end int) {
+		if end > literal {
+			ms.Parts = append(ms.Parts, Literal(s[literal:end]))
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 >= len(s) {
+			continue
+		}
+		switch s[i+1] {
+		case '%', '_', '-':
+			flush(i)
+			ms.Parts = append(ms.Parts, Escape(s[i+1]))
+			i++
+			literal = i + 1
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				continue
+			}
+			m, ok := parseMacro(s[i:i+end+1], offset+i)
+			if !ok {
+				continue
+			}
+			flush(i)
+			ms.Parts = append(ms.Parts, m)
+			i += end
+			literal = i + 1
+		}
+	}
+	flush(len(s))
+	return ms
+}
+
+// parseMacro parses the macro expression raw, such as %{d2r}, published at
+// offset.
+func parseMacro(raw string, offset int) (*Macro, bool) {
+	body := raw[2 : len(raw)-1]
+	if body == "" {
+		return nil, false
+	}
+	m := &Macro{Offset: offset, Raw: raw}
+	letter := body[0]
+	if letter >= 'A' && letter <= 'Z' {
+		m.URLEscape = true
+		letter += 'a' - 'A'
+	}
+	if !strings.ContainsRune("slodiphcrtv", rune(letter)) {
+		return nil, false
+	}
+	m.Letter = letter
+
+	transformers := body[1:]
+	rest := strings.TrimLeft(transformers, "0123456789")
+	if n := len(transformers) - len(rest); n > 0 {
+		digits, err := strconv.Atoi(transformers[:n])
+		if err != nil || digits == 0 {
+			return nil, false
+		}
+		m.Digits = digits
+	}
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		m.Reverse = true
+		rest = rest[1:]
+	}
+	if strings.Trim(rest, ".-+,/_=") != "" {
+		return nil, false
+	}
+	m.Delimiters = rest
+	return m, true
+}
+
+// checkMacroString returns the first violation of the macro-string grammar
+// in s: a character other than visible ASCII, or a percent sign that starts
+// neither a macro expression nor one of the %%, %_ and %- escapes. The Term
+// of the error is left to the caller.
+func checkMacroString(s *MacroString) *SyntaxError {
+	raw := s.Raw
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c < 0x21 || c > 0x7e {
+			return &SyntaxError{Offset: s.Offset + i, Msg: "invalid character"}
+		}
+		if c != '%' {
+			continue
+		}
+		if i+1 < len(raw) && strings.IndexByte("%_-", raw[i+1]) >= 0 {
+			i++
+			continue
+		}
+		if i+1 < len(raw) && raw[i+1] == '{' {
+			if end := strings.IndexByte(raw[i:], '}'); end >= 0 {
+				if _, ok := parseMacro(raw[i:i+end+1], 0); ok {
+					i += end
+					continue
+				}
+			}
+		}
+		return &SyntaxError{Offset: s.Offset + i, Msg: "invalid macro expression"}
+	}
+	return nil
+}
+
+// checkDomainSpec returns the first violation of the domain-spec grammar in
+// s, which is a macro-string ending with a macro expression or with a
+// top-level label following a dot.
+func checkDomainSpec(s *MacroString) *SyntaxError {
+	if err := checkMacroString(s); err != nil {
+		return err
+	}
+	start := 0
+	if n := len(s.Parts); n > 0 {
+		literal, ok := s.Parts[n-1].(Literal)
+		if !ok {
+			return nil
+		}
+		start = len(s.Raw) - len(literal)
+	}
+	end := strings.TrimSuffix(s.Raw[start:], ".")
+	dot := strings.LastIndexByte(end, '.')
+	if dot < 0 || !isTopLabel(end[dot+1:]) {
+		return &SyntaxError{Offset: s.Offset + start + dot + 1, Msg: "domain does not end with a valid top-level label"}
+	}
+	return nil
+}
+
+// isTopLabel reports whether label is a toplabel of RFC 7208 section 7.1:
+// letters, digits and inner hyphens, with at least one letter or hyphen so
+// that it cannot be mistaken for the end of an IP address.
+func isTopLabel(label string) bool {
+	if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	numeric := true
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-':
+			numeric = false
+		case c < '0' || c > '9':
+			return false
+		}
+	}
+	return !numeric
+}
@@ -0,0 +1,96 @@
+package spf
+
+import "testing"
+
+func TestMacroExpand(t *testing.T) {
+	// The examples of RFC 7208 section 7.4, with the sender
+	// strong-bad@email.example.com and the IP address 192.0.2.3.
+	values := map[byte]string{
+		's': "strong-bad@email.example.com",
+		'l': "strong-bad",
+		'o': "email.example.com",
+		'd': "email.example.com",
+		'i': "192.0.2.3",
+	}
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}", "3.2.0.192"},
+		{"%{i2r}", "0.192"},
+		{"%{S}", "strong-bad%40email.example.com"},
+		{"%{L-}", "strong.bad"},
+		{"%{l1r+-}", "strong"},
+		{"%{o2r}", "example.email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			m, ok := parseMacro(tt.raw, 0)
+			if !ok {
+				t.Fatalf("parseMacro(%q) failed", tt.raw)
+			}
+			if got := m.Expand(values[m.Letter]); got != tt.want {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMacroStringExpand(t *testing.T) {
+	value := func(letter byte) string {
+		return map[byte]string{'i': "192.0.2.3", 'd': "example.com", 'l': "user"}[letter]
+	}
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"%{ir}.%{v}._spf.%{d}", "3.2.0.192.._spf.example.com"},
+		{"%{l}%%%_%-.%{d}", "user% %20.example.com"},
+		{"%{z}.%{d}", "%{z}.example.com"},
+		{"100%.%{d}", "100%.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := parseMacroString(tt.raw, 0).Expand(value); got != tt.want {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMacro(t *testing.T) {
+	tests := []struct {
+		raw string
+		ok  bool
+	}{
+		{"%{d}", true},
+		{"%{D}", true},
+		{"%{d0}", false},
+		{"%{d2r.-}", true},
+		{"%{dx}", false},
+		{"%{q}", false},
+		{"%{}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if _, ok := parseMacro(tt.raw, 0); ok != tt.ok {
+				t.Errorf("parseMacro() ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+// Package spf parses SPF records (RFC 7208) into the mechanisms, modifiers
+// and macro expressions they are made of, keeping the position of each term
+// for error messages.
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Qualifier is the result a mechanism evaluates to when it matches.
+type Qualifier string
+
+// The qualifiers of RFC 7208 section 4.6.2.
+const (
+	Pass     Qualifier = "+"
+	Fail     Qualifier = "-"
+	SoftFail Qualifier = "~"
+	Neutral  Qualifier = "?"
+)
+
+// Record is a parsed SPF record.
+type Record struct {
+	// Terms holds the valid mechanisms and modifiers in the order they are
+	// published.
+	Terms []Term
+	// Errors holds the terms that failed to parse, which are left out of
+	// Terms.
+	Errors []*SyntaxError
+}
+
+// Term is a *Mechanism or a *Modifier.
+type Term interface {
+	// Pos returns the byte offset of the term in the record.
+	Pos() int
+	// String returns the term as published.
+	String() string
+}
+
+// Mechanism is a mechanism term, such as ip4:192.0.2.0/24 or -all.
+type Mechanism struct {
+	Offset int
+	// Qualifier is the qualifier the mechanism was published with, which is
+	// empty when it has none, see Result.
+	Qualifier Qualifier
+	// Name is the lowercased mechanism name: all, include, a, mx, ptr, ip4,
+	// ip6 or exists.
+	Name string
+	// Domain is the domain-spec of include, a, mx, ptr and exists, which is
+	// nil when a, mx or ptr have none.
+	Domain *MacroString
+	// Network is the address of ip4 and ip6 with its optional prefix
+	// length, as published.
+	Network string
+	// CIDR4 and CIDR6 are the dual-cidr-length of a and mx, which are empty
+	// when absent.
+	CIDR4 string
+	CIDR6 string
+	Raw   string
+}
+
+// Pos returns the byte offset of m in the record.
+func (m *Mechanism) Pos() int { return m.Offset }
+
+// String returns m as published.
+func (m *Mechanism) String() string { return m.Raw }
+
+// Result returns the qualifier of m, which defaults to Pass.
+func (m *Mechanism) Result() Qualifier {
+	if m.Qualifier == "" {
+		return Pass
+	}
+	return m.Qualifier
+}
+
+// Modifier is a name=value term, such as redirect= or exp=.
+type Modifier struct {
+	Offset int
+	// Name is the lowercased modifier name.
+	Name  string
+	Value *MacroString
+	Raw   string
+}
+
+// Pos returns the byte offset of m in the record.
+func (m *Modifier) Pos() int { return m.Offset }
+
+// String returns m as published.
+func (m *Modifier) String() string { return m.Raw }
+
+// SyntaxError is a term of a record that failed to parse.
+type SyntaxError struct {
+	// Offset is the byte offset in the record of the violation, which is
+	// the start of Term when the whole term is at fault.
+	Offset int
+	Term   string
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s in term %q", e.Offset+1, e.Msg, e.Term)
+}
+
+// IsRecord reports whether txt, the value of a TXT record, is an SPF record:
+// whether it starts with the exact v=spf1 version term, so that records
+// such as "v=spf10" are not mistaken for SPF.
+func IsRecord(txt string) bool {
+	version, _, _ := strings.Cut(txt, " ")
+	return strings.EqualFold(version, "v=spf1")
+}
+
+// Parse parses an SPF record. It only fails when record does not start with
+// the v=spf1 version; the terms that fail to parse are returned in the
+// Errors of the record.
+func Parse(record string) (*Record, error) {
+	fields := fields(record)
+	if len(fields) == 0 || !strings.EqualFold(fields[0].text, "v=spf1") {
+		term := ""
+		if len(fields) > 0 {
+			term = fields[0].text
+		}
+		return nil, &SyntaxError{Term: term, Msg: "missing v=spf1 version"}
+	}
+
+	r := &Record{}
+	seen := make(map[string]bool)
+	for _, f := range fields[1:] {
+		term, err := parseTerm(f.text, f.offset)
+		if err != nil {
+			r.Errors = append(r.Errors, err)
+			continue
+		}
+		// redirect= and exp= may appear at most once (RFC 7208 section 6)
+		if m, ok := term.(*Modifier); ok && (m.Name == "redirect" || m.Name == "exp") {
+			if seen[m.Name] {
+				r.Errors = append(r.Errors, &SyntaxError{Offset: m.Offset, Term: m.Raw, Msg: "duplicate " + m.Name + " modifier"})
+				continue
+			}
+			seen[m.Name] = true
+		}
+		r.Terms = append(r.Terms, term)
+	}
+	return r, nil
+}
+
+// Validate checks record against the grammar of RFC 7208, returning the
+// SyntaxError of every invalid term joined with errors.Join.
+func Validate(record string) error {
+	r, err := Parse(record)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(r.Errors))
+	for i, e := range r.Errors {
+		errs[i] = e
+	}
+	return errors.Join(errs...)
+}
+
+// field is a term of a record with its byte offset.
+type field struct {
+	text   string
+	offset int
+}
+
+// fields splits record around whitespace like strings.Fields, keeping the
+// offset of each field.
+func fields(record string) []field {
+	var result []field
+	start := -1
+	for i, c := range record {
+		space := unicode.IsSpace(c)
+		if space && start >= 0 {
+			result = append(result, field{record[start:i], start})
+			start = -1
+		} else if !space && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		result = append(result, field{record[start:], start})
+	}
+	return result
+}
+
+// parseTerm parses the term published at offset.
+func parseTerm(term string, offset int) (Term, *SyntaxError) {
+	// Mechanism and modifier names are case-insensitive, but domain-specs
+	// and macros are kept as published since macro expansion is
+	// case-sensitive
+	qualifier, name, value := splitTerm(term)
+	fail := func(msg string) (Term, *SyntaxError) {
+		return nil, &SyntaxError{Offset: offset, Term: term, Msg: msg}
+	}
+
+	if strings.HasPrefix(value, "=") {
+		if qualifier != "" {
+			return fail("qualifier on modifier")
+		}
+		if !isModifierName(name) {
+			return fail("invalid modifier name")
+		}
+		valueOffset := offset + len(term) - len(value) + 1
+		m := &Modifier{Offset: offset, Name: name, Value: parseMacroString(value[1:], valueOffset), Raw: term}
+		check := checkMacroString
+		if name == "redirect" || name == "exp" {
+			check = checkDomainSpec
+		}
+		if err := check(m.Value); err != nil {
+			err.Term = term
+			return nil, err
+		}
+		return m, nil
+	}
+
+	m := &Mechanism{Offset: offset, Qualifier: Qualifier(qualifier), Name: name, Raw: term}
+	target := strings.TrimPrefix(value, ":")
+	hasTarget := strings.HasPrefix(value, ":") && target != ""
+	targetOffset := offset + len(term) - len(target)
+
+	switch name {
+	case "all":
+		if value != "" {
+			return fail("all takes no argument")
+		}
+	case "ip4", "ip6":
+		version := 4
+		if name == "ip6" {
+			version = 6
+		}
+		if !hasTarget || !isValidIP(target, version) {
+			return fail("invalid " + name + " network")
+		}
+		m.Network = target
+	case "include", "exists":
+		if !hasTarget {
+			return fail("missing domain")
+		}
+		m.Domain = parseMacroString(target, targetOffset)
+	case "a", "mx":
+		domain, cidr4, cidr6, ok := parseHostMechanism(value)
+		if !ok {
+			return fail("invalid domain or cidr length")
+		}
+		if domain != "" {
+			m.Domain = parseMacroString(domain, offset+len(term)-len(value)+1)
+		}
+		m.CIDR4, m.CIDR6 = cidr4, cidr6
+	case "ptr":
+		if value != "" && !hasTarget {
+			return fail("missing domain")
+		}
+		if hasTarget {
+			m.Domain = parseMacroString(target, targetOffset)
+		}
+	default:
+		return fail("unknown mechanism")
+	}
+	if m.Domain != nil {
+		if err := checkDomainSpec(m.Domain); err != nil {
+			err.Term = term
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// splitTerm splits an SPF term into its optional qualifier, its lowercased
+// mechanism or modifier name, and the remainder starting at the first ':',
+// '/' or '=' with its original case.
+func splitTerm(term string) (qualifier, name, value string) {
+	if strings.ContainsAny(term[:1], "+-~?") {
+		qualifier, term = term[:1], term[1:]
+	}
+	if i := strings.IndexAny(term, ":/="); i >= 0 {
+		name, value = term[:i], term[i:]
+	} else {
+		name = term
+	}
+	return qualifier, strings.ToLower(name), value
+}
+
+// isModifierName reports whether name is a valid modifier name as defined in
+// RFC 7208 section 12.
+func isModifierName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		isAlpha := c >= 'a' && c <= 'z'
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHostMechanism parses the ":domain/cidr4//cidr6" remainder of an a or mx
+// mechanism.
+func parseHostMechanism(spec string) (domain, cidr4, cidr6 string, ok bool) {
+	target, cidr, hasCIDR := strings.Cut(spec, "/")
+	if target != "" {
+		if !strings.HasPrefix(target, ":") || len(target) == 1 {
+			return "", "", "", false
+		}
+		domain = target[1:]
+	}
+	if !hasCIDR {
+		return domain, "", "", true
+	}
+
+	// dual-cidr-length = [ ip4-cidr-length ] [ "/" ip6-cidr-length ]
+	if strings.HasPrefix(cidr, "/") {
+		cidr6 = cidr[1:]
+	} else {
+		cidr4, cidr6, _ = strings.Cut(cidr, "//")
+		if cidr4 == "" {
+			return "", "", "", false
+		}
+	}
+	if cidr4 != "" && !isValidPrefixLength(cidr4, 32) {
+		return "", "", "", false
+	}
+	if strings.HasPrefix(cidr, "/") || strings.Contains(cidr, "//") {
+		if !isValidPrefixLength(cidr6, 128) {
+			return "", "", "", false
+		}
+	}
+	return domain, cidr4, cidr6, true
+}
+
+func isValidPrefixLength(cidr string, max int) bool {
+	n, err := strconv.Atoi(cidr)
+	return err == nil && n >= 0 && n <= max && cidr == strconv.Itoa(n)
+}
+
+// isValidIP reports whether ip is an address of the given IP version with an
+// optional prefix length.
+func isValidIP(ip string, version int) bool {
+	if strings.Contains(ip, "/") {
+		var cidr string
+		ip, cidr, _ = strings.Cut(ip, "/")
+		maxPrefix := 32
+		if version == 6 {
+			maxPrefix = 128
+		}
+		if !isValidPrefixLength(cidr, maxPrefix) {
+			return false
+		}
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	if version == 4 {
+		return parsedIP.To4() != nil
+	}
+	return parsedIP.To4() == nil && strings.Contains(ip, ":")
+}
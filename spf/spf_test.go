@@ -0,0 +1,111 @@
+package spf
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		record string
+		terms  []string
+		// errs are the messages of the terms that failed to parse.
+		errs []string
+	}{
+		{record: "v=spf1", terms: nil},
+		{record: "V=SPF1 -ALL", terms: []string{"-ALL"}},
+		{record: "v=spf1  ip4:192.0.2.0/24\tip6:2001:db8::/32 ~all", terms: []string{"ip4:192.0.2.0/24", "ip6:2001:db8::/32", "~all"}},
+		{record: "v=spf1 a mx/24 a:example.com/24//64 mx:example.com//64 -all", terms: []string{"a", "mx/24", "a:example.com/24//64", "mx:example.com//64", "-all"}},
+		{record: "v=spf1 include:_spf.example.com exists:%{i}.%{d} ptr ?all", terms: []string{"include:_spf.example.com", "exists:%{i}.%{d}", "ptr", "?all"}},
+		{record: "v=spf1 redirect=_spf.example.com exp=explain.%{d} custom=x", terms: []string{"redirect=_spf.example.com", "exp=explain.%{d}", "custom=x"}},
+		{record: "v=spf1 ip4:192.0.2.300 ip4:192.0.2.0/33 ip6:192.0.2.1 -all", terms: []string{"-all"}, errs: []string{"invalid ip4 network", "invalid ip4 network", "invalid ip6 network"}},
+		{record: "v=spf1 a/33 mx//129 a: -all", terms: []string{"-all"}, errs: []string{"invalid domain or cidr length", "invalid domain or cidr length", "invalid domain or cidr length"}},
+		{record: "v=spf1 include: foo all:x ptr:", errs: []string{"missing domain", "unknown mechanism", "all takes no argument", "missing domain"}},
+		{record: "v=spf1 +redirect=example.com 1x=y", errs: []string{"qualifier on modifier", "invalid modifier name"}},
+		{record: "v=spf1 redirect=a.example.com redirect=b.example.com", terms: []string{"redirect=a.example.com"}, errs: []string{"duplicate redirect modifier"}},
+		{record: "v=spf1 include:example.123 include:%{z}.example.com include:example.com.", terms: []string{"include:example.com."}, errs: []string{"domain does not end with a valid top-level label", "invalid macro expression"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			r, err := Parse(tt.record)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			var terms []string
+			for _, term := range r.Terms {
+				terms = append(terms, term.String())
+			}
+			if !slices.Equal(terms, tt.terms) {
+				t.Errorf("terms = %q, want %q", terms, tt.terms)
+			}
+			var errs []string
+			for _, e := range r.Errors {
+				errs = append(errs, e.Msg)
+			}
+			if !slices.Equal(errs, tt.errs) {
+				t.Errorf("errors = %q, want %q", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestParseOffsets(t *testing.T) {
+	r, err := Parse("v=spf1 a  ip4:bad include:%{z}.example.com")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got := r.Terms[0].Pos(); got != 7 {
+		t.Errorf("offset of a = %d, want 7", got)
+	}
+	want := []int{10, 26}
+	var offsets []int
+	for _, e := range r.Errors {
+		offsets = append(offsets, e.Offset)
+	}
+	if !slices.Equal(offsets, want) {
+		t.Errorf("error offsets = %v, want %v", offsets, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		record string
+		// errs is the number of invalid terms, -1 for a missing version.
+		errs int
+	}{
+		{"v=spf1 ip4:192.0.2.0/24 -all", 0},
+		{"v=spf1", 0},
+		{"", -1},
+		{"spf1 -all", -1},
+		{"v=spf10 -all", -1},
+		{"v=spf1 ip4:192.0.2.0/24 foo -all", 1},
+		{"v=spf1 ip4:x ip6:y a:z", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			err := Validate(tt.record)
+			var syntax *SyntaxError
+			switch {
+			case tt.errs == 0:
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+			case tt.errs < 0:
+				if !errors.As(err, &syntax) || syntax.Msg != "missing v=spf1 version" {
+					t.Errorf("Validate() error = %v, want missing version", err)
+				}
+			default:
+				joined, ok := err.(interface{ Unwrap() []error })
+				if !ok || len(joined.Unwrap()) != tt.errs {
+					t.Fatalf("Validate() error = %v, want %d errors", err, tt.errs)
+				}
+				for _, e := range joined.Unwrap() {
+					if !errors.As(e, &syntax) {
+						t.Errorf("error %v is not a *SyntaxError", e)
+					}
+				}
+			}
+		})
+	}
+}
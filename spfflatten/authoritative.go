@@ -0,0 +1,183 @@
+package spfflatten
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEs limits the length of the CNAME chains followed across zones by
+// -authoritative.
+const maxCNAMEs = 8
+
+// queryAuthoritative sends a query for name directly to the authoritative
+// nameservers of its zone. Authoritative servers only answer for their own
+// zones, so CNAMEs to other zones are followed here, and the answer holds the
+// whole chain as it would coming from a resolver.
+func (w *walker) queryAuthoritative(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	var answer []dns.RR
+	for range maxCNAMEs {
+		servers, err := w.authoritativeServers(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		r, err := w.query(ctx, name, qtype, servers, false)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, r.Answer...)
+		r.Answer = answer
+
+		target := cnameTarget(r.Answer, name, qtype)
+		if target == "" || r.Rcode != dns.RcodeSuccess {
+			return r, nil
+		}
+		name = target
+	}
+	return nil, fmt.Errorf("more than %d CNAMEs followed for %s", maxCNAMEs, name)
+}
+
+// cnameTarget follows the CNAMEs of name in answer and returns the name at
+// the end of the chain when answer holds no records of qtype for it, or ""
+// when there is nothing left to follow.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	current := name
+	for range maxCNAMEs {
+		next := ""
+		for _, rr := range answer {
+			if !sameName(rr.Header().Name, current) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		current = next
+	}
+	if current == name {
+		return ""
+	}
+	return current
+}
+
+// authoritativeServers returns the addresses of the authoritative
+// nameservers of the zone containing name, found through the resolvers.
+func (w *walker) authoritativeServers(ctx context.Context, name string) ([]string, error) {
+	zone, err := w.findZone(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	servers, ok := w.nameservers[zone]
+	w.mu.Unlock()
+	if ok {
+		return servers, nil
+	}
+
+	r, err := w.query(ctx, zone, dns.TypeNS, w.resolvers, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range r.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !sameName(ns.Hdr.Name, zone) {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			r, err := w.query(ctx, ns.Ns, qtype, w.resolvers, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, rr := range r.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					servers = append(servers, net.JoinHostPort(rr.A.String(), "53"))
+				case *dns.AAAA:
+					servers = append(servers, net.JoinHostPort(rr.AAAA.String(), "53"))
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no authoritative nameservers found for zone %s", zone)
+	}
+
+	w.mu.Lock()
+	w.nameservers[zone] = servers
+	w.mu.Unlock()
+	return servers, nil
+}
+
+// findZone returns the apex of the zone containing name, as found in the
+// SOA record the resolvers return for it.
+func (w *walker) findZone(ctx context.Context, name string) (string, error) {
+	w.mu.Lock()
+	zone, ok := w.zones[name]
+	w.mu.Unlock()
+	if ok {
+		return zone, nil
+	}
+
+	r, err := w.query(ctx, name, dns.TypeSOA, w.resolvers, true)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range r.Answer {
+		if !sameName(rr.Header().Name, name) {
+			continue
+		}
+		switch rr.(type) {
+		case *dns.SOA:
+			zone = name
+		case *dns.CNAME:
+			// The SOA returned for an alias is that of its target, but the
+			// alias itself belongs to the zone of its parent.
+			parent, ok := parentDomain(name)
+			if !ok {
+				return "", fmt.Errorf("no zone found for %s", name)
+			}
+			zone, err = w.findZone(ctx, parent)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if zone == "" {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+				zone = soa.Hdr.Name
+			}
+		}
+	}
+	if zone == "" {
+		return "", fmt.Errorf("no zone found for %s", name)
+	}
+
+	w.mu.Lock()
+	w.zones[name] = zone
+	w.mu.Unlock()
+	return zone, nil
+}
+
+// sameName reports whether two domain names are equal, ignoring case.
+func sameName(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// parentDomain returns the domain one label above name.
+func parentDomain(name string) (string, bool) {
+	offset, end := dns.NextLabel(name, 0)
+	if end {
+		return "", false
+	}
+	return name[offset:], true
+}
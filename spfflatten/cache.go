@@ -0,0 +1,105 @@
+package spfflatten
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache stores DNS answers between queries. Values are answers in DNS wire
+// format, so that they can be kept in external stores such as Redis or
+// memcached. A Cache must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key, unless it has expired.
+	Get(key string) ([]byte, bool)
+	// Set stores value under key for ttl.
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// MemoryCache is a Cache keeping values in memory until they expire.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// cacheEntry is a value of a MemoryCache with its expiry time.
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]cacheEntry)}
+}
+
+// Get returns the value stored under key, removing it once it has expired.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Set stores value under key for ttl.
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// cacheKey returns the key of the answers to a query for name and qtype
+// sent to servers, which differ between sets of servers, such as a
+// filtering resolver and a public one sharing a Cache, between recursive
+// and authoritative queries, and between queries advertising a UDP payload
+// size of ednsSize, zero without EDNS0, or requiring DNSSEC, so that
+// unauthenticated answers never satisfy a DNSSEC query.
+func cacheKey(name string, qtype uint16, servers []string, recursive bool, ednsSize uint16, dnssec bool) string {
+	key := dns.Fqdn(name) + " " + dns.TypeToString[qtype] + " " + strings.Join(servers, ",")
+	if !recursive {
+		key += " authoritative"
+	}
+	if ednsSize == 0 {
+		key += " noedns"
+	} else {
+		key += " edns=" + strconv.Itoa(int(ednsSize))
+	}
+	if dnssec {
+		key += " dnssec"
+	}
+	return key
+}
+
+// cacheTTL returns how long the answer r may be cached: the lowest TTL of
+// its records, or for negative answers the negative caching TTL of the SOA
+// record of the authority section (RFC 2308 section 5). It returns zero for
+// answers that are not cached, such as errors.
+func cacheTTL(r *dns.Msg) time.Duration {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	var ttl uint32
+	if len(r.Answer) > 0 && r.Rcode == dns.RcodeSuccess {
+		ttl = r.Answer[0].Header().Ttl
+		for _, rr := range r.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	} else {
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,38 @@
+package spfflatten
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCacheSharedBetweenOptions(t *testing.T) {
+	server := newTestServer(t, testZone)
+	cache := NewMemoryCache()
+	tests := []struct {
+		name    string
+		options Options
+		// err is a substring of the error, empty when the lookup succeeds.
+		err string
+	}{
+		{"plain", Options{}, ""},
+		// The test server does not authenticate its answers, so the answer
+		// cached by the plain lookup must not satisfy a DNSSEC one.
+		{"dnssec", Options{DNSSEC: true}, "not authenticated by DNSSEC"},
+		{"no edns", Options{NoEDNS: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.Resolvers = []string{server}
+			options.Cache = cache
+			_, err := New(options).LookupPublished(context.Background(), "inc-pass.test")
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("LookupPublished() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	if got := len(cache.entries); got != 2 {
+		t.Errorf("cached answers = %d, want 2 for the plain and EDNS-less queries", got)
+	}
+}
@@ -0,0 +1,77 @@
+package spfflatten
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Errors that flattening can fail with, to be tested with errors.Is. The
+// first four are permanent errors of the published records, which receivers
+// evaluate to permerror (RFC 7208 section 2.6.7), while ErrDNSTemporary may
+// go away when flattening again later. ErrUnregisteredDomain comes along
+// with ErrNoSPFRecord when the registrable domain of an include does not
+// exist, so that whoever registers it controls part of the record.
+// ErrMaxDepthExceeded reports a chain of includes nested deeper than
+// Options.MaxDepth allows. ErrOverridden reports a mechanism with a fail,
+// softfail or neutral qualifier matching addresses that a later mechanism of
+// its record authorizes, which the flattened record would authorize instead.
+// ErrMacroDependent lists the mechanisms whose targets depend on the message
+// being evaluated, such as exists:%{i}._spf.example.com, which are only
+// passed through unchanged with Options.AllowMacros.
+var (
+	ErrNoSPFRecord         = errors.New("no SPF record found")
+	ErrUnregisteredDomain  = errors.New("unregistered domain")
+	ErrMultipleSPFRecords  = errors.New("multiple SPF records found")
+	ErrLookupLimitExceeded = errors.New("DNS lookup limit exceeded")
+	ErrLoopDetected        = errors.New("include loop detected")
+	ErrMaxDepthExceeded    = errors.New("maximum include depth exceeded")
+	ErrDNSTemporary        = errors.New("temporary DNS failure")
+	ErrOverridden          = errors.New("flattening would authorize addresses the record rejects")
+	ErrMacroDependent      = errors.New("mechanisms depending on macros expanded from the message being evaluated cannot be flattened without changing the senders they authorize")
+)
+
+// DNSError is a DNS query that no resolver answered, or whose answer had an
+// error code.
+type DNSError struct {
+	// Name and Type are the question of the query.
+	Name string
+	Type uint16
+	// Rcode is the error code of the answer, which is only set when Err is
+	// nil.
+	Rcode int
+	// Err is why no resolver answered.
+	Err error
+}
+
+// rcodeError returns the error of the answer r, which has an error code.
+func rcodeError(r *dns.Msg) *DNSError {
+	e := &DNSError{Rcode: r.Rcode}
+	if len(r.Question) > 0 {
+		e.Name, e.Type = r.Question[0].Name, r.Question[0].Qtype
+	}
+	return e
+}
+
+func (e *DNSError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("DNS query failed: %v", e.Err)
+	}
+	return fmt.Sprintf("DNS query returned error code: %s", dns.RcodeToString[e.Rcode])
+}
+
+func (e *DNSError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the query may succeed when retried later: when
+// no resolver answered or all of them answered SERVFAIL.
+func (e *DNSError) Temporary() bool {
+	return e.Err != nil || e.Rcode == dns.RcodeServerFailure
+}
+
+// Is makes temporary errors match ErrDNSTemporary.
+func (e *DNSError) Is(target error) bool {
+	return target == ErrDNSTemporary && e.Temporary()
+}
@@ -0,0 +1,485 @@
+package spfflatten
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/perryh/dns-spf-flatten/spf"
+)
+
+// CheckResult is the result of evaluating an SPF record for a sender (RFC
+// 7208 section 2.6).
+type CheckResult string
+
+// The results of RFC 7208 section 2.6.
+const (
+	ResultNone      CheckResult = "none"
+	ResultNeutral   CheckResult = "neutral"
+	ResultPass      CheckResult = "pass"
+	ResultFail      CheckResult = "fail"
+	ResultSoftFail  CheckResult = "softfail"
+	ResultTempError CheckResult = "temperror"
+	ResultPermError CheckResult = "permerror"
+)
+
+// maxMXNames is the number of names an mx or ptr mechanism may look up the
+// addresses of (RFC 7208 section 4.6.4).
+const maxMXNames = 10
+
+// Sender is the SMTP client whose authorization an SPF record is evaluated
+// for.
+type Sender struct {
+	IP netip.Addr
+	// MailFrom is the reverse-path of the MAIL FROM command, which
+	// defaults to postmaster@Helo when empty.
+	MailFrom string
+	// Helo is the domain of the HELO or EHLO command.
+	Helo string
+}
+
+// Evaluation is the outcome of check_host() (RFC 7208 section 4).
+type Evaluation struct {
+	Result CheckResult
+	// Mechanism is the term that determined Result, such as
+	// ip4:192.0.2.0/24 or -all. It is empty when no mechanism matched.
+	// When an include matched, it is the mechanism that matched within the
+	// included record.
+	Mechanism string
+	// Path is the chain of domains whose records were evaluated, from the
+	// evaluated domain down to the one holding Mechanism.
+	Path []string
+	// Err explains a permerror or temperror Result.
+	Err error
+}
+
+// CheckHost evaluates the SPF record published on domain for sender, as a
+// receiver does with check_host().
+func (f *Flattener) CheckHost(ctx context.Context, domain string, sender Sender) *Evaluation {
+	e := newEvaluator(f, sender)
+	defer e.w.pool.closeIdle()
+	return e.checkHost(ctx, strings.ToLower(strings.TrimSuffix(domain, ".")), nil)
+}
+
+// CheckRecord evaluates record for sender as if it was published on domain,
+// such as to check a generated record before publishing it.
+func (f *Flattener) CheckRecord(ctx context.Context, record, domain string, sender Sender) *Evaluation {
+	e := newEvaluator(f, sender)
+	defer e.w.pool.closeIdle()
+	return e.evaluate(ctx, record, strings.ToLower(strings.TrimSuffix(domain, ".")), nil)
+}
+
+// evaluator holds the state of a single check_host() evaluation, which
+// limits the DNS lookups and void lookups of all the records it evaluates
+// together.
+type evaluator struct {
+	w       *walker
+	sender  Sender
+	ip      netip.Addr
+	lookups int
+	voids   int
+}
+
+// newEvaluator returns an evaluator querying the resolvers of f.
+func newEvaluator(f *Flattener, sender Sender) *evaluator {
+	if sender.MailFrom == "" {
+		sender.MailFrom = "postmaster@" + sender.Helo
+	} else if !strings.Contains(sender.MailFrom, "@") {
+		sender.MailFrom = "postmaster@" + sender.MailFrom
+	}
+	return &evaluator{w: newWalker(f), sender: sender, ip: sender.IP.Unmap()}
+}
+
+// errorResult returns a permerror or temperror evaluation of the record of
+// the last domain of path.
+func errorResult(result CheckResult, path []string, format string, args ...any) *Evaluation {
+	return &Evaluation{Result: result, Path: path, Err: fmt.Errorf(format, args...)}
+}
+
+// checkHost fetches and evaluates the SPF record of domain, path holding
+// the domains that included or redirected to it. The lookups of included
+// and redirected domains count as void lookups when the domain does not
+// exist or has no TXT record.
+func (e *evaluator) checkHost(ctx context.Context, domain string, path []string) *Evaluation {
+	here := append(path[:len(path):len(path)], domain)
+	r, err := e.w.queryDNS(ctx, domain, dns.TypeTXT)
+	if err != nil {
+		return errorResult(ResultTempError, here, "failed to look up the SPF record of %s: %w", domain, err)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return errorResult(ResultTempError, here, "failed to look up the SPF record of %s: %w", domain, rcodeError(r))
+	}
+	if len(path) > 0 && !slices.ContainsFunc(r.Answer, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeTXT }) {
+		if evaluation := e.countVoid(domain, path); evaluation != nil {
+			return evaluation
+		}
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return &Evaluation{Result: ResultNone, Path: here}
+	}
+
+	var records []string
+	for _, ans := range r.Answer {
+		if txt, ok := ans.(*dns.TXT); ok && spf.IsRecord(strings.Join(txt.Txt, "")) {
+			records = append(records, strings.Join(txt.Txt, ""))
+		}
+	}
+	switch len(records) {
+	case 0:
+		return &Evaluation{Result: ResultNone, Path: here}
+	case 1:
+		return e.evaluate(ctx, records[0], domain, path)
+	}
+	return errorResult(ResultPermError, here, "%w for domain %s", ErrMultipleSPFRecords, domain)
+}
+
+// evaluate evaluates record as published on domain.
+func (e *evaluator) evaluate(ctx context.Context, record, domain string, path []string) *Evaluation {
+	path = append(path[:len(path):len(path)], domain)
+	parsed, err := spf.Parse(record)
+	if err != nil {
+		return errorResult(ResultPermError, path, "invalid SPF record of %s: %w", domain, err)
+	}
+	if len(parsed.Errors) > 0 {
+		return errorResult(ResultPermError, path, "invalid SPF record of %s: %w", domain, parsed.Errors[0])
+	}
+
+	var redirect *spf.Modifier
+	for _, term := range parsed.Terms {
+		switch t := term.(type) {
+		case *spf.Modifier:
+			if t.Name == "redirect" {
+				redirect = t
+			}
+		case *spf.Mechanism:
+			if evaluation := e.match(ctx, t, domain, path); evaluation != nil {
+				return evaluation
+			}
+		}
+	}
+
+	// redirect= only applies when no mechanism matched, so that an all
+	// mechanism always takes precedence (RFC 7208 section 6.1)
+	if redirect != nil {
+		if evaluation := e.countLookup(redirect.Raw, path); evaluation != nil {
+			return evaluation
+		}
+		target := e.expandDomain(redirect.Value, domain)
+		evaluation := e.checkHost(ctx, target, path)
+		if evaluation.Result == ResultNone {
+			return errorResult(ResultPermError, evaluation.Path, "%w for domain %s, the target of %s", ErrNoSPFRecord, target, redirect.Raw)
+		}
+		return evaluation
+	}
+	return &Evaluation{Result: ResultNeutral, Path: path}
+}
+
+// match returns the evaluation that m determines when it matches or fails,
+// and nil when evaluation continues with the next term.
+func (e *evaluator) match(ctx context.Context, m *spf.Mechanism, domain string, path []string) *Evaluation {
+	matched := &Evaluation{Result: qualifierResult(m.Result()), Mechanism: m.Raw, Path: path}
+	if ctx.Err() != nil {
+		return errorResult(ResultTempError, path, "%w", ctx.Err())
+	}
+
+	switch m.Name {
+	case "all":
+		return matched
+	case "ip4", "ip6":
+		prefix, err := parseNetwork(m.Network)
+		if err != nil {
+			return errorResult(ResultPermError, path, "invalid network in %s: %w", m.Raw, err)
+		}
+		if prefix.Contains(e.ip) {
+			return matched
+		}
+		return nil
+	}
+
+	if evaluation := e.countLookup(m.Raw, path); evaluation != nil {
+		return evaluation
+	}
+	target := domain
+	if m.Domain != nil {
+		target = e.expandDomain(m.Domain, domain)
+	}
+
+	switch m.Name {
+	case "include":
+		evaluation := e.checkHost(ctx, target, path)
+		switch evaluation.Result {
+		case ResultPass:
+			evaluation.Result = matched.Result
+			return evaluation
+		case ResultTempError, ResultPermError:
+			return evaluation
+		case ResultNone:
+			return errorResult(ResultPermError, evaluation.Path, "%w for domain %s, the target of %s", ErrNoSPFRecord, target, m.Raw)
+		}
+		return nil
+	case "a":
+		addrs, evaluation := e.lookupAddrs(ctx, target, m.Raw, path)
+		if evaluation != nil {
+			return evaluation
+		}
+		if e.containsIP(addrs, m.CIDR4, m.CIDR6) {
+			return matched
+		}
+	case "mx":
+		r, evaluation := e.lookup(ctx, target, dns.TypeMX, m.Raw, path)
+		if evaluation != nil {
+			return evaluation
+		}
+		var hosts []string
+		for _, ans := range r.Answer {
+			if mx, ok := ans.(*dns.MX); ok {
+				hosts = append(hosts, mx.Mx)
+			}
+		}
+		if len(hosts) > maxMXNames {
+			return errorResult(ResultPermError, path, "%s returned %d mail exchangers, exceeding the limit of %d", m.Raw, len(hosts), maxMXNames)
+		}
+		for _, host := range hosts {
+			addrs, evaluation := e.lookupAddrs(ctx, host, m.Raw, path)
+			if evaluation != nil {
+				return evaluation
+			}
+			if e.containsIP(addrs, m.CIDR4, m.CIDR6) {
+				return matched
+			}
+		}
+	case "ptr":
+		names, evaluation := e.validatedNames(ctx, m.Raw, path)
+		if evaluation != nil {
+			return evaluation
+		}
+		for _, name := range names {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return matched
+			}
+		}
+	case "exists":
+		r, evaluation := e.lookup(ctx, target, dns.TypeA, m.Raw, path)
+		if evaluation != nil {
+			return evaluation
+		}
+		for _, ans := range r.Answer {
+			if _, ok := ans.(*dns.A); ok {
+				return matched
+			}
+		}
+	}
+	return nil
+}
+
+// countLookup counts the DNS lookup of term, returning a permerror when it
+// exceeds MaxLookups.
+func (e *evaluator) countLookup(term string, path []string) *Evaluation {
+	e.lookups++
+	if e.lookups > MaxLookups {
+		return errorResult(ResultPermError, path, "%w at %s", ErrLookupLimitExceeded, term)
+	}
+	return nil
+}
+
+// lookup queries name for qtype on behalf of term. Answers without records
+// of the type and NXDOMAIN are void lookups, a permerror once they exceed
+// MaxVoidLookups.
+func (e *evaluator) lookup(ctx context.Context, name string, qtype uint16, term string, path []string) (*dns.Msg, *Evaluation) {
+	r, err := e.w.queryDNS(ctx, name, qtype)
+	if err != nil {
+		return nil, errorResult(ResultTempError, path, "failed to resolve %s: %w", term, err)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, errorResult(ResultTempError, path, "failed to resolve %s: %w", term, rcodeError(r))
+	}
+	for _, ans := range r.Answer {
+		if ans.Header().Rrtype == qtype {
+			return r, nil
+		}
+	}
+	return r, e.countVoid(term, path)
+}
+
+// countVoid counts a void lookup of term, returning a permerror when the
+// void lookups exceed MaxVoidLookups.
+func (e *evaluator) countVoid(term string, path []string) *Evaluation {
+	e.voids++
+	if e.voids > MaxVoidLookups {
+		return errorResult(ResultPermError, path, "%s is void lookup %d, exceeding the limit of %d", term, e.voids, MaxVoidLookups)
+	}
+	return nil
+}
+
+// lookupAddrs returns the addresses of name in the family of the sender.
+func (e *evaluator) lookupAddrs(ctx context.Context, name, term string, path []string) ([]netip.Addr, *Evaluation) {
+	qtype := dns.TypeAAAA
+	if e.ip.Is4() {
+		qtype = dns.TypeA
+	}
+	r, evaluation := e.lookup(ctx, name, qtype, term, path)
+	if evaluation != nil {
+		return nil, evaluation
+	}
+	var addrs []netip.Addr
+	for _, ans := range r.Answer {
+		switch rr := ans.(type) {
+		case *dns.A:
+			addr, _ := netip.AddrFromSlice(rr.A.To4())
+			addrs = append(addrs, addr)
+		case *dns.AAAA:
+			addr, _ := netip.AddrFromSlice(rr.AAAA)
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// containsIP reports whether the networks of addrs, with the prefix
+// lengths of a dual-cidr-length, contain the address of the sender.
+func (e *evaluator) containsIP(addrs []netip.Addr, cidr4, cidr6 string) bool {
+	cidr := cidr6
+	if e.ip.Is4() {
+		cidr = cidr4
+	}
+	for _, addr := range addrs {
+		bits := addr.BitLen()
+		if cidr != "" {
+			bits, _ = strconv.Atoi(cidr)
+		}
+		if prefix, err := addr.Prefix(bits); err == nil && prefix.Contains(e.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatedNames returns the names of the sender that its address resolves
+// back to, as used by the ptr mechanism and the %{p} macro (RFC 7208
+// section 5.5).
+func (e *evaluator) validatedNames(ctx context.Context, term string, path []string) ([]string, *Evaluation) {
+	arpa, err := dns.ReverseAddr(e.ip.String())
+	if err != nil {
+		return nil, nil
+	}
+	r, evaluation := e.lookup(ctx, arpa, dns.TypePTR, term, path)
+	if evaluation != nil {
+		return nil, evaluation
+	}
+	var names []string
+	for _, ans := range r.Answer {
+		ptr, ok := ans.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		if len(names) == maxMXNames {
+			break
+		}
+		name := strings.ToLower(strings.TrimSuffix(ptr.Ptr, "."))
+		addrs, evaluation := e.lookupAddrs(ctx, name, term, path)
+		if evaluation != nil {
+			if evaluation.Result == ResultTempError {
+				continue
+			}
+			return nil, evaluation
+		}
+		for _, addr := range addrs {
+			if addr == e.ip {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// expandDomain expands the macros of the domain-spec spec of a record
+// published on domain, shortened to 253 characters by dropping labels from
+// the left (RFC 7208 section 7.3).
+func (e *evaluator) expandDomain(spec *spf.MacroString, domain string) string {
+	expanded := strings.ToLower(strings.TrimSuffix(spec.Expand(func(letter byte) string {
+		return e.macroValue(letter, domain)
+	}), "."))
+	for len(expanded) > 253 {
+		_, rest, ok := strings.Cut(expanded, ".")
+		if !ok {
+			break
+		}
+		expanded = rest
+	}
+	return expanded
+}
+
+// macroValue returns the value of a macro letter in a record published on
+// domain (RFC 7208 section 7.2).
+func (e *evaluator) macroValue(letter byte, domain string) string {
+	local, senderDomain, _ := strings.Cut(e.sender.MailFrom, "@")
+	switch letter {
+	case 's':
+		return e.sender.MailFrom
+	case 'l':
+		return local
+	case 'o':
+		return senderDomain
+	case 'd':
+		return domain
+	case 'i':
+		if e.ip.Is4() {
+			return e.ip.String()
+		}
+		var nibbles []string
+		for _, b := range e.ip.As16() {
+			nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+		}
+		return strings.Join(nibbles, ".")
+	case 'p':
+		// The validated name costs lookups of its own and RFC 7208
+		// discourages it, so like many receivers it is left unknown
+		return "unknown"
+	case 'v':
+		if e.ip.Is4() {
+			return "in-addr"
+		}
+		return "ip6"
+	case 'h':
+		return e.sender.Helo
+	case 'c':
+		return e.ip.String()
+	case 'r':
+		return "unknown"
+	case 't':
+		return "0"
+	}
+	return ""
+}
+
+// qualifierResult returns the result a mechanism with qualifier q
+// evaluates to when it matches.
+func qualifierResult(q spf.Qualifier) CheckResult {
+	switch q {
+	case spf.Fail:
+		return ResultFail
+	case spf.SoftFail:
+		return ResultSoftFail
+	case spf.Neutral:
+		return ResultNeutral
+	}
+	return ResultPass
+}
+
+// parseNetwork parses the address of an ip4 or ip6 mechanism with its
+// optional prefix length.
+func parseNetwork(network string) (netip.Prefix, error) {
+	if strings.Contains(network, "/") {
+		return netip.ParsePrefix(network)
+	}
+	addr, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,180 @@
+package spfflatten
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testZone holds the records served to the tests by newTestServer.
+const testZone = `
+inc-pass.test.       TXT "v=spf1 ip4:192.0.2.0/24 -all"
+inc-fail.test.       TXT "v=spf1 -all"
+inc-neutral.test.    TXT "v=spf1 ?all"
+inc-noall.test.      TXT "v=spf1 ip4:198.51.100.1"
+inc-perm.test.       TXT "v=spf1 foo -all"
+redir-target.test.   TXT "v=spf1 ip4:203.0.113.0/24 ~all"
+redir-chain.test.    TXT "v=spf1 redirect=redir-target.test"
+redir-empty.test.    TXT "not spf"
+redir-loop.test.     TXT "v=spf1 redirect=redir-loop.test"
+host.test.           A   192.0.2.10
+`
+
+// newTestServer starts a DNS server answering the queries for the records
+// of zone, with NXDOMAIN for the other names, and returns its address.
+func newTestServer(t *testing.T, zone string) string {
+	t.Helper()
+	records := make(map[string][]dns.RR)
+	for _, line := range strings.Split(zone, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		rrs, ok := records[strings.ToLower(q.Name)]
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestCheckRecordQualifiers(t *testing.T) {
+	f := New(Options{Resolvers: []string{newTestServer(t, testZone)}})
+	tests := []struct {
+		record string
+		ip     string
+		want   CheckResult
+		// mechanism is the term that determined the result.
+		mechanism string
+	}{
+		{"v=spf1 ip4:192.0.2.1 -all", "192.0.2.1", ResultPass, "ip4:192.0.2.1"},
+		{"v=spf1 +ip4:192.0.2.1 -all", "192.0.2.1", ResultPass, "+ip4:192.0.2.1"},
+		{"v=spf1 -ip4:192.0.2.1 +all", "192.0.2.1", ResultFail, "-ip4:192.0.2.1"},
+		{"v=spf1 ~ip4:192.0.2.0/24 +all", "192.0.2.1", ResultSoftFail, "~ip4:192.0.2.0/24"},
+		{"v=spf1 ?ip6:2001:db8::/32 -all", "2001:db8::1", ResultNeutral, "?ip6:2001:db8::/32"},
+		{"v=spf1 ip4:192.0.2.1 -all", "198.51.100.1", ResultFail, "-all"},
+		{"v=spf1 ip4:192.0.2.1 ~all", "198.51.100.1", ResultSoftFail, "~all"},
+		{"v=spf1 ip4:192.0.2.1 ?all", "198.51.100.1", ResultNeutral, "?all"},
+		{"v=spf1 ip4:192.0.2.1", "198.51.100.1", ResultNeutral, ""},
+		{"v=spf1 a:host.test -all", "192.0.2.10", ResultPass, "a:host.test"},
+		{"v=spf1 -a:host.test/24 +all", "192.0.2.99", ResultFail, "-a:host.test/24"},
+		// An include matches when the included record passes, and then
+		// takes the qualifier of the include mechanism.
+		{"v=spf1 include:inc-pass.test -all", "192.0.2.1", ResultPass, "ip4:192.0.2.0/24"},
+		{"v=spf1 ~include:inc-pass.test -all", "192.0.2.1", ResultSoftFail, "ip4:192.0.2.0/24"},
+		{"v=spf1 -include:inc-pass.test +all", "192.0.2.1", ResultFail, "ip4:192.0.2.0/24"},
+		// Other results of the included record do not match.
+		{"v=spf1 include:inc-pass.test -all", "198.51.100.1", ResultFail, "-all"},
+		{"v=spf1 include:inc-fail.test ?all", "192.0.2.1", ResultNeutral, "?all"},
+		{"v=spf1 include:inc-neutral.test -all", "192.0.2.1", ResultFail, "-all"},
+		{"v=spf1 include:inc-noall.test -all", "192.0.2.1", ResultFail, "-all"},
+		{"v=spf1 include:inc-noall.test -all", "198.51.100.1", ResultPass, "ip4:198.51.100.1"},
+		// Errors of the included record are the result.
+		{"v=spf1 include:inc-perm.test +all", "192.0.2.1", ResultPermError, ""},
+		{"v=spf1 include:missing.test +all", "192.0.2.1", ResultPermError, ""},
+		{"v=spf1 foo -all", "192.0.2.1", ResultPermError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record+" "+tt.ip, func(t *testing.T) {
+			got := f.CheckRecord(context.Background(), tt.record, "example.test", Sender{IP: netip.MustParseAddr(tt.ip), Helo: "mail.example.test"})
+			if got.Result != tt.want || got.Mechanism != tt.mechanism {
+				t.Errorf("CheckRecord() = %s at %q (%v), want %s at %q", got.Result, got.Mechanism, got.Err, tt.want, tt.mechanism)
+			}
+		})
+	}
+}
+
+func TestCheckRecordRedirect(t *testing.T) {
+	f := New(Options{Resolvers: []string{newTestServer(t, testZone)}})
+	tests := []struct {
+		record string
+		ip     string
+		want   CheckResult
+		path   string
+		err    error
+	}{
+		{"v=spf1 redirect=redir-target.test", "203.0.113.5", ResultPass, "example.test -> redir-target.test", nil},
+		{"v=spf1 redirect=redir-target.test", "192.0.2.1", ResultSoftFail, "example.test -> redir-target.test", nil},
+		{"v=spf1 redirect=redir-chain.test", "203.0.113.5", ResultPass, "example.test -> redir-chain.test -> redir-target.test", nil},
+		// Mechanisms are evaluated before the redirect wherever it is.
+		{"v=spf1 redirect=redir-target.test ip4:192.0.2.1", "192.0.2.1", ResultPass, "example.test", nil},
+		// redirect= is ignored when the record has an all mechanism.
+		{"v=spf1 ?all redirect=redir-target.test", "203.0.113.5", ResultNeutral, "example.test", nil},
+		// A redirect to a domain without an SPF record is a permerror.
+		{"v=spf1 redirect=missing.test", "192.0.2.1", ResultPermError, "example.test -> missing.test", ErrNoSPFRecord},
+		{"v=spf1 redirect=redir-empty.test", "192.0.2.1", ResultPermError, "example.test -> redir-empty.test", ErrNoSPFRecord},
+		// Redirect loops end at the lookup limit.
+		{"v=spf1 redirect=redir-loop.test", "192.0.2.1", ResultPermError, "", ErrLookupLimitExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record+" "+tt.ip, func(t *testing.T) {
+			got := f.CheckRecord(context.Background(), tt.record, "example.test", Sender{IP: netip.MustParseAddr(tt.ip), Helo: "mail.example.test"})
+			if got.Result != tt.want {
+				t.Errorf("CheckRecord() = %s (%v), want %s", got.Result, got.Err, tt.want)
+			}
+			if path := strings.Join(got.Path, " -> "); tt.path != "" && path != tt.path {
+				t.Errorf("path = %s, want %s", path, tt.path)
+			}
+			if !errors.Is(got.Err, tt.err) {
+				t.Errorf("error = %v, want %v", got.Err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckRecordVoidLookups(t *testing.T) {
+	f := New(Options{Resolvers: []string{newTestServer(t, testZone)}})
+	tests := []struct {
+		record string
+		want   CheckResult
+		// void is whether the result comes from exceeding the void lookup
+		// limit.
+		void bool
+	}{
+		{"v=spf1 exists:nx1.test exists:nx2.test -all", ResultFail, false},
+		{"v=spf1 exists:nx1.test exists:nx2.test exists:nx3.test -all", ResultPermError, true},
+		{"v=spf1 a:nx1.test exists:nx2.test include:nx3.test -all", ResultPermError, true},
+		{"v=spf1 exists:nx1.test exists:nx2.test redirect=nx3.test", ResultPermError, true},
+		{"v=spf1 exists:nx1.test include:nx2.test -all", ResultPermError, false},
+		{"v=spf1 exists:host.test exists:nx1.test ?all", ResultPass, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			got := f.CheckRecord(context.Background(), tt.record, "example.test", Sender{IP: netip.MustParseAddr("198.51.100.1"), Helo: "mail.example.test"})
+			if got.Result != tt.want {
+				t.Errorf("CheckRecord() = %s (%v), want %s", got.Result, got.Err, tt.want)
+			}
+			if void := got.Err != nil && strings.Contains(got.Err.Error(), "void lookup"); void != tt.void {
+				t.Errorf("error = %v, void lookup limit = %v, want %v", got.Err, void, tt.void)
+			}
+		})
+	}
+}
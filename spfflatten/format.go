@@ -0,0 +1,101 @@
+package spfflatten
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Formatter writes a flattened result in an output format.
+type Formatter interface {
+	Format(w io.Writer, result *Result, opts FormatOptions) error
+}
+
+// FormatterFunc adapts a function to a Formatter.
+type FormatterFunc func(w io.Writer, result *Result, opts FormatOptions) error
+
+// Format calls fn.
+func (fn FormatterFunc) Format(w io.Writer, result *Result, opts FormatOptions) error {
+	return fn(w, result, opts)
+}
+
+// FormatOptions controls which parts of a flattened result are written and
+// how. Formats use the options that apply to them and ignore the others.
+type FormatOptions struct {
+	// Output is the output mode of the text format: list, record or split.
+	Output        string
+	Tags          bool
+	KeepModifiers bool
+	// Annotate appends a comment with the origin of each entry to the lines
+	// of the list output and of line-based formats supporting comments.
+	Annotate bool
+	// All overrides the all mechanism of the result when not empty.
+	All string
+	// Domain is the name the root record is published on.
+	Domain string
+	// SplitTemplate names the included records of the split output mode, %d being
+	// replaced by the record number starting at 1. Names are relative to Domain.
+	SplitTemplate string
+	// SplitSize is the maximum length of each record of the split output mode in bytes.
+	SplitSize int
+	// TTL is the time to live of published records.
+	TTL               int
+	TerraformProvider string
+	// Zone is the zone containing Domain, which defaults to Domain itself.
+	Zone string
+	// LookupPublished returns the SPF records currently published on a name,
+	// so that formats updating DNS can replace them.
+	LookupPublished func(name string) ([][]string, error)
+	// SetName is the name of the table or list, or the base name of the
+	// firewall sets, suffixed with _v4 and _v6 for each address family
+	// where they are kept apart.
+	SetName string
+	// NftTable is the family and name of the nftables table holding the sets.
+	NftTable string
+	// NginxDenyAll ends the nginx directives with deny all.
+	NginxDenyAll bool
+	// PostfixAction is the result of each network in the Postfix table.
+	PostfixAction string
+	// LookupBudget is the number of DNS lookups the root record of -output
+	// split may require before warning.
+	LookupBudget int
+}
+
+// formatters holds the registered output formats by name, along with their
+// names in registration order.
+var formatters struct {
+	mu     sync.RWMutex
+	byName map[string]Formatter
+	names  []string
+}
+
+// RegisterFormat makes formatter available under name, such as for the
+// -format flag of the command line tool when called from the init function
+// of a package it imports. It panics when name is already registered.
+func RegisterFormat(name string, formatter Formatter) {
+	formatters.mu.Lock()
+	defer formatters.mu.Unlock()
+	if _, ok := formatters.byName[name]; ok {
+		panic(fmt.Sprintf("spfflatten: format %q registered twice", name))
+	}
+	if formatters.byName == nil {
+		formatters.byName = make(map[string]Formatter)
+	}
+	formatters.byName[name] = formatter
+	formatters.names = append(formatters.names, name)
+}
+
+// LookupFormat returns the formatter registered under name.
+func LookupFormat(name string) (Formatter, bool) {
+	formatters.mu.RLock()
+	defer formatters.mu.RUnlock()
+	formatter, ok := formatters.byName[name]
+	return formatter, ok
+}
+
+// Formats returns the names of the registered formats in registration order.
+func Formats() []string {
+	formatters.mu.RLock()
+	defer formatters.mu.RUnlock()
+	return append([]string(nil), formatters.names...)
+}
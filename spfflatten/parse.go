@@ -0,0 +1,160 @@
+package spfflatten
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+)
+
+// HostMechanism is the target of an a or mx mechanism with its optional
+// dual-cidr-length.
+// An empty Domain refers to the domain the record was published on.
+type HostMechanism struct {
+	Domain string
+	CIDR4  string
+	CIDR6  string
+}
+
+// parseSPFRecord parses txt into the mechanisms the flattener resolves.
+// Mechanisms with a qualifier other than pass are only validated, as they
+// do not authorize any senders.
+func parseSPFRecord(txt string) (*SPFRecord, error) {
+	parsed, err := spf.Parse(txt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPF record: %s", txt)
+	}
+
+	record := &SPFRecord{
+		IP4:      []string{},
+		IP6:      []string{},
+		Includes: []string{},
+		A:        []HostMechanism{},
+		MX:       []HostMechanism{},
+		PTR:      []string{},
+		Exists:   []string{},
+	}
+	record.Invalid = parsed.Errors
+
+	for _, term := range parsed.Terms {
+		switch t := term.(type) {
+		case *spf.Modifier:
+			if t.Name == "redirect" {
+				record.Redirect = t.Value.Raw
+				record.Lookups++
+			} else {
+				record.Modifiers = append(record.Modifiers, t.Name+"="+t.Value.Raw)
+			}
+		case *spf.Mechanism:
+			domain := ""
+			if t.Domain != nil {
+				domain = t.Domain.Raw
+			}
+			if t.Name == "all" {
+				record.All = string(t.Qualifier) + t.Name
+				continue
+			}
+			if t.Result() != spf.Pass {
+				ignored := ignoredTerm{before: termCounts{
+					ip4: len(record.IP4), ip6: len(record.IP6), includes: len(record.Includes),
+					a: len(record.A), mx: len(record.MX), ptr: len(record.PTR),
+				}}
+				if t.Name == "ip4" || t.Name == "ip6" {
+					ignored.network = t.Network
+				}
+				record.Ignored = append(record.Ignored, t.Raw)
+				record.ignored = append(record.ignored, ignored)
+			} else {
+				switch t.Name {
+				case "ip4":
+					record.IP4 = append(record.IP4, t.Network)
+				case "ip6":
+					record.IP6 = append(record.IP6, t.Network)
+				case "include":
+					record.Includes = append(record.Includes, domain)
+				case "a":
+					record.A = append(record.A, HostMechanism{Domain: domain, CIDR4: t.CIDR4, CIDR6: t.CIDR6})
+				case "mx":
+					record.MX = append(record.MX, HostMechanism{Domain: domain, CIDR4: t.CIDR4, CIDR6: t.CIDR6})
+				case "ptr":
+					record.PTR = append(record.PTR, domain)
+				case "exists":
+					record.Exists = append(record.Exists, domain)
+				}
+			}
+			switch t.Name {
+			case "include", "a", "mx", "ptr", "exists":
+				record.Lookups++
+			}
+		}
+	}
+
+	return record, nil
+}
+
+// termCounts counts the mechanisms of each kind authorizing senders that
+// precede a term of a record.
+type termCounts struct {
+	ip4, ip6, includes, a, mx, ptr int
+}
+
+// ignoredTerm is a mechanism of SPFRecord.Ignored, which receivers evaluate
+// before the mechanisms authorizing senders that follow it.
+type ignoredTerm struct {
+	// network is the network of an ip4 or ip6 mechanism, empty for the
+	// other mechanisms.
+	network string
+	before  termCounts
+}
+
+// term formats h back into a mechanism with the given name.
+func (h HostMechanism) term(name string) string {
+	term := name
+	if h.Domain != "" {
+		term += ":" + h.Domain
+	}
+	if h.CIDR4 != "" {
+		term += "/" + h.CIDR4
+	}
+	if h.CIDR6 != "" {
+		term += "//" + h.CIDR6
+	}
+	return term
+}
+
+// deduplicateEntries removes the entries whose IP already appeared, keeping
+// the provenance of the first occurrence.
+func deduplicateEntries(entries []Entry) []Entry {
+	seen := make(map[string]bool)
+	var result []Entry
+
+	for _, entry := range entries {
+		if !seen[entry.IP] {
+			seen[entry.IP] = true
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func deduplicateIPs(ips []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+
+	for _, ip := range ips {
+		if !seen[ip] {
+			seen[ip] = true
+			result = append(result, ip)
+		}
+	}
+
+	return result
+}
+
+// IsIPv4 reports whether the address or network ip, such as the IP of an
+// Entry, is IPv4.
+func IsIPv4(ip string) bool {
+	return net.ParseIP(strings.Split(ip, "/")[0]).To4() != nil
+}
@@ -0,0 +1,83 @@
+package spfflatten
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc opens a connection to address, such as through a proxy.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// NewProxyDialer returns a DialFunc connecting through the SOCKS5 or HTTP
+// CONNECT proxy at proxyURL, which is reached with forward.
+func NewProxyDialer(proxyURL *url.URL, forward *net.Dialer) (DialFunc, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext, nil
+		}
+		return func(_ context.Context, network, address string) (net.Conn, error) {
+			return d.Dial(network, address)
+		}, nil
+	case "http":
+		return func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dialConnect(ctx, forward, proxyURL, address)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, must be socks5 or http", proxyURL.Scheme)
+}
+
+// dialConnect opens a tunnel to address through an HTTP proxy with the
+// CONNECT method.
+func dialConnect(ctx context.Context, forward *net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyAddress, address, resp.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package spfflatten
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// systemResolvers returns the nameservers of /etc/resolv.conf in order.
+func systemResolvers() []string {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	resolvers := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		resolvers[i] = net.JoinHostPort(server, config.Port)
+	}
+	return resolvers
+}
@@ -0,0 +1,43 @@
+package spfflatten
+
+import (
+	"net"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// systemResolvers returns the DNS servers of the network adapters that are
+// up, in the order Windows lists them.
+func systemResolvers() []string {
+	size := uint32(15000)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_SKIP_ANYCAST|windows.GAA_FLAG_SKIP_MULTICAST, 0, (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW {
+			return nil
+		}
+	}
+
+	var resolvers []string
+	for adapter := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0])); adapter != nil; adapter = adapter.Next {
+		if adapter.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		for server := adapter.FirstDnsServerAddress; server != nil; server = server.Next {
+			ip := server.Address.IP()
+			// Windows lists the deprecated site-local fec0:0:0:ffff::1-3
+			// on adapters without IPv6 DNS servers.
+			if ip == nil || strings.HasPrefix(ip.String(), "fec0:0:0:ffff::") {
+				continue
+			}
+			resolvers = append(resolvers, net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+	return resolvers
+}
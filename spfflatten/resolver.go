@@ -0,0 +1,354 @@
+package spfflatten
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exchange sends m to resolver and returns the response, giving up after
+// w.Timeout or when ctx is done. Queries are throttled by w.limiter.
+// resolver is either a host:port of a plain DNS server, a tcp:// host:port
+// of one only queried over TCP, a tls:// host:port of a DNS-over-TLS
+// server, or the https:// URL of a DNS-over-HTTPS endpoint.
+func (w *walker) exchange(ctx context.Context, m *dns.Msg, resolver string) (*dns.Msg, error) {
+	if w.limiter != nil {
+		if err := w.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	if strings.HasPrefix(resolver, "https://") {
+		return exchangeHTTPS(ctx, w.HTTPClient, m, resolver)
+	}
+	network, address := "udp", resolver
+	if a, ok := strings.CutPrefix(resolver, "tcp://"); ok {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "53")
+		}
+		network, address = "tcp", a
+	}
+	if a, ok := strings.CutPrefix(resolver, "tls://"); ok {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "853")
+		}
+		network, address = "tcp-tls", a
+	}
+	if network == "udp" {
+		// Proxies do not carry UDP, so plain DNS goes over TCP through them.
+		if w.Dial != nil {
+			return w.exchangeStream(ctx, "tcp", m, address)
+		}
+		r, _, err := w.client(network).ExchangeContext(ctx, m, address)
+		if err != nil || !r.Truncated {
+			return r, err
+		}
+		// The answer did not fit in a UDP response even with EDNS, so
+		// retry over TCP rather than use the partial answer.
+		network = "tcp"
+	}
+	return w.exchangeStream(ctx, network, m, address)
+}
+
+// client returns the DNS client of network: udp, tcp or tcp-tls.
+func (w *walker) client(network string) *dns.Client {
+	return w.clients[network]
+}
+
+// newClient returns a DNS client for network, which is safe for concurrent
+// use.
+func (w *walker) newClient(network string) *dns.Client {
+	c := &dns.Client{Net: network, TLSConfig: w.TLSConfig, Timeout: w.Timeout}
+	if w.SourceIP != nil {
+		var local net.Addr = &net.TCPAddr{IP: w.SourceIP}
+		if network == "udp" {
+			local = &net.UDPAddr{IP: w.SourceIP}
+		}
+		c.Dialer = &net.Dialer{Timeout: w.Timeout, LocalAddr: local}
+	}
+	return c
+}
+
+// exchangeStream sends m to address over a tcp or tcp-tls connection,
+// reusing an idle connection from w.pool when there is one and returning the
+// connection to it afterwards.
+func (w *walker) exchangeStream(ctx context.Context, network string, m *dns.Msg, address string) (*dns.Msg, error) {
+	c := w.client(network)
+	key := network + " " + address
+	if co := w.pool.get(key); co != nil {
+		r, _, err := c.ExchangeWithConnContext(ctx, m, co)
+		if err == nil {
+			w.pool.put(key, co)
+			return r, nil
+		}
+		// The resolver may have closed the idle connection, so retry on a
+		// new one.
+		co.Close()
+	}
+
+	co, err := w.dialStream(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := c.ExchangeWithConnContext(ctx, m, co)
+	if err != nil {
+		co.Close()
+		return nil, err
+	}
+	w.pool.put(key, co)
+	return r, nil
+}
+
+// dialStream opens a tcp or tcp-tls connection to address, through w.Dial
+// when it is set.
+func (w *walker) dialStream(ctx context.Context, network, address string) (*dns.Conn, error) {
+	if w.Dial == nil {
+		return w.client(network).DialContext(ctx, address)
+	}
+	conn, err := w.Dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp-tls" {
+		config := &tls.Config{}
+		if w.TLSConfig != nil {
+			config = w.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		conn = tls.Client(conn, config)
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// queryBatch sends the queries for name of each of qtypes concurrently, as
+// a batch, and returns their answers in the same order. It fails with the
+// error of the first query that failed.
+func (w *walker) queryBatch(ctx context.Context, name string, qtypes ...uint16) ([]*dns.Msg, error) {
+	answers := make([]*dns.Msg, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answers[i], errs[i] = w.queryDNS(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+// hostAddresses is the outcome of looking up the addresses of a name.
+type hostAddresses struct {
+	ips []string
+	ttl uint32
+	err error
+}
+
+// lookupEach runs lookups concurrently, as a batch of lookups that do not
+// depend on each other, and returns their outcomes in the same order. Nil
+// lookups are skipped.
+func lookupEach(lookups []func() ([]string, uint32, error)) []hostAddresses {
+	hosts := make([]hostAddresses, len(lookups))
+	var wg sync.WaitGroup
+	for i, lookup := range lookups {
+		if lookup == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hosts[i].ips, hosts[i].ttl, hosts[i].err = lookup()
+		}()
+	}
+	wg.Wait()
+	return hosts
+}
+
+// connPool keeps the TCP and DNS-over-TLS connections to resolvers open
+// between queries, as RFC 7766 allows, so that flattening a deep tree does
+// not pay for a handshake per query. A nil pool keeps no connections. It is
+// safe for concurrent use.
+type connPool struct {
+	mu   sync.Mutex
+	idle map[string][]*dns.Conn
+}
+
+// get removes an idle connection for key from the pool, or returns nil.
+func (p *connPool) get(key string) *dns.Conn {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	co := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	return co
+}
+
+// put adds co to the idle connections for key, closing it when the pool is
+// nil.
+func (p *connPool) put(key string, co *dns.Conn) {
+	if p == nil {
+		co.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*dns.Conn)
+	}
+	p.idle[key] = append(p.idle[key], co)
+}
+
+// closeIdle closes all idle connections.
+func (p *connPool) closeIdle() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.idle {
+		for _, co := range conns {
+			co.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// NewTLSConfig returns the TLS configuration of DNS-over-TLS connections.
+// serverName overrides the name the certificate is verified against, which
+// defaults to the host of the resolver. When spki is set, the server is
+// instead authenticated by the public key of its certificate, whose base64
+// SHA-256 digest of the SubjectPublicKeyInfo must be spki, as with the pin
+// sets of RFC 7858. Only the leaf certificate is checked, as the handshake
+// only proves that the server holds its key, while the other certificates
+// of the chain are public and could be sent by anyone.
+func NewTLSConfig(serverName, spki string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if spki == "" {
+		return config, nil
+	}
+	pin, err := base64.StdEncoding.DecodeString(spki)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SPKI pin %q: must be a base64 SHA-256 digest", spki)
+	}
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the resolver sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if !bytes.Equal(digest[:], pin) {
+			return errors.New("the certificate of the resolver does not match the SPKI pin")
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// exchangeHTTPS sends m to a DNS-over-HTTPS endpoint in the RFC 8484 wire
+// format using client, or http.DefaultClient when it is nil.
+func exchangeHTTPS(ctx context.Context, client *http.Client, m *dns.Msg, url string) (*dns.Msg, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// RFC 8484 recommends an ID of 0 so that responses can be cached.
+	query := m.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", url, err)
+	}
+	r.Id = m.Id
+	return r, nil
+}
+
+// rateLimiter spaces out events so that no more than a given number happen
+// per second. It is safe for concurrent use.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next event is allowed or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
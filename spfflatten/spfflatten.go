@@ -0,0 +1,1578 @@
+// Package spfflatten resolves the SPF records of domains into the addresses
+// they authorize, so that they can be published as a flattened record that
+// needs no DNS lookups of its own.
+package spfflatten
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/perryh/dns-spf-flatten/spf"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// idnaProfile converts internationalized domain names to A-labels for DNS
+// queries. Strict domain name rules are disabled, as SPF records commonly
+// live on names with underscores such as _spf.example.com.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+type SPFRecord struct {
+	IP4      []string
+	IP6      []string
+	Includes []string
+	A        []HostMechanism
+	MX       []HostMechanism
+	PTR      []string
+	Exists   []string
+	Redirect string
+	All      string
+	// Modifiers holds every modifier other than redirect=, such as exp=.
+	Modifiers []string
+	// Invalid holds the terms that failed validation and were dropped, with
+	// the position and reason of each violation.
+	Invalid []*spf.SyntaxError
+	// Ignored holds the mechanisms with a fail, softfail or neutral qualifier,
+	// which do not authorize any senders.
+	Ignored []string
+	// ignored tells which mechanisms of the record each of Ignored precedes.
+	ignored []ignoredTerm
+	// TTL is the time to live of the TXT record the record was read from.
+	TTL uint32
+	// Lookups is the number of terms causing DNS lookups during evaluation:
+	// include, a, mx, ptr and exists mechanisms and the redirect modifier.
+	Lookups int
+}
+
+// SkippedTerm is a term of a source record that is not represented in the
+// flattened result.
+type SkippedTerm struct {
+	Domain string `json:"domain"`
+	Term   string `json:"term"`
+	Reason string `json:"reason"`
+}
+
+// Entry is a flattened address or network along with where it came from.
+type Entry struct {
+	IP string `json:"ip"`
+	// Qualifier is the result the entry matches with. It is always + (pass),
+	// as mechanisms with other qualifiers do not authorize senders and are
+	// left out.
+	Qualifier string `json:"qualifier"`
+	// Mechanism is the type of mechanism that authorized IP: ip4, ip6, a, mx or ptr.
+	Mechanism string `json:"mechanism"`
+	// Source is the domain whose record contained the mechanism. It is empty
+	// for addresses given on the command line.
+	Source string `json:"source,omitempty"`
+	// Path is the chain of include and redirect domains from the top-level
+	// include domain down to Source.
+	Path []string `json:"path,omitempty"`
+	// TTL is the lowest time to live of the DNS records the entry was built from.
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// Prefix returns the network of the entry, an address being a prefix of its
+// full length. It is the zero Prefix when IP is invalid.
+func (e Entry) Prefix() netip.Prefix {
+	if strings.Contains(e.IP, "/") {
+		prefix, _ := netip.ParsePrefix(e.IP)
+		return prefix
+	}
+	addr, _ := netip.ParseAddr(e.IP)
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// Result is the outcome of flattening a set of SPF sources.
+type Result struct {
+	Entries []Entry
+	// Terms holds the mechanisms carried over verbatim, such as exists: and
+	// macro-dependent mechanisms.
+	Terms []string
+	// Lookups is the number of DNS lookups the generated record requires.
+	Lookups int
+	// All is the terminating all mechanism of the top-level include records.
+	All string
+	// Skipped lists the terms that were left out, so that an incomplete
+	// result can be reported.
+	Skipped []SkippedTerm
+	// Modifiers are the modifiers of the top-level include records, which
+	// can be carried over into the generated record.
+	Modifiers []string
+	// Warnings holds the problems found while flattening.
+	Warnings []string
+	// Queries is the number of DNS queries performed.
+	Queries int
+	// Tree holds the top-level include domains with the domains they
+	// include or redirect to below them.
+	Tree []*Node
+}
+
+// Node is a domain in the tree of SPF records traversed while flattening.
+type Node struct {
+	Domain string `json:"domain"`
+	// Via is how the parent record referenced the domain: include or
+	// redirect. It is empty for top-level include domains.
+	Via string `json:"via,omitempty"`
+	// Lookups is the number of DNS lookups the record of the domain itself
+	// consumes when evaluated, not counting the records below it.
+	Lookups int `json:"lookups"`
+	// VoidLookups is the number of a, mx and exists mechanisms of the record
+	// of the domain that resolved to no address, either because the name
+	// does not exist or because it has no records of the queried type (RFC
+	// 7208 section 4.6.4). The targets of exists mechanisms are only looked
+	// up to be counted when they do not depend on macros. Includes and
+	// redirects to domains that do not exist are void lookups too, but fail
+	// flattening with ErrNoSPFRecord.
+	VoidLookups int `json:"void_lookups,omitempty"`
+	// All is the all mechanism of the record of the domain as published,
+	// such as -all, which is empty when it has none.
+	All string `json:"all,omitempty"`
+	// PTR holds the ptr mechanisms of the record of the domain, such as ptr
+	// or ptr:example.com, which RFC 7208 section 5.5 says not to use.
+	PTR []string `json:"ptr,omitempty"`
+	// IP4 and IP6 are the number of entries the record of the domain
+	// contributes itself.
+	IP4 int `json:"ip4"`
+	IP6 int `json:"ip6"`
+	// Repeated is set when the domain was already visited elsewhere in the
+	// tree, in which case it has no children.
+	Repeated bool    `json:"repeated,omitempty"`
+	Children []*Node `json:"children,omitempty"`
+	parent   *Node
+}
+
+// Parent returns the node whose record referenced n, which is nil for a
+// top-level include domain.
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// path returns the domains from the top-level include domain down to n.
+func (n *Node) path() []string {
+	var path []string
+	for ; n != nil; n = n.parent {
+		path = append([]string{n.Domain}, path...)
+	}
+	return path
+}
+
+// IPs returns the addresses and networks of the entries.
+func (r *Result) IPs() []string {
+	ips := make([]string, len(r.Entries))
+	for i, entry := range r.Entries {
+		ips[i] = entry.IP
+	}
+	return ips
+}
+
+// Handling of ptr mechanisms, which cannot be expressed as addresses exactly.
+const (
+	PtrModeWarn    = "warn"
+	PtrModeFail    = "fail"
+	PtrModeResolve = "resolve"
+)
+
+// MaxLookups is the DNS lookup limit for SPF evaluation (RFC 7208 section 4.6.4).
+const MaxLookups = 10
+
+// MaxVoidLookups is the number of lookups returning no answer or NXDOMAIN
+// beyond which receivers should evaluate a record to a permanent error (RFC
+// 7208 section 4.6.4).
+const MaxVoidLookups = 2
+
+// DefaultEDNSSize is the UDP payload size advertised with EDNS0 unless
+// Options.EDNSSize is set.
+const DefaultEDNSSize = 4096
+
+// Networks authorized by the include domains with a shorter prefix length
+// are warned about, as they are usually mistakes of the provider and
+// authorize far more senders than it operates.
+const (
+	BroadPrefix4 = 12
+	BroadPrefix6 = 32
+)
+
+// Options configure how a Flattener walks SPF records. The zero value is
+// usable, sending queries to DefaultResolvers. Options added later default
+// to the former behavior when zero.
+type Options struct {
+	// MaxDepth, when positive, is the maximum number of include and
+	// redirect levels below the include domains, beyond which flattening
+	// fails with ErrMaxDepthExceeded.
+	MaxDepth int
+	// LookupBudget is the number of DNS lookups the generated record may
+	// require before a warning is added to the result, MaxLookups when zero.
+	// Lowering it leaves room for the lookups of other mechanisms published
+	// alongside the generated ones.
+	LookupBudget int
+	// MaxPrefix4 and MaxPrefix6, when positive, are the shortest prefix
+	// lengths of the IPv4 and IPv6 networks the include domains may
+	// authorize, broader networks failing flattening. Networks broader than
+	// BroadPrefix4 and BroadPrefix6 are only warned about otherwise.
+	MaxPrefix4 int
+	MaxPrefix6 int
+	// PtrMode is one of PtrModeWarn, PtrModeFail and PtrModeResolve, the
+	// zero value behaving as PtrModeWarn.
+	PtrMode     string
+	KeepExists  bool
+	AllowMacros bool
+	// KeepIncludes are include domains kept as include mechanisms of the
+	// generated record rather than flattened, each costing a DNS lookup,
+	// for providers whose addresses change too often to copy.
+	KeepIncludes []string
+	// Scheduled reports that flattening is repeated regularly, such as by a
+	// cron job, which keeps flattened copies of volatile includes fresh and
+	// silences the warnings about them.
+	Scheduled bool
+	// Strict fails on records that receivers evaluate to a permanent error,
+	// such as invalid terms, multiple SPF records, include loops and a
+	// generated record exceeding LookupBudget, rather than warning.
+	Strict bool
+	// Unicode shows internationalized domain names in their Unicode form in
+	// errors and warnings.
+	Unicode bool
+	// Resolvers are the DNS servers queries are sent to, as host:port for
+	// UDP falling back to TCP, tcp://host[:port] for TCP only,
+	// tls://host[:port] for DNS-over-TLS or https:// URLs. Each is
+	// tried in turn until one answers without SERVFAIL. DefaultResolvers
+	// are used when there are none.
+	Resolvers []string
+	TLSConfig *tls.Config
+	// Retries is the number of times a query that no resolver answered is
+	// retried, waiting Backoff, doubled on each retry, plus up to Jitter.
+	Retries int
+	Backoff time.Duration
+	Jitter  time.Duration
+	// Timeout limits each query to a resolver.
+	Timeout time.Duration
+	// EDNSSize is the UDP payload size advertised with EDNS0,
+	// DefaultEDNSSize when zero.
+	EDNSSize uint16
+	// NoEDNS sends queries without EDNS0, for middleboxes that mishandle
+	// it, relying on TCP for answers larger than 512 bytes. DNSSEC cannot
+	// be used with it.
+	NoEDNS bool
+	// DNSSEC requires every answer to be authenticated by a validating
+	// resolver.
+	DNSSEC bool
+	// QPS, when positive, limits the queries sent to resolvers per second.
+	QPS float64
+	// Concurrency is the number of records fetched in parallel, along with
+	// the addresses of their a and mx mechanisms, ahead of the walk of the
+	// include tree, which is serial so that each domain included more than
+	// once is attributed to its first occurrence in record order. Records
+	// are fetched serially when it is at most one.
+	Concurrency int
+	// Dial and HTTPClient, when set, open the connections to resolvers,
+	// such as through a proxy.
+	Dial       DialFunc
+	HTTPClient *http.Client
+	// SourceIP, when set, is the local address queries are sent from.
+	SourceIP net.IP
+	// Authoritative sends queries to the authoritative nameservers of each
+	// name, found through the resolvers, rather than to the resolvers.
+	Authoritative bool
+	// OnEntry, when set, is called with each entry as soon as it is
+	// resolved, before deduplication. It is never called concurrently.
+	OnEntry func(Entry)
+	// Cache stores the answers to DNS queries, which are answered from it
+	// until they expire. New uses a MemoryCache when it is nil.
+	Cache Cache
+	// OnLookup, when set, is called with each DNS query sent once it is
+	// answered or has failed, for logging, metrics or auditing. Answers
+	// from Cache are not reported. It is never called concurrently.
+	OnLookup func(LookupEvent)
+}
+
+// LookupEvent describes a DNS query performed while flattening.
+type LookupEvent struct {
+	// Name and Type are the question of the query, Name being fully
+	// qualified.
+	Name string
+	Type uint16
+	// Server is the resolver or authoritative nameserver that answered, or
+	// that was queried last when none did.
+	Server string
+	// Duration is the time the query took, including retries.
+	Duration time.Duration
+	// Rcode is the error code of the answer, which is only meaningful when
+	// Err is nil.
+	Rcode int
+	// Err is why the query failed.
+	Err error
+}
+
+// Flattener walks SPF records and collects the addresses they authorize. Its
+// options are not modified by Flatten, so a Flattener may be used for
+// several runs, including concurrent ones.
+type Flattener struct {
+	opts Options
+}
+
+// New returns a Flattener with the given options.
+func New(opts Options) *Flattener {
+	if opts.Cache == nil {
+		opts.Cache = NewMemoryCache()
+	}
+	return &Flattener{opts: opts}
+}
+
+// Options returns the options of f.
+func (f *Flattener) Options() Options {
+	return f.opts
+}
+
+// walker holds the state of a single run of a Flattener.
+type walker struct {
+	Options
+	// resolvers are the Resolvers, or DefaultResolvers when there are none.
+	resolvers []string
+	// limiter, when set, throttles the queries sent to resolvers.
+	limiter *rateLimiter
+	// pool keeps connections to resolvers open between queries.
+	pool *connPool
+	// clients are the DNS clients of each network, shared by all queries.
+	clients map[string]*dns.Client
+	// workers holds a token for each goroutine prefetching records. Records
+	// are not prefetched when it is nil.
+	workers chan struct{}
+	// mu guards the fields below, which are shared by the goroutines
+	// prefetching records and sending queries.
+	mu      sync.Mutex
+	visited map[string]bool
+	// prefetched are the domains whose records were prefetched, and answers
+	// the answers of the queries sent so far when records are prefetched, so
+	// that the walk reuses them.
+	prefetched map[string]bool
+	answers    map[string]*answer
+	// zones and nameservers cache the zone of each name and the addresses
+	// of the authoritative nameservers of each zone.
+	zones       map[string]string
+	nameservers map[string][]string
+	terms       []string
+	// macroTerms are the mechanisms whose targets depend on macros that
+	// were left out without AllowMacros.
+	macroTerms []string
+	skipped    []SkippedTerm
+	warnings   []string
+	queries    int
+	tree       []*Node
+}
+
+// newWalker returns the state for a run of f.
+func newWalker(f *Flattener) *walker {
+	w := &walker{
+		Options:     f.opts,
+		resolvers:   f.opts.Resolvers,
+		pool:        &connPool{},
+		visited:     make(map[string]bool),
+		zones:       make(map[string]string),
+		nameservers: make(map[string][]string),
+	}
+	if len(w.resolvers) == 0 {
+		w.resolvers = DefaultResolvers()
+	}
+	if w.LookupBudget == 0 {
+		w.LookupBudget = MaxLookups
+	}
+	if w.EDNSSize == 0 {
+		w.EDNSSize = DefaultEDNSSize
+	}
+	if w.QPS > 0 {
+		w.limiter = newRateLimiter(w.QPS)
+	}
+	if w.Concurrency > 1 {
+		w.workers = make(chan struct{}, w.Concurrency)
+		w.prefetched = make(map[string]bool)
+		w.answers = make(map[string]*answer)
+	}
+	w.clients = make(map[string]*dns.Client)
+	for _, network := range []string{"udp", "tcp", "tcp-tls"} {
+		w.clients[network] = w.newClient(network)
+	}
+	return w
+}
+
+// Request is what a run of a Flattener flattens.
+type Request struct {
+	// Includes are the domains whose SPF records are flattened.
+	Includes []string
+	// IP4 and IP6 are addresses and networks added to the result as is.
+	IP4 []string
+	IP6 []string
+}
+
+// Flatten flattens the request with the zero Options, which send queries to
+// DefaultResolvers.
+func Flatten(ctx context.Context, req Request) (*Result, error) {
+	return New(Options{}).Flatten(ctx, req)
+}
+
+// Flatten flattens the SPF records of the include domains of req along with
+// its addresses. When ctx is done before all records are resolved, the
+// result of the include domains resolved so far is returned along with the
+// error.
+func (f *Flattener) Flatten(ctx context.Context, req Request) (*Result, error) {
+	return newWalker(f).flatten(ctx, req.IP4, req.IP6, req.Includes)
+}
+
+// LookupPublished returns the character-strings of each SPF record currently
+// published on domain, which is empty when there is none.
+func (f *Flattener) LookupPublished(ctx context.Context, domain string) ([][]string, error) {
+	w := newWalker(f)
+	defer w.pool.closeIdle()
+	return w.lookupPublished(ctx, domain)
+}
+
+// DefaultResolvers returns the nameservers of the system configuration,
+// falling back to a local resolver when there are none.
+func DefaultResolvers() []string {
+	if resolvers := systemResolvers(); len(resolvers) > 0 {
+		return resolvers
+	}
+	return []string{"127.0.0.1:53"}
+}
+
+// DisplayDomain returns domain in the form used in messages, which is its
+// Unicode form when the Unicode option is set.
+func (f *Flattener) DisplayDomain(domain string) string {
+	return displayDomain(domain, f.opts.Unicode)
+}
+
+// displayDomain returns domain in the form used in messages of the run.
+func (w *walker) displayDomain(domain string) string {
+	return displayDomain(domain, w.Unicode)
+}
+
+// displayDomain returns domain, converted to its Unicode form when unicode
+// is set and it is a valid internationalized domain name.
+func displayDomain(domain string, unicode bool) string {
+	if !unicode {
+		return domain
+	}
+	if u, err := idnaProfile.ToUnicode(domain); err == nil {
+		return u
+	}
+	return domain
+}
+
+// flatten flattens the SPF records of the include domains along with the
+// given addresses, see Flattener.Flatten.
+func (w *walker) flatten(ctx context.Context, ip4List, ip6List, includeList []string) (*Result, error) {
+	var entries []Entry
+	var modifiers []string
+	var all string
+
+	for _, ip := range ip4List {
+		entries = append(entries, Entry{IP: ip, Qualifier: "+", Mechanism: "ip4"})
+	}
+	for _, ip := range ip6List {
+		entries = append(entries, Entry{IP: ip, Qualifier: "+", Mechanism: "ip6"})
+	}
+	if w.OnEntry != nil {
+		for _, entry := range entries {
+			w.OnEntry(entry)
+		}
+	}
+
+	defer w.pool.closeIdle()
+
+	if w.workers != nil {
+		prefetchCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer cancel()
+		for _, domain := range includeList {
+			w.prefetch(prefetchCtx, &wg, domain, 0)
+		}
+	}
+
+	for _, domain := range includeList {
+		if w.keepInclude(domain) {
+			continue
+		}
+		domainEntries, spfRecord, err := w.resolveDomain(ctx, domain, "", nil)
+		if err != nil {
+			err = fmt.Errorf("failed to resolve include domain %s: %w", w.displayDomain(domain), err)
+			if ctx.Err() != nil {
+				return w.result(entries, all, modifiers), err
+			}
+			return nil, err
+		}
+		if err := w.checkPrefixes(domainEntries); err != nil {
+			return nil, err
+		}
+		entries = append(entries, domainEntries...)
+		if voids := voidLookups(w.tree[len(w.tree)-1]); voids > MaxVoidLookups {
+			w.warn("%s requires %d void lookups, exceeding the limit of %d, which receivers may evaluate to a permanent error", w.displayDomain(domain), voids, MaxVoidLookups)
+		}
+		if spfRecord != nil && spfRecord.All != "" {
+			if all == "" {
+				all = spfRecord.All
+			} else if spfRecord.All != all {
+				w.warn("%s ends with %s, keeping %s from the first include domain", w.displayDomain(domain), spfRecord.All, all)
+			}
+		}
+		if spfRecord != nil {
+			for _, modifier := range spfRecord.Modifiers {
+				expanded := expandDomainMacros(modifier, strings.ToLower(domain))
+				modifiers = mergeModifiers(modifiers, []string{expanded})
+			}
+		}
+	}
+
+	if len(w.macroTerms) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMacroDependent, strings.Join(w.macroTerms, ", "))
+	}
+	for _, loop := range findLoops(w.tree) {
+		for i, domain := range loop {
+			loop[i] = w.displayDomain(domain)
+		}
+		if w.Strict {
+			return nil, fmt.Errorf("%w: %s", ErrLoopDetected, strings.Join(loop, " -> "))
+		}
+		w.warn("include loop %s, which receivers evaluate to a permanent error", strings.Join(loop, " -> "))
+	}
+
+	result := w.result(entries, all, modifiers)
+	if w.Strict && result.Lookups > w.LookupBudget {
+		return nil, fmt.Errorf("%w: generated record requires %d DNS lookups, exceeding the limit of %d", ErrLookupLimitExceeded, result.Lookups, w.LookupBudget)
+	}
+	return result, nil
+}
+
+// result returns the flattened result of the entries, all mechanism and
+// modifiers collected along with the state of the walk.
+func (w *walker) result(entries []Entry, all string, modifiers []string) *Result {
+	terms := deduplicateIPs(w.terms)
+	if len(terms) > w.LookupBudget {
+		w.warn("generated record requires %d DNS lookups, exceeding the limit of %d", len(terms), w.LookupBudget)
+	}
+
+	return &Result{
+		Entries:   deduplicateEntries(entries),
+		Terms:     terms,
+		Lookups:   len(terms),
+		All:       all,
+		Modifiers: modifiers,
+		Skipped:   w.skipped,
+		Warnings:  w.warnings,
+		Queries:   w.queries,
+		Tree:      w.tree,
+	}
+}
+
+// checkPrefixes fails on the entries broader than MaxPrefix4 and
+// MaxPrefix6, and warns about those broader than BroadPrefix4 and
+// BroadPrefix6.
+func (w *walker) checkPrefixes(entries []Entry) error {
+	for _, entry := range entries {
+		prefix := entry.Prefix()
+		if !prefix.IsValid() {
+			continue
+		}
+		limit, broad := w.MaxPrefix6, BroadPrefix6
+		if prefix.Addr().Is4() {
+			limit, broad = w.MaxPrefix4, BroadPrefix4
+		}
+		switch {
+		case limit > 0 && prefix.Bits() < limit:
+			return fmt.Errorf("%s authorizes %s, which is broader than the maximum prefix length of /%d", w.displayDomain(entry.Source), entry.IP, limit)
+		case prefix.Bits() < broad:
+			w.warn("%s authorizes %s, which is broader than /%d and likely a mistake", w.displayDomain(entry.Source), entry.IP, broad)
+		}
+	}
+	return nil
+}
+
+// voidLookups returns the number of void lookups evaluating the record of
+// node consumes, including the records it includes or redirects to.
+func voidLookups(node *Node) int {
+	voids := node.VoidLookups
+	for _, child := range node.Children {
+		voids += voidLookups(child)
+	}
+	return voids
+}
+
+// findLoops returns the cycles of includes and redirects in the tree, each
+// as the chain of domains from the first one reached back to itself, such
+// as a -> b -> a. Each cycle is returned once, however many branches of the
+// tree lead to it.
+func findLoops(tree []*Node) [][]string {
+	// The tree only holds the records below the first visit of each domain,
+	// so the references are collected into a graph of domains
+	var domains []string
+	references := make(map[string][]string)
+	var collect func(nodes []*Node)
+	collect = func(nodes []*Node) {
+		for _, node := range nodes {
+			if _, ok := references[node.Domain]; !ok {
+				domains = append(domains, node.Domain)
+				references[node.Domain] = nil
+			}
+			for _, child := range node.Children {
+				if !slices.Contains(references[node.Domain], child.Domain) {
+					references[node.Domain] = append(references[node.Domain], child.Domain)
+				}
+			}
+			collect(node.Children)
+		}
+	}
+	collect(tree)
+
+	var loops [][]string
+	seen := make(map[string]bool)
+	done := make(map[string]bool)
+	var path []string
+	var walk func(domain string)
+	walk = func(domain string) {
+		if i := slices.Index(path, domain); i >= 0 {
+			loop := append(slices.Clone(path[i:]), domain)
+			// The same cycle is reached from each of its domains in turn
+			members := path[i:]
+			first := slices.Index(members, slices.Min(members))
+			if key := strings.Join(append(slices.Clone(members[first:]), members[:first]...), " "); !seen[key] {
+				seen[key] = true
+				loops = append(loops, loop)
+			}
+			return
+		}
+		if done[domain] {
+			return
+		}
+		path = append(path, domain)
+		for _, reference := range references[domain] {
+			walk(reference)
+		}
+		path = path[:len(path)-1]
+		done[domain] = true
+	}
+	for _, domain := range domains {
+		walk(domain)
+	}
+	return loops
+}
+
+// mergeModifiers appends the modifiers not yet present in existing. Only the
+// first occurrence of each modifier name is kept, as exp= may appear at most
+// once in a record.
+func mergeModifiers(existing, modifiers []string) []string {
+	for _, modifier := range modifiers {
+		name, _, _ := strings.Cut(modifier, "=")
+		duplicate := false
+		for _, e := range existing {
+			if strings.HasPrefix(e, name+"=") {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			existing = append(existing, modifier)
+		}
+	}
+	return existing
+}
+
+// resolveDomain returns the entries authorized by the SPF record of domain
+// along with the parsed record itself, and adds domain to the include tree
+// below parent, which referenced it through via (include or redirect). The
+// record is nil when domain was already visited.
+func (w *walker) resolveDomain(ctx context.Context, domain, via string, parent *Node) ([]Entry, *SPFRecord, error) {
+	return w.resolveNode(ctx, w.addNode(domain, via, parent))
+}
+
+// addNode adds domain to the include tree below parent, which referenced it
+// through via, or as a top-level include domain when parent is nil. Only the
+// goroutine resolving parent may add nodes below it.
+func (w *walker) addNode(domain, via string, parent *Node) *Node {
+	node := &Node{Domain: domain, Via: via, parent: parent}
+	if parent != nil {
+		parent.Children = append(parent.Children, node)
+	} else {
+		w.tree = append(w.tree, node)
+	}
+	return node
+}
+
+// resolveNode returns the entries authorized by the SPF record of the domain
+// of node along with the parsed record itself, adding the domains it
+// includes or redirects to below node. The record is nil when the domain was
+// already visited.
+func (w *walker) resolveNode(ctx context.Context, node *Node) ([]Entry, *SPFRecord, error) {
+	domain, err := toASCII(node.Domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	node.Domain = domain
+
+	w.mu.Lock()
+	visited := w.visited[domain]
+	w.visited[domain] = true
+	w.mu.Unlock()
+	if visited {
+		// Loops are reported by findLoops once the whole tree is known
+		node.Repeated = true
+		return nil, nil, nil
+	}
+	if provider, ok := VolatileProvider(domain); ok && !w.Scheduled {
+		w.warn("%s (%s) is known to change its addresses frequently, so the flattened record will go stale: keep it with -keep-include %s, or flatten again on a schedule and pass -scheduled", w.displayDomain(domain), provider, w.displayDomain(domain))
+	}
+	path := node.path()
+	if w.MaxDepth > 0 && len(path)-1 > w.MaxDepth {
+		var chain []string
+		for _, d := range path {
+			chain = append(chain, w.displayDomain(d))
+		}
+		return nil, nil, fmt.Errorf("%w: %s is nested %d levels below %s, exceeding the limit of %d: %s", ErrMaxDepthExceeded, w.displayDomain(domain), len(path)-1, w.displayDomain(path[0]), w.MaxDepth, strings.Join(chain, " -> "))
+	}
+
+	spfRecord, err := w.getSPFRecord(ctx, domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	node.Lookups = spfRecord.Lookups
+	node.All = spfRecord.All
+
+	var entries []Entry
+	addEntries := func(ips []string, mechanism string, ttl uint32) {
+		for _, ip := range ips {
+			entry := Entry{IP: ip, Qualifier: "+", Mechanism: mechanism, Source: domain, Path: path, TTL: ttl}
+			entries = append(entries, entry)
+			if w.OnEntry != nil {
+				w.mu.Lock()
+				w.OnEntry(entry)
+				w.mu.Unlock()
+			}
+			if IsIPv4(ip) {
+				node.IP4++
+			} else {
+				node.IP6++
+			}
+		}
+	}
+	// The entries of each kind of mechanism are contiguous, those of each
+	// mechanism starting at its mark, which the mechanisms that do not
+	// authorize senders are checked against.
+	marks := make(map[string][]int)
+	mark := func(kind string) {
+		marks[kind] = append(marks[kind], len(entries))
+	}
+	ends := make(map[string]int)
+	for _, ip := range spfRecord.IP4 {
+		mark("ip4")
+		addEntries([]string{ip}, "ip4", spfRecord.TTL)
+	}
+	ends["ip4"] = len(entries)
+	for _, ip := range spfRecord.IP6 {
+		mark("ip6")
+		addEntries([]string{ip}, "ip6", spfRecord.TTL)
+	}
+	ends["ip6"] = len(entries)
+
+	// Includes are resolved in the order of the record, so that a domain
+	// included more than once is attributed to its first occurrence
+	// whatever the concurrency. Includes that are kept or not expanded have
+	// no entries.
+	for _, includeDomain := range spfRecord.Includes {
+		mark("include")
+		includeDomain, ok := w.expandTarget("include:"+includeDomain, includeDomain, domain)
+		if !ok || w.keepInclude(includeDomain) {
+			continue
+		}
+		includeEntries, _, err := w.resolveDomain(ctx, includeDomain, "include", node)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve include %s: %w", includeDomain, err)
+		}
+		entries = append(entries, includeEntries...)
+	}
+	ends["include"] = len(entries)
+
+	// The a and mx mechanisms do not depend on each other, so their
+	// addresses are looked up in a single batch. Mechanisms whose target
+	// was not expanded have no lookup.
+	var targets []string
+	var lookups []func() ([]string, uint32, error)
+	addLookup := func(h HostMechanism, name string, lookup func(context.Context, string) ([]string, uint32, error)) {
+		target, ok := w.expandTarget(h.term(name), h.Domain, domain)
+		if target == "" {
+			target = domain
+		}
+		targets = append(targets, target)
+		if !ok {
+			lookups = append(lookups, nil)
+			return
+		}
+		lookups = append(lookups, func() ([]string, uint32, error) {
+			return lookup(ctx, target)
+		})
+	}
+	for _, a := range spfRecord.A {
+		addLookup(a, "a", w.lookupHost)
+	}
+	for _, mx := range spfRecord.MX {
+		addLookup(mx, "mx", w.lookupMX)
+	}
+	hosts := lookupEach(lookups)
+	addHosts := func(i int, h HostMechanism, name string) error {
+		mark(name)
+		if lookups[i] == nil {
+			return nil
+		}
+		if hosts[i].err != nil {
+			return fmt.Errorf("failed to resolve %s:%s: %w", name, targets[i], hosts[i].err)
+		}
+		if len(hosts[i].ips) == 0 {
+			node.VoidLookups++
+		}
+		addEntries(applyCIDR(hosts[i].ips, h.CIDR4, h.CIDR6), name, hosts[i].ttl)
+		return nil
+	}
+	for i, a := range spfRecord.A {
+		if err := addHosts(i, a, "a"); err != nil {
+			return nil, nil, err
+		}
+	}
+	ends["a"] = len(entries)
+	for i, mx := range spfRecord.MX {
+		if err := addHosts(len(spfRecord.A)+i, mx, "mx"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ends["mx"] = len(entries)
+	for _, ptr := range spfRecord.PTR {
+		mark("ptr")
+		term := "ptr"
+		if ptr != "" {
+			term += ":" + ptr
+		}
+		node.PTR = append(node.PTR, term)
+		w.warn("%s in %s should not be used (RFC 7208 section 5.5): it is slow, unreliable on DNS errors and places a large burden on the .arpa name servers, so list the addresses of the senders instead", term, w.displayDomain(domain))
+
+		target := ptr
+		if target == "" {
+			target = domain
+		}
+		target, _ = expandMacros(target, domain)
+		switch w.PtrMode {
+		case PtrModeFail:
+			return nil, nil, fmt.Errorf("ptr mechanism for %s cannot be flattened", target)
+		case PtrModeResolve:
+			ptrIPs, ttl, err := w.lookupValidatedPTR(ctx, target)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve ptr:%s: %w", target, err)
+			}
+			addEntries(ptrIPs, "ptr", ttl)
+		default:
+			w.skip(domain, term, "ptr mechanisms are not flattened with -ptr-mode warn")
+		}
+	}
+
+	ends["ptr"] = len(entries)
+
+	for _, exists := range spfRecord.Exists {
+		target, ok := w.expandTarget("exists:"+exists, exists, domain)
+		if !ok {
+			continue
+		}
+		w.countVoidExists(ctx, node, target)
+		if !w.KeepExists {
+			w.skip(domain, "exists:"+exists, "exists mechanisms are only kept with -keep-exists")
+			continue
+		}
+		w.mu.Lock()
+		w.terms = append(w.terms, "exists:"+target)
+		w.mu.Unlock()
+	}
+
+	for _, term := range spfRecord.Ignored {
+		w.skip(domain, term, "mechanisms with a -, ~ or ? qualifier do not authorize senders")
+	}
+	for _, modifier := range spfRecord.Modifiers {
+		if !strings.HasPrefix(modifier, "exp=") {
+			w.skip(domain, modifier, "unknown modifiers are ignored by receivers")
+		}
+	}
+
+	// redirect= only applies when the record has no all mechanism (RFC 7208 section 6.1)
+	if spfRecord.Redirect != "" && spfRecord.All != "" {
+		w.skip(domain, "redirect="+spfRecord.Redirect, "redirect= is ignored in records with an all mechanism")
+	}
+	if spfRecord.Redirect != "" && spfRecord.All == "" {
+		redirect, ok := w.expandTarget("redirect="+spfRecord.Redirect, spfRecord.Redirect, domain)
+		if !ok {
+			return entries, spfRecord, nil
+		}
+		redirectEntries, redirectRecord, err := w.resolveDomain(ctx, redirect, "redirect", node)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve redirect %s: %w", redirect, err)
+		}
+		ends["redirect"] = len(entries)
+		entries = append(entries, redirectEntries...)
+		// The all mechanism of the redirect target becomes the policy of this record
+		if redirectRecord != nil {
+			spfRecord.All = redirectRecord.All
+		}
+	}
+
+	if err := w.checkIgnored(domain, spfRecord, entries, marks, ends); err != nil {
+		return nil, nil, err
+	}
+	return entries, spfRecord, nil
+}
+
+// countVoidExists looks up the addresses of target, the domain of an exists
+// mechanism of the record of node, counting a void lookup when it has none.
+// It only warns when the lookup fails, as the target is not needed to
+// flatten the record.
+func (w *walker) countVoidExists(ctx context.Context, node *Node, target string) {
+	r, err := w.queryDNS(ctx, target, dns.TypeA)
+	if err == nil && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		err = rcodeError(r)
+	}
+	if err != nil {
+		w.warn("failed to resolve exists:%s in %s to count void lookups: %v", target, w.displayDomain(node.Domain), err)
+		return
+	}
+	for _, ans := range r.Answer {
+		if _, ok := ans.(*dns.A); ok {
+			return
+		}
+	}
+	node.VoidLookups++
+}
+
+// checkIgnored fails when an ip4 or ip6 mechanism of the SPF record of
+// domain with a fail, softfail or neutral qualifier matches addresses that
+// later mechanisms of the record, or its redirect, authorize. Receivers
+// reject those addresses, while the flattened record, which leaves the
+// mechanism out, would authorize them. The entries of the record are
+// located by the marks and ends of each kind of mechanism, those of the
+// redirect starting at the "redirect" end. Other mechanisms followed by ones
+// authorizing senders are only warned about, as the addresses they match
+// are not known.
+func (w *walker) checkIgnored(domain string, record *SPFRecord, entries []Entry, marks map[string][]int, ends map[string]int) error {
+	for i, ignored := range record.ignored {
+		var later []Entry
+		for kind, before := range map[string]int{
+			"ip4": ignored.before.ip4, "ip6": ignored.before.ip6, "include": ignored.before.includes,
+			"a": ignored.before.a, "mx": ignored.before.mx, "ptr": ignored.before.ptr,
+		} {
+			if before < len(marks[kind]) {
+				later = append(later, entries[marks[kind][before]:ends[kind]]...)
+			}
+		}
+		if from, ok := ends["redirect"]; ok {
+			later = append(later, entries[from:]...)
+		}
+		if len(later) == 0 {
+			continue
+		}
+		term := record.Ignored[i]
+		if ignored.network == "" {
+			w.warn("%s in %s precedes mechanisms authorizing senders, which the flattened record authorizes even where %s would have matched first", term, w.displayDomain(domain), term)
+			continue
+		}
+		network, err := parseNetwork(ignored.network)
+		if err != nil {
+			continue
+		}
+		for _, entry := range later {
+			if prefix := entry.Prefix(); prefix.IsValid() && prefix.Overlaps(network) {
+				return fmt.Errorf("%w: %s in %s matches part of %s, which a later mechanism authorizes", ErrOverridden, term, w.displayDomain(domain), entry.IP)
+			}
+		}
+	}
+	return nil
+}
+
+// prefetch fetches the SPF record of domain in a new goroutine tracked by
+// wg, along with the addresses of its a and mx mechanisms, and then
+// prefetches the domains it includes or redirects to, so that their answers
+// are ready when the walk, which is serial, reaches them. Domains below
+// MaxDepth, kept, or depending on macros are not prefetched, and errors are
+// left for the walk to report.
+func (w *walker) prefetch(ctx context.Context, wg *sync.WaitGroup, domain string, depth int) {
+	domain, err := toASCII(domain)
+	if err != nil || strings.Contains(domain, "%") || (w.MaxDepth > 0 && depth > w.MaxDepth) || w.isKept(domain) {
+		return
+	}
+	w.mu.Lock()
+	prefetched := w.prefetched[domain]
+	w.prefetched[domain] = true
+	w.mu.Unlock()
+	if prefetched {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case w.workers <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		record := w.prefetchRecord(ctx, domain)
+		<-w.workers
+		if record == nil {
+			return
+		}
+		for _, include := range record.Includes {
+			w.prefetch(ctx, wg, include, depth+1)
+		}
+		if record.Redirect != "" && record.All == "" {
+			w.prefetch(ctx, wg, record.Redirect, depth+1)
+		}
+	}()
+}
+
+// prefetchRecord sends the queries for the SPF record of domain and the
+// addresses of its a, mx and exists mechanisms, returning the parsed record, or nil
+// when it could not be fetched.
+func (w *walker) prefetchRecord(ctx context.Context, domain string) *SPFRecord {
+	r, err := w.queryDNS(ctx, domain, dns.TypeTXT)
+	if err != nil || r.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	for _, ans := range r.Answer {
+		txt, ok := ans.(*dns.TXT)
+		if !ok || !spf.IsRecord(strings.Join(txt.Txt, "")) {
+			continue
+		}
+		record, err := parseSPFRecord(strings.Join(txt.Txt, ""))
+		if err != nil {
+			return nil
+		}
+		var lookups []func() ([]string, uint32, error)
+		addLookup := func(h HostMechanism, lookup func(context.Context, string) ([]string, uint32, error)) {
+			target := h.Domain
+			if target == "" {
+				target = domain
+			}
+			if !strings.Contains(target, "%") {
+				lookups = append(lookups, func() ([]string, uint32, error) {
+					return lookup(ctx, target)
+				})
+			}
+		}
+		for _, a := range record.A {
+			addLookup(a, w.lookupHost)
+		}
+		for _, mx := range record.MX {
+			addLookup(mx, w.lookupMX)
+		}
+		for _, exists := range record.Exists {
+			if !strings.Contains(exists, "%") {
+				lookups = append(lookups, func() ([]string, uint32, error) {
+					_, err := w.queryDNS(ctx, exists, dns.TypeA)
+					return nil, 0, err
+				})
+			}
+		}
+		lookupEach(lookups)
+		return record
+	}
+	return nil
+}
+
+// skip records that term of the SPF record of domain is left out of the result.
+func (w *walker) skip(domain, term, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.skipped = append(w.skipped, SkippedTerm{Domain: domain, Term: term, Reason: reason})
+}
+
+// warn records a warning to report along with the result.
+func (w *walker) warn(format string, args ...any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, fmt.Sprintf(format, args...))
+}
+
+// isKept reports whether domain is one of KeepIncludes.
+func (w *walker) isKept(domain string) bool {
+	return slices.ContainsFunc(w.KeepIncludes, func(kept string) bool {
+		return strings.EqualFold(strings.TrimSuffix(kept, "."), domain)
+	})
+}
+
+// keepInclude reports whether domain is one of KeepIncludes, in which case
+// it is passed through as an include mechanism.
+func (w *walker) keepInclude(domain string) bool {
+	if !w.isKept(domain) {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.terms = append(w.terms, "include:"+domain)
+	return true
+}
+
+// expandTarget expands the static macros in the domain-spec of term. When the
+// target still depends on the message being evaluated it cannot be flattened
+// and ok is false: with AllowMacros the term is passed through unchanged,
+// otherwise it is recorded for flatten to fail with once every record has
+// been resolved, so that all the affected mechanisms are reported at once.
+func (w *walker) expandTarget(term, spec, domain string) (string, bool) {
+	expanded, dynamic := expandMacros(spec, domain)
+	if !dynamic {
+		return expanded, true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.AllowMacros {
+		w.macroTerms = append(w.macroTerms, fmt.Sprintf("%s in %s", term, w.displayDomain(domain)))
+		return "", false
+	}
+	passthrough := expandDomainMacros(term, domain)
+	w.terms = append(w.terms, passthrough)
+	return "", false
+}
+
+// expandMacros expands the macros and escapes of the macro-string spec of a
+// record published on domain when its value is known at flatten time. Only
+// %{d}, the domain the record was published on, is static, while every other
+// macro letter depends on the message being evaluated. When spec has any of
+// them, dynamic is set and only its %{d} macros are expanded, see
+// expandDomainMacros.
+func expandMacros(spec, domain string) (expanded string, dynamic bool) {
+	ms := spf.ParseMacroString(spec)
+	for _, m := range ms.Macros() {
+		if m.Letter != 'd' {
+			return expandDomainMacros(spec, domain), true
+		}
+	}
+	return ms.Expand(func(byte) string { return domain }), false
+}
+
+// expandDomainMacros returns s, a term or modifier of a record published on
+// domain, with its %{d} macros expanded and its other macros and escapes as
+// published, for receivers to expand once the record is republished on
+// another domain.
+func expandDomainMacros(s, domain string) string {
+	var b strings.Builder
+	for _, part := range spf.ParseMacroString(s).Parts {
+		if m, ok := part.(*spf.Macro); ok && m.Letter == 'd' {
+			b.WriteString(m.Expand(domain))
+		} else {
+			b.WriteString(part.String())
+		}
+	}
+	return b.String()
+}
+
+// lookupValidatedPTR approximates a ptr mechanism by performing forward-confirmed
+// reverse DNS on the addresses of domain. Addresses whose validated host name
+// is domain or one of its subdomains are returned.
+func (w *walker) lookupValidatedPTR(ctx context.Context, domain string) ([]string, uint32, error) {
+	hostIPs, ttl, err := w.lookupHost(ctx, domain)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []string
+	for _, ip := range hostIPs {
+		arpa, err := dns.ReverseAddr(ip)
+		if err != nil {
+			continue
+		}
+		r, err := w.queryDNS(ctx, arpa, dns.TypePTR)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ans := range r.Answer {
+			ptr, ok := ans.(*dns.PTR)
+			if !ok {
+				continue
+			}
+			name := strings.TrimSuffix(strings.ToLower(ptr.Ptr), ".")
+			if name != domain && !strings.HasSuffix(name, "."+domain) {
+				continue
+			}
+			forwardIPs, _, err := w.lookupHost(ctx, name)
+			if err != nil {
+				return nil, 0, err
+			}
+			if containsIP(forwardIPs, ip) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+func containsIP(ips []string, ip string) bool {
+	for _, candidate := range ips {
+		if candidate == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupMX returns the addresses of every mail exchanger of domain and the
+// lowest TTL of the records involved.
+func (w *walker) lookupMX(ctx context.Context, domain string) ([]string, uint32, error) {
+	r, err := w.queryDNS(ctx, domain, dns.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return nil, 0, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, rcodeError(r)
+	}
+
+	// The addresses of the exchanges are looked up in a single batch
+	var ttl uint32
+	var exchanges []string
+	var lookups []func() ([]string, uint32, error)
+	for _, ans := range r.Answer {
+		if mx, ok := ans.(*dns.MX); ok {
+			ttl = minTTL(ttl, mx.Hdr.Ttl)
+			exchanges = append(exchanges, mx.Mx)
+			lookups = append(lookups, func() ([]string, uint32, error) {
+				return w.lookupHost(ctx, mx.Mx)
+			})
+		}
+	}
+	var ips []string
+	for i, host := range lookupEach(lookups) {
+		if host.err != nil {
+			return nil, 0, fmt.Errorf("failed to resolve exchange %s: %w", exchanges[i], host.err)
+		}
+		ips = append(ips, host.ips...)
+		if len(host.ips) > 0 {
+			ttl = minTTL(ttl, host.ttl)
+		}
+	}
+	return ips, ttl, nil
+}
+
+// lookupHost returns the A and AAAA addresses of domain and the lowest TTL
+// of their records. A name without addresses is not an error, as an a
+// mechanism simply does not match then.
+func (w *walker) lookupHost(ctx context.Context, domain string) ([]string, uint32, error) {
+	answers, err := w.queryBatch(ctx, domain, dns.TypeA, dns.TypeAAAA)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ips []string
+	var ttl uint32
+	for _, r := range answers {
+		if r.Rcode == dns.RcodeNameError {
+			return nil, 0, nil
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, 0, rcodeError(r)
+		}
+		for _, ans := range r.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+				ttl = minTTL(ttl, rr.Hdr.Ttl)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+				ttl = minTTL(ttl, rr.Hdr.Ttl)
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+// minTTL returns the lower of two TTLs, treating 0 as not yet set.
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
+
+// applyCIDR applies the IPv4 and IPv6 cidr-lengths of an a or mx mechanism
+// to the resolved addresses, turning them into the networks they authorize.
+// Addresses whose family has no cidr-length are kept as host addresses.
+func applyCIDR(ips []string, cidr4, cidr6 string) []string {
+	if cidr4 == "" && cidr6 == "" {
+		return ips
+	}
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		cidr := cidr6
+		if net.ParseIP(ip).To4() != nil {
+			cidr = cidr4
+		}
+		if cidr != "" {
+			if _, network, err := net.ParseCIDR(ip + "/" + cidr); err == nil {
+				ip = network.String()
+			}
+		}
+		result = append(result, ip)
+	}
+	return result
+}
+
+// toASCII converts domain to its lowercase A-label form (RFC 5891).
+func toASCII(domain string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name %s: %w", domain, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+func (w *walker) queryDNS(ctx context.Context, domain string, qtype uint16) (*dns.Msg, error) {
+	name, err := toASCII(domain)
+	if err != nil {
+		return nil, err
+	}
+	if w.answers == nil {
+		return w.lookup(ctx, name, qtype)
+	}
+
+	// Records are prefetched, so each query is sent once and its answer
+	// shared with the walk.
+	key := dns.Fqdn(name) + " " + dns.TypeToString[qtype]
+	w.mu.Lock()
+	a, ok := w.answers[key]
+	if !ok {
+		a = &answer{done: make(chan struct{})}
+		w.answers[key] = a
+	}
+	w.mu.Unlock()
+	if !ok {
+		a.r, a.err = w.lookup(ctx, name, qtype)
+		close(a.done)
+		return a.r, a.err
+	}
+	select {
+	case <-a.done:
+		return a.r, a.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// answer is the answer to a query, once done is closed.
+type answer struct {
+	done chan struct{}
+	r    *dns.Msg
+	err  error
+}
+
+// lookup sends a query for the ASCII name, to its authoritative servers
+// with Authoritative.
+func (w *walker) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if w.Authoritative {
+		return w.queryAuthoritative(ctx, dns.Fqdn(name), qtype)
+	}
+	return w.query(ctx, dns.Fqdn(name), qtype, w.resolvers, true)
+}
+
+// query sends a query for name to each of servers in turn until one answers
+// without SERVFAIL, retrying as configured, unless the answer is cached.
+// recursive sets the RD flag, which is cleared for queries to authoritative
+// servers.
+func (w *walker) query(ctx context.Context, name string, qtype uint16, servers []string, recursive bool) (r *dns.Msg, err error) {
+	var ednsSize uint16
+	if !w.NoEDNS {
+		ednsSize = w.EDNSSize
+	}
+	key := cacheKey(name, qtype, servers, recursive, ednsSize, w.DNSSEC)
+	if packed, ok := w.Cache.Get(key); ok {
+		cached := new(dns.Msg)
+		if cached.Unpack(packed) == nil {
+			return cached, nil
+		}
+	}
+	defer func() {
+		if err == nil {
+			if ttl := cacheTTL(r); ttl > 0 {
+				if packed, err := r.Pack(); err == nil {
+					w.Cache.Set(key, packed, ttl)
+				}
+			}
+		}
+	}()
+
+	w.mu.Lock()
+	w.queries++
+	w.mu.Unlock()
+
+	var lastServer string
+	if w.OnLookup != nil {
+		start := time.Now()
+		defer func() {
+			event := LookupEvent{Name: name, Type: qtype, Server: lastServer, Duration: time.Since(start), Err: err}
+			if r != nil {
+				event.Rcode = r.Rcode
+			}
+			w.mu.Lock()
+			w.OnLookup(event)
+			w.mu.Unlock()
+		}()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = recursive
+	if !w.NoEDNS {
+		m.SetEdns0(w.EDNSSize, w.DNSSEC)
+	}
+	m.AuthenticatedData = w.DNSSEC
+
+	backoff := w.Backoff
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			delay := backoff
+			if w.Jitter > 0 {
+				delay += rand.N(w.Jitter)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("DNS query failed: %w", ctx.Err())
+			}
+			backoff *= 2
+		}
+		for _, server := range servers {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("DNS query failed: %w", ctx.Err())
+			}
+			lastServer = server
+			r, err = w.exchange(ctx, m, server)
+			if err == nil && r.Rcode != dns.RcodeServerFailure {
+				if w.DNSSEC && !r.AuthenticatedData {
+					return nil, fmt.Errorf("%s answer for %s from %s is not authenticated by DNSSEC", dns.TypeToString[qtype], name, server)
+				}
+				return r, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, &DNSError{Name: name, Type: qtype, Err: err}
+	}
+	return r, nil
+}
+
+// lookupPublished returns the character-strings of each SPF record
+// currently published on domain, see Flattener.LookupPublished.
+func (w *walker) lookupPublished(ctx context.Context, domain string) ([][]string, error) {
+	r, err := w.queryDNS(ctx, domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return nil, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rcodeError(r)
+	}
+
+	var published [][]string
+	for _, ans := range r.Answer {
+		if txt, ok := ans.(*dns.TXT); ok && spf.IsRecord(strings.Join(txt.Txt, "")) {
+			published = append(published, txt.Txt)
+		}
+	}
+	return published, nil
+}
+
+// unregisteredDomain returns the registrable domain of the nonexistent
+// domain, such as example.com for _spf.example.com, when it does not exist
+// either, and the empty string when it does. A registered domain always
+// exists, as its zone apex holds the SOA and NS records.
+func (w *walker) unregisteredDomain(ctx context.Context, domain string) (string, error) {
+	base, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		// domain is a public suffix itself
+		return "", nil
+	}
+	if base == domain {
+		return base, nil
+	}
+	r, err := w.queryDNS(ctx, base, dns.TypeNS)
+	if err != nil {
+		return "", err
+	}
+	if r.Rcode != dns.RcodeNameError {
+		return "", nil
+	}
+	return base, nil
+}
+
+func (w *walker) getSPFRecord(ctx context.Context, domain string) (*SPFRecord, error) {
+	r, err := w.queryDNS(ctx, domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Rcode == dns.RcodeNameError {
+		base, err := w.unregisteredDomain(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		if base != "" {
+			return nil, fmt.Errorf("%w for domain %s, which does not exist: %w %s, which anyone could register to authorize their own senders", ErrNoSPFRecord, w.displayDomain(domain), ErrUnregisteredDomain, w.displayDomain(base))
+		}
+		return nil, fmt.Errorf("%w for domain %s, which does not exist", ErrNoSPFRecord, w.displayDomain(domain))
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, rcodeError(r)
+	}
+
+	var spfTxts []string
+	var ttl uint32
+	for _, ans := range r.Answer {
+		if txt, ok := ans.(*dns.TXT); ok {
+			// Concatenate all strings in the TXT record to build the complete record,
+			// as records longer than 255 characters are split into several strings
+			// without any separator (RFC 7208 section 3.3)
+			fullTxt := strings.Join(txt.Txt, "")
+			if spf.IsRecord(fullTxt) {
+				spfTxts = append(spfTxts, fullTxt)
+				if len(spfTxts) == 1 {
+					ttl = txt.Hdr.Ttl
+				}
+			}
+		}
+	}
+
+	if len(spfTxts) == 0 {
+		return nil, fmt.Errorf("%w for domain %s", ErrNoSPFRecord, w.displayDomain(domain))
+	}
+
+	// Publishing more than one SPF record is a permerror (RFC 7208 section 4.5)
+	if len(spfTxts) > 1 {
+		if w.Strict {
+			return nil, fmt.Errorf("%w for domain %s: %q", ErrMultipleSPFRecords, w.displayDomain(domain), spfTxts)
+		}
+		w.warn("multiple SPF records found for domain %s, using the first:\n  %s", w.displayDomain(domain), strings.Join(spfTxts, "\n  "))
+	}
+
+	record, err := parseSPFRecord(spfTxts[0])
+	if err != nil {
+		return nil, err
+	}
+	record.TTL = ttl
+	for _, e := range record.Invalid {
+		if w.Strict {
+			return nil, fmt.Errorf("invalid SPF record of %s: %w", w.displayDomain(domain), e)
+		}
+		w.skip(domain, e.Term, fmt.Sprintf("invalid term: column %d: %s", e.Offset+1, e.Msg))
+	}
+	return record, nil
+}
@@ -0,0 +1,27 @@
+package spfflatten
+
+import "testing"
+
+func TestExpandMacros(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expanded string
+		dynamic  bool
+	}{
+		{"_spf.%{d}", "_spf.example.com", false},
+		{"%{d2}", "example.com", false},
+		{"%{dr}.rev", "com.example.rev", false},
+		{"%{D}", "example.com", false},
+		{"a%%b%_c%-d.%{d}", "a%b c%20d.example.com", false},
+		{"%{i}._spf.%{d}", "%{i}._spf.example.com", true},
+		{"%{ir}.%{v}.%%.%{d}", "%{ir}.%{v}.%%.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			expanded, dynamic := expandMacros(tt.spec, "example.com")
+			if expanded != tt.expanded || dynamic != tt.dynamic {
+				t.Errorf("expandMacros(%q) = %q, %v, want %q, %v", tt.spec, expanded, dynamic, tt.expanded, tt.dynamic)
+			}
+		})
+	}
+}
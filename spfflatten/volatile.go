@@ -0,0 +1,29 @@
+package spfflatten
+
+import "strings"
+
+// volatileIncludes maps the include domains of large email service
+// providers known to change their addresses frequently to the name of the
+// provider. A flattened copy of their records goes stale within days or
+// weeks, so flattening them is only safe when it is repeated regularly.
+var volatileIncludes = map[string]string{
+	"_spf.google.com":            "Google Workspace",
+	"spf.protection.outlook.com": "Microsoft 365",
+	"amazonses.com":              "Amazon SES",
+	"sendgrid.net":               "SendGrid",
+	"servers.mcsv.net":           "Mailchimp",
+	"spf.mandrillapp.com":        "Mandrill",
+	"mailgun.org":                "Mailgun",
+	"_spf.salesforce.com":        "Salesforce",
+	"spf.sendinblue.com":         "Brevo",
+	"_spf.mlsend.com":            "MailerLite",
+	"mail.zendesk.com":           "Zendesk",
+	"_spf.createsend.com":        "Campaign Monitor",
+}
+
+// VolatileProvider returns the name of the provider of domain when it is a
+// known include domain whose addresses change frequently.
+func VolatileProvider(domain string) (string, bool) {
+	provider, ok := volatileIncludes[strings.TrimSuffix(strings.ToLower(domain), ".")]
+	return provider, ok
+}
@@ -0,0 +1,96 @@
+// Package spfpublish registers publishers updating the SPF records of a zone
+// hosted by a DNS provider, which the publish command of dns-spf-flatten
+// offers as -provider alongside its built-in providers. A publisher is
+// compiled in by importing the package registering it for its side effects.
+package spfpublish
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Config is what publishers are created from.
+type Config struct {
+	// Zone is the zone holding the records, without a trailing dot.
+	Zone string
+	// Credentials is the file given with -credentials, which overrides the
+	// credentials of the environment when not empty.
+	Credentials string
+	// Endpoint overrides the base URL of the API when not empty.
+	Endpoint string
+	// Header holds the fields of -header.
+	Header http.Header
+	TTL    int
+	Client *http.Client
+	// LookupSPF returns the SPF records DNS resolvers answer with for name,
+	// for the publishers of providers whose records cannot be read back.
+	LookupSPF func(ctx context.Context, name string) ([]string, error)
+}
+
+// Publisher updates the SPF records of a zone hosted by a DNS provider. The
+// names given to its methods are fully qualified names in the zone, without
+// a trailing dot, and the values are SPF records such as "v=spf1 -all".
+type Publisher interface {
+	// Current returns the SPF records the provider holds for name, which
+	// may differ from those DNS resolvers answer with until the change
+	// propagates. Changes are only applied when they differ.
+	Current(ctx context.Context, name string) ([]string, error)
+	// Apply replaces the SPF record of name with value, leaving the other
+	// TXT records of name in place. An empty value removes the SPF record.
+	Apply(ctx context.Context, name, value string) error
+	// Verify checks that the provider holds the SPF record of value for
+	// name, or none when value is empty, once Apply returned.
+	Verify(ctx context.Context, name, value string) error
+}
+
+// Factory returns the publisher of a provider for config.
+type Factory func(config Config) (Publisher, error)
+
+// factories holds the registered publishers by provider name.
+var factories struct {
+	mu     sync.RWMutex
+	byName map[string]Factory
+}
+
+// Register makes the publisher of factory available as the provider name,
+// such as for the -provider flag of the command line tool when called from
+// the init function of a package it imports. It panics when name is already
+// registered or factory is nil.
+func Register(name string, factory Factory) {
+	factories.mu.Lock()
+	defer factories.mu.Unlock()
+	if factory == nil {
+		panic(fmt.Sprintf("spfpublish: provider %q registered with a nil factory", name))
+	}
+	if _, ok := factories.byName[name]; ok {
+		panic(fmt.Sprintf("spfpublish: provider %q registered twice", name))
+	}
+	if factories.byName == nil {
+		factories.byName = make(map[string]Factory)
+	}
+	factories.byName[name] = factory
+}
+
+// Lookup returns the factory registered as the provider name.
+func Lookup(name string) (Factory, bool) {
+	factories.mu.RLock()
+	defer factories.mu.RUnlock()
+	factory, ok := factories.byName[name]
+	return factory, ok
+}
+
+// Providers returns the names of the registered providers in alphabetical
+// order.
+func Providers() []string {
+	factories.mu.RLock()
+	defer factories.mu.RUnlock()
+	var names []string
+	for name := range factories.byName {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
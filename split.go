@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// PublishedRecord is a TXT record to publish in DNS.
+type PublishedRecord struct {
+	Name  string
+	Value string
+}
+
+// buildRecords returns the records to publish on opts.Domain: the chained
+// records of -output split, or a single record otherwise.
+func buildRecords(result *spfflatten.Result, opts spfflatten.FormatOptions) ([]PublishedRecord, error) {
+	if opts.Output == outputSplit {
+		return splitRecords(result, opts)
+	}
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return nil, err
+	}
+	return []PublishedRecord{{Name: opts.Domain, Value: record}}, nil
+}
+
+// splitRecords distributes the flattened addresses over as many included
+// records as needed to keep each of them within the size budget. The first
+// returned record is the root record, which includes the others and carries
+// the passed-through mechanisms, the all mechanism and the modifiers.
+func splitRecords(result *spfflatten.Result, opts spfflatten.FormatOptions) ([]PublishedRecord, error) {
+	addresses := addressTerms(result)
+	trailing := trailingTerms(result, opts)
+
+	root, err := formatRecord(append(addresses, trailing...))
+	if err != nil {
+		return nil, err
+	}
+	if len(root) <= opts.SplitSize {
+		return []PublishedRecord{{Name: opts.Domain, Value: root}}, nil
+	}
+
+	// The addresses are valid terms, as the whole record was assembled
+	// from them above.
+	var children []PublishedRecord
+	var current []string
+	for _, term := range addresses {
+		if single, _ := formatRecord([]string{term}); len(single) > opts.SplitSize {
+			return nil, fmt.Errorf("record size %d is too small to hold %s", opts.SplitSize, term)
+		}
+		if next, _ := formatRecord(append(current, term)); len(next) > opts.SplitSize {
+			value, _ := formatRecord(current)
+			children = append(children, PublishedRecord{Value: value})
+			current = nil
+		}
+		current = append(current, term)
+	}
+	if len(current) > 0 {
+		value, _ := formatRecord(current)
+		children = append(children, PublishedRecord{Value: value})
+	}
+
+	var includes []string
+	for i := range children {
+		children[i].Name = strings.Replace(opts.SplitTemplate, "%d", strconv.Itoa(i+1), 1) + "." + opts.Domain
+		includes = append(includes, "include:"+children[i].Name)
+	}
+
+	rootValue, err := formatRecord(append(includes, trailing...))
+	if err != nil {
+		return nil, err
+	}
+	if len(rootValue) > opts.SplitSize {
+		return nil, fmt.Errorf("root record of %d bytes exceeds the record size of %d bytes", len(rootValue), opts.SplitSize)
+	}
+	return append([]PublishedRecord{{Name: opts.Domain, Value: rootValue}}, children...), nil
+}
+
+// splitWarnings returns the warnings about records, the records of -output
+// split with the root record first, for the flattened result.
+func splitWarnings(result *spfflatten.Result, records []PublishedRecord, opts spfflatten.FormatOptions) []string {
+	if lookups := len(records) - 1 + result.Lookups; lookups > opts.LookupBudget {
+		return []string{fmt.Sprintf("root record requires %d DNS lookups, exceeding the limit of %d", lookups, opts.LookupBudget)}
+	}
+	return nil
+}
+
+// relativeName returns name relative to the zone domain, "@" being the apex.
+func relativeName(name, domain string) string {
+	name = strings.TrimSuffix(name, ".")
+	domain = strings.TrimSuffix(domain, ".")
+	if strings.EqualFold(name, domain) {
+		return "@"
+	}
+	if len(name) > len(domain) && strings.EqualFold(name[len(name)-len(domain)-1:], "."+domain) {
+		return name[:len(name)-len(domain)-1]
+	}
+	return name + "."
+}
+
+// printRecords prints records in zone file presentation format, splitting
+// long values into several character-strings.
+func printRecords(w io.Writer, records []PublishedRecord) {
+	for _, record := range records {
+		chunks := spf.Chunk(record.Value)
+		fmt.Fprintf(w, "%s. IN TXT %s\n", strings.TrimSuffix(record.Name, "."), quoteChunks(chunks))
+		if len(chunks) > 1 {
+			printChunkSizes(record.Name, chunks)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// writeSummary writes statistics about the flattened result and the records
+// it was built from.
+func writeSummary(w io.Writer, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	ip4, ip6 := splitFamilies(result)
+	fmt.Fprintf(w, "Entries: %d ip4, %d ip6\n", len(ip4), len(ip6))
+	fmt.Fprintf(w, "Record length: %d bytes\n", len(record))
+	fmt.Fprintf(w, "DNS lookups: %d in the original records, %d in the flattened record\n", originalLookups(result.Tree), result.Lookups)
+	fmt.Fprintf(w, "DNS queries performed: %d\n", result.Queries)
+	fmt.Fprintf(w, "Maximum include depth: %d\n", maxDepth(result.Tree))
+	return nil
+}
+
+// originalLookups returns the number of DNS lookups evaluating the records
+// in the tree consumes.
+func originalLookups(nodes []*spfflatten.Node) int {
+	lookups := 0
+	for _, node := range nodes {
+		lookups += node.Lookups + originalLookups(node.Children)
+	}
+	return lookups
+}
+
+// maxDepth returns the number of nested includes and redirects below the
+// deepest top-level include domain.
+func maxDepth(nodes []*spfflatten.Node) int {
+	depth := 0
+	for _, node := range nodes {
+		if len(node.Children) > 0 {
+			depth = max(depth, 1+maxDepth(node.Children))
+		}
+	}
+	return depth
+}
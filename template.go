@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// templateData is the data a -template is executed with.
+type templateData struct {
+	*spfflatten.Result
+	// Record is the complete flattened SPF record.
+	Record string
+	// Domain is the value of -domain.
+	Domain string
+	// Records are the records to publish on Domain, split according to
+	// -output split. It is empty when no -domain is given.
+	Records []PublishedRecord
+}
+
+// templateFuncs are the functions available to templates in addition to
+// the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"join":   strings.Join,
+	"tag":    tagIP,
+	"isIPv4": spfflatten.IsIPv4,
+}
+
+// writeTemplate executes the Go text/template in file with the result.
+func writeTemplate(w io.Writer, file string, result *spfflatten.Result, opts spfflatten.FormatOptions) error {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(file).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+
+	record, err := generatedRecord(result, opts)
+	if err != nil {
+		return err
+	}
+	data := templateData{
+		Result: result,
+		Record: record,
+		Domain: opts.Domain,
+	}
+	if opts.Domain != "" {
+		if data.Records, err = buildRecords(result, opts); err != nil {
+			return err
+		}
+	}
+	return tmpl.Execute(w, data)
+}
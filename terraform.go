@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+const formatTerraform = "terraform"
+
+// Resource types written by -format terraform.
+const (
+	terraformRoute53    = "route53"
+	terraformCloudflare = "cloudflare"
+)
+
+// writeTerraform writes one DNS record resource per record. The zone is
+// referenced as var.zone_id, which the surrounding configuration defines.
+func writeTerraform(w io.Writer, records []PublishedRecord, opts spfflatten.FormatOptions) error {
+	for i, record := range records {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		name := strings.TrimSuffix(record.Name, ".")
+		switch opts.TerraformProvider {
+		case terraformCloudflare:
+			// Cloudflare splits long TXT values into character-strings itself
+			fmt.Fprintf(w, "resource \"cloudflare_record\" %s {\n", hclString(resourceName(name)))
+			fmt.Fprintf(w, "  zone_id = var.zone_id\n")
+			fmt.Fprintf(w, "  name    = %s\n", hclString(name))
+			fmt.Fprintf(w, "  type    = \"TXT\"\n")
+			fmt.Fprintf(w, "  ttl     = %d\n", opts.TTL)
+			fmt.Fprintf(w, "  content = %s\n", hclString(record.Value))
+			fmt.Fprintf(w, "}\n")
+		default:
+			// Route 53 takes the character-strings of a value longer than 255
+			// bytes separated by "" within a single record
+			value := strings.Join(spf.Chunk(record.Value), `""`)
+			fmt.Fprintf(w, "resource \"aws_route53_record\" %s {\n", hclString(resourceName(name)))
+			fmt.Fprintf(w, "  zone_id = var.zone_id\n")
+			fmt.Fprintf(w, "  name    = %s\n", hclString(name))
+			fmt.Fprintf(w, "  type    = \"TXT\"\n")
+			fmt.Fprintf(w, "  ttl     = %d\n", opts.TTL)
+			fmt.Fprintf(w, "  records = [%s]\n", hclString(value))
+			fmt.Fprintf(w, "}\n")
+		}
+	}
+	return nil
+}
+
+// resourceName derives a Terraform resource name from a record name.
+func resourceName(name string) string {
+	return "spf_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// hclString quotes s as an HCL string literal. Template sequences are escaped
+// so that SPF macros such as %{i} are not interpreted by Terraform.
+func hclString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "${", "$${")
+	s = strings.ReplaceAll(s, "%{", "%%{")
+	return `"` + s + `"`
+}
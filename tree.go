@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// writeTree writes the include tree indented like tree(1), each domain
+// followed by the lookups its record consumes and the entries it
+// contributes.
+func writeTree(w io.Writer, result *spfflatten.Result) error {
+	for _, root := range result.Tree {
+		fmt.Fprintln(w, nodeLabel(root))
+		writeSubtree(w, root.Children, "")
+	}
+	return nil
+}
+
+// writeSubtree writes nodes below a parent, prefixing each line with indent.
+func writeSubtree(w io.Writer, nodes []*spfflatten.Node, indent string) {
+	for i, node := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%s%s%s:%s\n", indent, branch, node.Via, nodeLabel(node))
+		writeSubtree(w, node.Children, indent+next)
+	}
+}
+
+// nodeLabel returns the domain of node with its counts.
+func nodeLabel(node *spfflatten.Node) string {
+	if node.Repeated {
+		return node.Domain + " (already visited)"
+	}
+	return fmt.Sprintf("%s (%d lookups, %d ip4, %d ip6)", node.Domain, node.Lookups, node.IP4, node.IP6)
+}
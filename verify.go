@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/perryh/dns-spf-flatten/spfflatten"
+)
+
+// verifyResolvers flattens the SPF records separately against each
+// resolver of config and reports the terms of the generated record that not
+// every resolver returned, such as because of split-horizon DNS or stale
+// caches. It returns whether all resolvers agreed.
+func verifyResolvers(ctx context.Context, w io.Writer, config spfflatten.Options, req spfflatten.Request) bool {
+	var order []string
+	seenBy := make(map[string][]string)
+	var succeeded []string
+	for _, resolver := range config.Resolvers {
+		options := config
+		options.Resolvers = []string{resolver}
+		result, err := spfflatten.New(options).Flatten(ctx, req)
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", resolver, describeFlattenError(err))
+			continue
+		}
+		succeeded = append(succeeded, resolver)
+
+		terms := append(result.IPs(), result.Terms...)
+		if result.All != "" {
+			terms = append(terms, result.All)
+		}
+		for _, term := range terms {
+			if _, ok := seenBy[term]; !ok {
+				order = append(order, term)
+			}
+			seenBy[term] = append(seenBy[term], resolver)
+		}
+	}
+
+	consistent := len(succeeded) == len(config.Resolvers)
+	for _, term := range order {
+		if len(seenBy[term]) == len(succeeded) {
+			continue
+		}
+		consistent = false
+		var missing []string
+		for _, resolver := range succeeded {
+			if !slices.Contains(seenBy[term], resolver) {
+				missing = append(missing, resolver)
+			}
+		}
+		fmt.Fprintf(w, "%s: returned by %s, missing from %s\n", term, strings.Join(seenBy[term], ", "), strings.Join(missing, ", "))
+	}
+
+	if consistent {
+		fmt.Fprintf(w, "All %d resolvers returned the same %d terms\n", len(config.Resolvers), len(order))
+	}
+	return consistent
+}
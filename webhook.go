@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/perryh/dns-spf-flatten/spf"
+	"github.com/perryh/dns-spf-flatten/spfpublish"
+)
+
+const providerWebhook = "webhook"
+
+func init() {
+	spfpublish.Register(providerWebhook, newWebhook)
+}
+
+// webhook publishes records by posting each change as JSON to the URL of
+// -url, for in-house DNS systems to apply. Requests carry the fields of
+// -header and, with a secret from WEBHOOK_SECRET or -credentials, the
+// HMAC-SHA256 of their body in X-Signature-256.
+type webhook struct {
+	spfpublish.Config
+	secret string
+}
+
+// webhookChange is the document posted for each change of the SPF record of
+// a name.
+type webhookChange struct {
+	// Action is publish to replace the SPF record of the name with Value,
+	// or remove to delete it, leaving the other TXT records of the name in
+	// place either way.
+	Action string `json:"action"`
+	Zone   string `json:"zone"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	TTL    int    `json:"ttl"`
+	Value  string `json:"value,omitempty"`
+	// Strings is Value split into the character-strings of the TXT record.
+	Strings []string `json:"strings,omitempty"`
+}
+
+// newWebhook returns a publisher posting the changes of the zone of config.
+func newWebhook(config spfpublish.Config) (spfpublish.Publisher, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("no URL: pass -url with the URL to post the changes to")
+	}
+	var secret string
+	if config.Credentials != "" || os.Getenv("WEBHOOK_SECRET") != "" {
+		var err error
+		if secret, err = readCredentials(config.Credentials, "WEBHOOK_SECRET"); err != nil {
+			return nil, err
+		}
+	}
+	return &webhook{Config: config, secret: secret}, nil
+}
+
+// Current returns the SPF records DNS resolvers answer with for name, as
+// the records cannot be read back from the in-house system.
+func (w *webhook) Current(ctx context.Context, name string) ([]string, error) {
+	if w.LookupSPF == nil {
+		return nil, errors.New("no DNS lookup to read the SPF records with")
+	}
+	return w.LookupSPF(ctx, name)
+}
+
+// Apply posts the change of the SPF record of name.
+func (w *webhook) Apply(ctx context.Context, name, value string) error {
+	change := webhookChange{Action: "publish", Zone: w.Zone, Name: name, Type: "TXT", TTL: w.TTL, Value: value}
+	if value == "" {
+		change.Action = "remove"
+	} else {
+		change.Strings = spf.Chunk(value)
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	header := w.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return doJSON(ctx, w.Client, http.MethodPost, w.Endpoint, header, json.RawMessage(body), nil)
+}
+
+// Verify accepts the change of name once acknowledged, as the in-house
+// system may apply it later, which the propagation wait checks instead.
+func (w *webhook) Verify(ctx context.Context, name, value string) error {
+	return nil
+}